@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// Chain is the settlement backend a Host registers on, finds peers through and
+// settles trustline debt over. FakeChain over HTTP is one implementation.
+type Chain interface {
+	// Register adds id with a starting balance. Registering an existing id
+	// with the same password only refreshes its PeerInfo.
+	Register(id string, balance uint32, password string, pi PeerInfo) error
+	// Users returns every registered user with its balance and PeerInfo.
+	Users() (map[string]PeerDetails, error)
+	// Pay moves amount from sender to receiver on the chain. A non-empty
+	// ref is kept with the transfer so Paid can find it later.
+	Pay(sender string, receiver string, password string, amount uint32, ref string) error
+	// Paid tells whether sender made a transfer with ref. A chain that
+	// doesn't keep refs returns errNoTransfers.
+	Paid(sender string, ref string) (bool, error)
+	// Balance returns the on-chain balance of id.
+	Balance(id string) (uint32, error)
+	// Reset deletes all users.
+	Reset() error
+}
+
+// Errors every Chain returns for refused operations. The HTTP client maps
+// FakeChain response bodies onto them.
+var (
+	errUnknownUser       = errors.New("unknown user")
+	errInvalidKey        = errors.New("invalid private key")
+	errInsufficientFunds = errors.New("insufficient funds")
+	errNoTransfers       = errors.New("chain can't look up transfers")
+)
+
+// newChain builds the backend selected with --chain.
+func newChain(kind string, ledger string) (Chain, error) {
+	switch kind {
+	case "http", "":
+		return &httpChain{}, nil
+	case "memory":
+		return newMemChain(), nil
+	case "file":
+		return newFileChain(ledger), nil
+	}
+	return nil, fmt.Errorf("unknown chain %q, should be one of http, memory or file", kind)
+}
+
+type chainUser struct {
+	Balance  uint32
+	Password string
+	PeerInfo string
+}
+
+// memChain keeps the whole ledger in memory. It backs FakechainServer and is
+// handy for tests that want settlement without HTTP.
+type memChain struct {
+	mu    sync.Mutex
+	users map[string]*chainUser
+	// Transfer refs, by sender
+	refs map[string]map[string]bool
+}
+
+func newMemChain() *memChain {
+	return &memChain{users: make(map[string]*chainUser), refs: make(map[string]map[string]bool)}
+}
+
+func (c *memChain) Register(id string, balance uint32, password string, pi PeerInfo) error {
+	pb, err := json.Marshal(pi)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.register(id, balance, password, string(pb))
+}
+
+func (c *memChain) register(id string, balance uint32, password string, peerInfo string) error {
+	if u, ok := c.users[id]; ok {
+		if u.Password != password {
+			return errInvalidKey
+		}
+		u.PeerInfo = peerInfo
+		return nil
+	}
+	c.users[id] = &chainUser{Balance: balance, Password: password, PeerInfo: peerInfo}
+	return nil
+}
+
+func (c *memChain) Users() (map[string]PeerDetails, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	data := make(map[string]PeerDetails)
+	for id, u := range c.users {
+		var pi PeerInfo
+		json.Unmarshal([]byte(u.PeerInfo), &pi)
+		data[id] = PeerDetails{Balance: u.Balance, PeerInfo: pi}
+	}
+	return data, nil
+}
+
+func (c *memChain) Pay(sender string, receiver string, password string, amount uint32, ref string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.pay(sender, receiver, password, amount, ref)
+}
+
+func (c *memChain) pay(sender string, receiver string, password string, amount uint32, ref string) error {
+	from, ok := c.users[sender]
+	if !ok {
+		return fmt.Errorf("%w %s", errUnknownUser, sender)
+	}
+	to, ok := c.users[receiver]
+	if !ok {
+		return fmt.Errorf("%w %s", errUnknownUser, receiver)
+	}
+	if from.Password != password {
+		return errInvalidKey
+	}
+	if from.Balance < amount {
+		return errInsufficientFunds
+	}
+	from.Balance -= amount
+	to.Balance += amount
+	if ref != "" {
+		if c.refs[sender] == nil {
+			c.refs[sender] = make(map[string]bool)
+		}
+		c.refs[sender][ref] = true
+	}
+	return nil
+}
+
+func (c *memChain) Paid(sender string, ref string) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.refs[sender][ref], nil
+}
+
+func (c *memChain) Balance(id string) (uint32, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	u, ok := c.users[id]
+	if !ok {
+		return 0, fmt.Errorf("%w %s", errUnknownUser, id)
+	}
+	return u.Balance, nil
+}
+
+func (c *memChain) Reset() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.users = make(map[string]*chainUser)
+	c.refs = make(map[string]map[string]bool)
+	return nil
+}
+
+// fileChain is a local append-only ledger. Every register and pay is appended
+// to the file as one JSON line and the balances are rebuilt by replaying it, so
+// several nodes on one machine can share a ledger file. Appends are only
+// serialized within a process.
+type fileChain struct {
+	mu   sync.Mutex
+	path string
+}
+
+// ledgerEntry is one line of a fileChain ledger. Passwords are stored hashed.
+type ledgerEntry struct {
+	Op       string `json:"op"`
+	ID       string `json:"id,omitempty"`
+	Sender   string `json:"sender,omitempty"`
+	Receiver string `json:"receiver,omitempty"`
+	Amount   uint32 `json:"amount"`
+	Ref      string `json:"ref,omitempty"`
+	Password string `json:"password,omitempty"`
+	PeerInfo string `json:"peering_info,omitempty"`
+}
+
+func newFileChain(path string) *fileChain {
+	return &fileChain{path: path}
+}
+
+func hashPassword(password string) string {
+	h := sha256.Sum256([]byte(password))
+	return hex.EncodeToString(h[:])
+}
+
+// replay rebuilds the ledger state from the file.
+func (c *fileChain) replay() (*memChain, error) {
+	mc := newMemChain()
+	f, err := os.Open(c.path)
+	if os.IsNotExist(err) {
+		return mc, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var e ledgerEntry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("corrupt ledger %s: %v", c.path, err)
+		}
+		// Entries were validated before they were appended, so errors here
+		// can only come from a hand-edited file and are skipped.
+		switch e.Op {
+		case "register":
+			mc.register(e.ID, e.Amount, e.Password, e.PeerInfo)
+		case "pay":
+			mc.pay(e.Sender, e.Receiver, e.Password, e.Amount, e.Ref)
+		case "reset":
+			mc.users = make(map[string]*chainUser)
+			mc.refs = make(map[string]map[string]bool)
+		}
+	}
+	return mc, sc.Err()
+}
+
+func (c *fileChain) append(e *ledgerEntry) error {
+	f, err := os.OpenFile(c.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (c *fileChain) Register(id string, balance uint32, password string, pi PeerInfo) error {
+	pb, err := json.Marshal(pi)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	mc, err := c.replay()
+	if err != nil {
+		return err
+	}
+	e := &ledgerEntry{Op: "register", ID: id, Amount: balance, Password: hashPassword(password), PeerInfo: string(pb)}
+	if err := mc.register(e.ID, e.Amount, e.Password, e.PeerInfo); err != nil {
+		return err
+	}
+	return c.append(e)
+}
+
+func (c *fileChain) Users() (map[string]PeerDetails, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	mc, err := c.replay()
+	if err != nil {
+		return nil, err
+	}
+	return mc.Users()
+}
+
+func (c *fileChain) Pay(sender string, receiver string, password string, amount uint32, ref string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	mc, err := c.replay()
+	if err != nil {
+		return err
+	}
+	e := &ledgerEntry{Op: "pay", Sender: sender, Receiver: receiver, Amount: amount, Ref: ref, Password: hashPassword(password)}
+	if err := mc.pay(e.Sender, e.Receiver, e.Password, e.Amount, e.Ref); err != nil {
+		return err
+	}
+	return c.append(e)
+}
+
+func (c *fileChain) Paid(sender string, ref string) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	mc, err := c.replay()
+	if err != nil {
+		return false, err
+	}
+	return mc.Paid(sender, ref)
+}
+
+func (c *fileChain) Balance(id string) (uint32, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	mc, err := c.replay()
+	if err != nil {
+		return 0, err
+	}
+	return mc.Balance(id)
+}
+
+func (c *fileChain) Reset() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.append(&ledgerEntry{Op: "reset"})
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestChains(t *testing.T) {
+	chains := map[string]func(t *testing.T) Chain{
+		"memory": func(t *testing.T) Chain { return newMemChain() },
+		"file": func(t *testing.T) Chain {
+			return newFileChain(filepath.Join(t.TempDir(), "ledger.jsonl"))
+		},
+		"http": func(t *testing.T) Chain {
+			useLocalFakechain(t)
+			return &httpChain{}
+		},
+	}
+	for name, mk := range chains {
+		t.Run(name, func(t *testing.T) {
+			c := mk(t)
+			if err := c.Register("alice", 100, "pw1", PeerInfo{IP: "127.0.0.1", Port: 4000}); err != nil {
+				t.Fatal(err)
+			}
+			if err := c.Register("bob", 10, "pw2", PeerInfo{IP: "127.0.0.1", Port: 4001}); err != nil {
+				t.Fatal(err)
+			}
+			if err := c.Pay("alice", "bob", "pw1", 40, "t1"); err != nil {
+				t.Fatal(err)
+			}
+			if err := c.Pay("bob", "alice", "pw2", 1000, ""); err == nil {
+				t.Fatal("overdraft succeeded")
+			}
+			if err := c.Pay("alice", "bob", "pw2", 1, "t2"); err == nil {
+				t.Fatal("payment with wrong password succeeded")
+			}
+			// Only the transfer that went through is found by its ref
+			for ref, want := range map[string]bool{"t1": true, "t2": false} {
+				if paid, err := c.Paid("alice", ref); err != nil || paid != want {
+					t.Fatalf("paid %s = %v, %v", ref, paid, err)
+				}
+			}
+			if paid, _ := c.Paid("bob", "t1"); paid {
+				t.Fatal("bob paid t1")
+			}
+
+			// Re-registering keeps the balance and refreshes PeerInfo
+			if err := c.Register("bob", 500, "pw2", PeerInfo{IP: "127.0.0.1", Port: 4002}); err != nil {
+				t.Fatal(err)
+			}
+			ud, err := c.Users()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ud["bob"].Balance != 50 || ud["bob"].PeerInfo.Port != 4002 {
+				t.Fatalf("bob = %+v", ud["bob"])
+			}
+			bal, err := c.Balance("alice")
+			if err != nil || bal != 60 {
+				t.Fatalf("alice balance = %d, %v", bal, err)
+			}
+
+			if err := c.Reset(); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := c.Balance("alice"); err == nil {
+				t.Fatal("alice still registered after reset")
+			}
+		})
+	}
+}
+
+func TestMemChainErrors(t *testing.T) {
+	c := newMemChain()
+	c.Register("alice", 10, "pw", PeerInfo{})
+	if err := c.Pay("alice", "carol", "pw", 1, ""); !errors.Is(err, errUnknownUser) {
+		t.Fatalf("got %v, want unknown user", err)
+	}
+	if err := c.Pay("alice", "alice", "pw", 11, ""); !errors.Is(err, errInsufficientFunds) {
+		t.Fatalf("got %v, want insufficient funds", err)
+	}
+}
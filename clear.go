@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Debts often go around in a circle: alice owes bob, bob owes carol and carol
+// owes alice. Clearing takes the smallest of them off every trustline on the
+// cycle, without anything moving on the chain. It is a routed payment from a
+// node back to itself, against the direction of the debts: alice pays carol,
+// carol pays bob and bob pays alice, so nobody's net position changes. The
+// hops hold it as HTLCs like any routed payment, so it clears every
+// trustline on the cycle or none of them.
+//
+// Each node on the cycle consents by checking the clearing only shrinks what
+// is owed on both of its trustlines, and a node started with --no-clear
+// refuses them all. A hop that can clear less cancels with how much it can,
+// and the node that started the clearing tries again with that.
+//
+// A node clears one cycle at a time. Each clearing that ends, whether it
+// went through or not, moves on to the next cycle, until every one we know
+// of has been tried.
+
+const (
+	rejectDeclined    = "declined"
+	rejectClearAmount = "clear_amount"
+)
+
+// isCycle reports whether path leads back to where it started, which makes a
+// payment along it a clearing.
+func isCycle(path []string) bool {
+	return len(path) > 2 && path[0] == path[len(path)-1]
+}
+
+// owedBy is what the peer owes us, less what is already on its way back.
+func (tl *Trustline) owedBy() int {
+	return tl.HostBalance - int(tl.inFlight(true))
+}
+
+// owedTo is what we owe the peer, less what is already on its way back.
+func (tl *Trustline) owedTo() int {
+	return tl.PeerBalance - int(tl.inFlight(false))
+}
+
+// findCycle returns a cycle through us whose debts can be cleared, and how
+// much we can clear on it, or nil if there is none we know of that hasn't
+// been tried yet. The cycle goes to someone who owes us and comes back from
+// someone we owe.
+func (host *Host) findCycle() ([]string, uint32) {
+	links := host.openLinks()
+	for _, to := range links {
+		owed := host.peerIDtoPeer[to].trustline.owedTo()
+		if owed <= 0 {
+			continue
+		}
+		for _, from := range links {
+			owing := host.peerIDtoPeer[from].trustline.owedBy()
+			if from == to || owing <= 0 {
+				continue
+			}
+			path := host.findPath(from, to, host.Name, 0)
+			if path == nil {
+				continue
+			}
+			cycle := append(append([]string{host.Name}, path...), host.Name)
+			if host.clearTried[strings.Join(cycle, " ")] {
+				continue
+			}
+			if owing < owed {
+				return cycle, uint32(owing)
+			}
+			return cycle, uint32(owed)
+		}
+	}
+	return nil, 0
+}
+
+// clearing reports whether a clearing we started is still in flight.
+func (host *Host) clearing() bool {
+	for _, peer := range host.peerIDtoPeer {
+		if peer.trustline == nil {
+			continue
+		}
+		for _, h := range peer.trustline.HTLCs {
+			if h.Out && h.From == "" && !h.resolved() && isCycle(h.Path) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// clearCycles starts clearing the next cycle, unless a clearing is already
+// under way. verbose says what happened, for the clear command. Runs from the
+// stateManager.
+func (host *Host) clearCycles(verbose bool) {
+	if host.noClear {
+		if verbose {
+			fmt.Println("Err: Clearing is turned off with --no-clear")
+		}
+		return
+	}
+	if host.clearing() {
+		if verbose {
+			fmt.Println("A clearing is already under way")
+		}
+		return
+	}
+	path, amount := host.findCycle()
+	if path == nil {
+		// Start over next time
+		host.clearTried = make(map[string]bool)
+		if verbose {
+			fmt.Println("No debt cycles to clear")
+		}
+		return
+	}
+	host.clearTried[strings.Join(path, " ")] = true
+	if host.clearAround(path, amount) && verbose {
+		fmt.Println("Clearing queued.")
+	}
+}
+
+// clearOnSchedule runs clearCycles every host.clearEvery, if it is set. Runs
+// from the stateManager.
+func (host *Host) clearOnSchedule() {
+	if host.clearEvery == 0 || time.Since(host.lastClear) < host.clearEvery {
+		return
+	}
+	host.lastClear = time.Now()
+	host.clearCycles(false)
+}
+
+func (host *Host) clearAround(path []string, amount uint32) bool {
+	if err := host.sendHTLC(path, amount, host.publicKey()); err != nil {
+		fmt.Printf("\nErr: Could not clear %d around %s: %v\n", amount, strings.Join(path, ", "), err)
+		fmt.Print("> ")
+		return false
+	}
+	return true
+}
+
+// checkClear makes sure a clearing from peer only takes debt off our
+// trustlines with it and with the next hop. A clearing for more than that
+// is refused with the most we could clear.
+func (host *Host) checkClear(peer *Peer, next string, msg *Message) (code string, reason string, most uint32) {
+	if host.noClear {
+		return rejectDeclined, fmt.Sprintf("%s doesn't take part in clearing", host.Name), 0
+	}
+	seen := map[string]bool{}
+	for _, id := range msg.Path[1:] {
+		if seen[id] {
+			return rejectBadRoute, fmt.Sprintf("cycle goes through %s twice", id), 0
+		}
+		seen[id] = true
+	}
+	can := peer.trustline.owedTo()
+	if next != "" {
+		if owing := host.peerIDtoPeer[next].trustline.owedBy(); owing < can {
+			can = owing
+		}
+	}
+	if can < int(msg.Amount) {
+		if can < 0 {
+			can = 0
+		}
+		return rejectClearAmount, fmt.Sprintf("%s can clear at most %d", host.Name, can), uint32(can)
+	}
+	return "", "", 0
+}
+
+// cleared reports a clearing we started going through, and moves on to the
+// next cycle.
+func (host *Host) cleared(h *HTLC) {
+	fmt.Printf("\nCleared %d around %s\n", h.Amount, strings.Join(h.Path, ", "))
+	fmt.Print("> ")
+	host.clearCycles(false)
+}
+
+// clearFailed tries a clearing we started again for the amount the cycle
+// can take. Otherwise it reports why it failed, unless the cycle just had
+// nothing left to clear, and moves on to the next one.
+func (host *Host) clearFailed(h *HTLC, code string, reason string, limit uint32) {
+	if code == rejectClearAmount && limit > 0 && limit < h.Amount {
+		if host.clearAround(h.Path, limit) {
+			return
+		}
+	} else if code != rejectClearAmount {
+		fmt.Printf("\nErr: Could not clear %d around %s (%s): %s\n", h.Amount, strings.Join(h.Path, ", "), code, reason)
+		fmt.Print("> ")
+	}
+	host.clearCycles(false)
+}
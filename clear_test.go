@@ -0,0 +1,95 @@
+package main
+
+import (
+	"crypto/sha256"
+	"testing"
+	"time"
+)
+
+// debtTriangle has alice owe bob 30, bob owe carol 20 and carol owe alice 40.
+func debtTriangle(t *testing.T, noClear bool) (alice, bob, carol *Host) {
+	defer func(i time.Duration) { settleCheckInterval = i }(settleCheckInterval)
+	settleCheckInterval = 5 * time.Millisecond
+	chain := newMemChain()
+	alice = newTestHost(t, "alice", chain)
+	bob = newTestHost(t, "bob", chain)
+	carol = newTestHost(t, "carol", chain)
+	carol.noClear = noClear
+	for _, h := range []*Host{alice, bob, carol} {
+		go h.stateManager()
+	}
+	_, aliceInfo := listen(t, alice)
+	_, bobInfo := listen(t, bob)
+	_, carolInfo := listen(t, carol)
+	openTrustline(t, alice, bob, bobInfo)
+	openTrustline(t, bob, carol, carolInfo)
+	openTrustline(t, carol, alice, aliceInfo)
+
+	alice.outbound <- &Message{HostID: "alice", PeerID: "bob", Type: "Pay", Amount: 30}
+	bob.outbound <- &Message{HostID: "bob", PeerID: "carol", Type: "Pay", Amount: 20}
+	carol.outbound <- &Message{HostID: "carol", PeerID: "alice", Type: "Pay", Amount: 40}
+	owes(t, alice, "bob", 30)
+	owes(t, bob, "carol", 20)
+	owes(t, carol, "alice", 40)
+	waitFor(t, alice, func() bool { return alice.edge("carol", "bob") != nil })
+	return alice, bob, carol
+}
+
+// owes waits for host to owe peerID amount, with nothing in flight.
+func owes(t *testing.T, host *Host, peerID string, amount int) {
+	t.Helper()
+	waitFor(t, host, func() bool {
+		tl := host.peerIDtoPeer[peerID].trustline
+		return tl.PeerBalance == amount && len(tl.Pending) == 0 && tl.inFlight(true) == 0 && tl.inFlight(false) == 0
+	})
+}
+
+func TestClearCycle(t *testing.T) {
+	alice, bob, carol := debtTriangle(t, false)
+
+	alice.run(func() { alice.clearCycles(true) })
+	// Carol can only take 20 off, which alice tries again with
+	owes(t, alice, "bob", 10)
+	owes(t, bob, "carol", 0)
+	owes(t, carol, "alice", 20)
+	owes(t, bob, "alice", -10)
+	owes(t, carol, "bob", 0)
+	owes(t, alice, "carol", -20)
+	if bal, _ := alice.chain.Balance("alice"); bal != 0 {
+		t.Fatalf("alice has %d on chain", bal)
+	}
+
+	// Nothing left to clear, and every node is as it was
+	waitFor(t, alice, func() bool { return !alice.clearing() && len(alice.clearTried) == 0 })
+	owes(t, alice, "bob", 10)
+	owes(t, carol, "alice", 20)
+}
+
+func TestClearNeedsConsent(t *testing.T) {
+	alice, bob, carol := debtTriangle(t, true)
+
+	alice.run(func() { alice.clearCycles(true) })
+	waitFor(t, alice, func() bool { return !alice.clearing() && len(alice.clearTried) == 0 })
+	owes(t, alice, "bob", 30)
+	owes(t, bob, "carol", 20)
+	owes(t, carol, "alice", 40)
+}
+
+func TestClearLimitedByDebt(t *testing.T) {
+	host := newTestHost(t, "bob", newMemChain())
+	go host.stateManager()
+	alice := testPeer(host, "alice")
+	carol := testPeer(host, "carol")
+	host.run(func() {
+		alice.trustline.PeerBalance, alice.trustline.HostBalance = 5, -5
+		carol.trustline.PeerBalance, carol.trustline.HostBalance = -20, 20
+	})
+
+	// Bob only owes alice 5, so clearing 10 would put alice in his debt
+	hash := sha256.Sum256(make([]byte, 32))
+	host.inbound <- &Message{HostID: "alice", PeerID: "bob", Type: "Prepare", Amount: 10, ID: newID(), Seq: 1,
+		Path: []string{"alice", "bob", "carol", "alice"}, Hash: hash[:], Expiry: time.Now().Add(3 * host.htlcDelta).UnixNano(), Sealed: make([]byte, 64)}
+	if msg := next(alice); msg.Type != "Cancel" || msg.Code != rejectClearAmount || msg.Limit != 5 {
+		t.Fatalf("alice got %+v", msg)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Messages go over the wire as frames: the length of the JSON encoding as an
+// unsigned varint, followed by the JSON itself. Frames longer than
+// maxFrameSize are refused on both ends.
+const maxFrameSize = 64 * 1024
+
+var errFrameTooLarge = errors.New("frame exceeds maximum size")
+
+// encodeFrame returns the frame for msg.
+func encodeFrame(msg *Message) ([]byte, error) {
+	mb, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	if len(mb) > maxFrameSize {
+		return nil, errFrameTooLarge
+	}
+	b := make([]byte, binary.MaxVarintLen64, binary.MaxVarintLen64+len(mb))
+	n := binary.PutUvarint(b, uint64(len(mb)))
+	return append(b[:n], mb...), nil
+}
+
+// frameReader decodes a stream of frames, however they were split or bundled
+// up by the reads underneath.
+type frameReader struct {
+	r *bufio.Reader
+}
+
+func newFrameReader(r io.Reader) *frameReader {
+	return &frameReader{bufio.NewReaderSize(r, bufSize)}
+}
+
+// Next returns the next message. io.EOF means the stream ended cleanly
+// between frames.
+func (fr *frameReader) Next() (*Message, error) {
+	size, err := binary.ReadUvarint(fr.r)
+	if err != nil {
+		return nil, err
+	}
+	if size > maxFrameSize {
+		return nil, fmt.Errorf("%w: %d bytes", errFrameTooLarge, size)
+	}
+	b := make([]byte, size)
+	if _, err := io.ReadFull(fr.r, b); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	var msg Message
+	if err := json.Unmarshal(b, &msg); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
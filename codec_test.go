@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+	"testing/iotest"
+)
+
+func TestFrames(t *testing.T) {
+	msgs := []*Message{
+		{HostID: "alice", PeerID: "bob", Type: "Pay", Amount: 10},
+		{HostID: "ali}ce{", PeerID: "b\"ob", Type: "Settle", Amount: 3, ID: "}}"},
+		{HostID: "alice", PeerID: "bob", Type: "Propose"},
+	}
+	var stream []byte
+	for _, m := range msgs {
+		stream = append(stream, serialize(m)...)
+	}
+
+	// Bundled into one read, or split over many
+	readers := map[string]io.Reader{
+		"bundled":  bytes.NewReader(stream),
+		"one byte": iotest.OneByteReader(bytes.NewReader(stream)),
+	}
+	for name, r := range readers {
+		fr := newFrameReader(r)
+		for i, want := range msgs {
+			got, err := fr.Next()
+			if err != nil {
+				t.Fatalf("%s: frame %d: %v", name, i, err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("%s: frame %d = %+v, want %+v", name, i, got, want)
+			}
+		}
+		if _, err := fr.Next(); err != io.EOF {
+			t.Fatalf("%s: got %v at end of stream, want EOF", name, err)
+		}
+	}
+}
+
+func TestFrameErrors(t *testing.T) {
+	huge := make([]byte, binary.MaxVarintLen64)
+	huge = huge[:binary.PutUvarint(huge, maxFrameSize+1)]
+	if _, err := newFrameReader(bytes.NewReader(huge)).Next(); !errors.Is(err, errFrameTooLarge) {
+		t.Fatalf("oversized frame: got %v", err)
+	}
+
+	f := serialize(&Message{Type: "Pay"})
+	if _, err := newFrameReader(bytes.NewReader(f[:len(f)-1])).Next(); err != io.ErrUnexpectedEOF {
+		t.Fatalf("truncated frame: got %v", err)
+	}
+
+	if _, err := encodeFrame(&Message{HostID: string(make([]byte, maxFrameSize))}); !errors.Is(err, errFrameTooLarge) {
+		t.Fatalf("oversized message encoded: %v", err)
+	}
+}
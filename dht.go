@@ -0,0 +1,541 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/bits"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// With --dht, nodes run a Kademlia-style distributed hash table over the
+// discovery socket, so nobody has to publish their address in one place. Each
+// node is placed at the SHA-256 of its public key and keeps up to dhtK
+// contacts at each distance from itself, distance being the XOR of the two
+// hashes. A node stores its signed address record at the dhtK nodes closest
+// to its key, and finding a node whose key we know means asking ever closer
+// nodes for the record until one has it. Bootstrap nodes are only the way in:
+// with --dht, they are pinged rather than asked for their whole address book.
+//
+// Names don't come into it: a record is stored under the key that signed it,
+// so nobody can take over another node's place, and each DHT message is
+// signed by its sender, whose place follows from its key. Nodes store their
+// record again every dhtRepublish, and records are dropped dhtExpiry after
+// they were signed.
+//
+// Anyone can make up keys, so we keep only one record per key and at most
+// dhtMaxRecords in all. Once full, expired records go first, then the ones
+// whose key is farthest from us, since the closest are the ones lookups come
+// to us for.
+
+const (
+	dhtK             = 8
+	dhtAlpha         = 3
+	dhtTimeout       = 500 * time.Millisecond
+	dhtLookupTimeout = 2 * time.Second
+	dhtRepublish     = 10 * time.Minute
+	dhtExpiry        = time.Hour
+)
+
+var dhtMaxRecords = 4096
+
+type dhtKey [sha256.Size]byte
+
+func keyOf(pub ed25519.PublicKey) dhtKey {
+	return sha256.Sum256(pub)
+}
+
+func (k dhtKey) String() string {
+	return hex.EncodeToString(k[:])
+}
+
+func (k dhtKey) MarshalText() ([]byte, error) {
+	return []byte(k.String()), nil
+}
+
+func (k *dhtKey) UnmarshalText(text []byte) error {
+	b, err := hex.DecodeString(string(text))
+	if err != nil || len(b) != len(k) {
+		return fmt.Errorf("invalid DHT key %q", text)
+	}
+	copy(k[:], b)
+	return nil
+}
+
+func (k dhtKey) distance(to dhtKey) dhtKey {
+	var d dhtKey
+	for i := range k {
+		d[i] = k[i] ^ to[i]
+	}
+	return d
+}
+
+// A Contact is a node in the DHT and where it answers over UDP.
+type Contact struct {
+	ID   dhtKey `json:"id"`
+	Addr string `json:"addr"`
+}
+
+type dhtCall struct {
+	addr  string
+	reply chan *discoveryMsg
+}
+
+// A dhtTable is our view of the DHT: the buckets of contacts, the records
+// other nodes stored with us and the calls waiting for an answer.
+type dhtTable struct {
+	mu       sync.Mutex
+	self     dhtKey
+	buckets  [8 * sha256.Size][]Contact
+	records  map[dhtKey]*AddrRecord
+	calls    map[uint64]dhtCall
+	nextCall uint64
+	pinging  map[dhtKey]bool
+}
+
+func newDHT(pub ed25519.PublicKey) *dhtTable {
+	return &dhtTable{
+		self:    keyOf(pub),
+		records: make(map[dhtKey]*AddrRecord),
+		calls:   make(map[uint64]dhtCall),
+		pinging: make(map[dhtKey]bool),
+	}
+}
+
+// bucket is the bucket for key: how many leading bits it shares with us, or
+// -1 if it is us.
+func (d *dhtTable) bucket(key dhtKey) int {
+	dist := d.self.distance(key)
+	for i, b := range dist {
+		if b != 0 {
+			return 8*i + bits.LeadingZeros8(b)
+		}
+	}
+	return -1
+}
+
+// randomKey returns a key that would go in bucket i.
+func (d *dhtTable) randomKey(i int) dhtKey {
+	var k dhtKey
+	rand.Read(k[:])
+	for b := 0; b <= i; b++ {
+		mask := byte(0x80) >> (b % 8)
+		ours := d.self[b/8]
+		if b == i {
+			ours = ^ours
+		}
+		k[b/8] = k[b/8]&^mask | ours&mask
+	}
+	return k
+}
+
+func (d *dhtTable) remove(i int, id dhtKey) {
+	b := d.buckets[i]
+	for j, c := range b {
+		if c.ID == id {
+			d.buckets[i] = append(b[:j:j], b[j+1:]...)
+			return
+		}
+	}
+}
+
+// closest returns up to n contacts, closest to key first.
+func (d *dhtTable) closest(key dhtKey, n int) []Contact {
+	d.mu.Lock()
+	var cs []Contact
+	for _, b := range d.buckets {
+		cs = append(cs, b...)
+	}
+	d.mu.Unlock()
+	sortByDistance(cs, key)
+	if len(cs) > n {
+		cs = cs[:n]
+	}
+	return cs
+}
+
+func sortByDistance(cs []Contact, key dhtKey) {
+	sort.Slice(cs, func(i, j int) bool {
+		di, dj := cs[i].ID.distance(key), cs[j].ID.distance(key)
+		return bytes.Compare(di[:], dj[:]) < 0
+	})
+}
+
+// put keeps a record another node stored with us under the key that signed
+// it, if it is current and newer than what we have there. A record for a new
+// key only gets in if there's room for it, see makeRoom.
+func (d *dhtTable) put(r *AddrRecord) bool {
+	if r.verify() != nil {
+		return false
+	}
+	if age := time.Since(time.Unix(0, r.Stamp)); age > dhtExpiry || age < -time.Minute {
+		return false
+	}
+	key := keyOf(r.Info.PublicKey)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	old, ok := d.records[key]
+	if ok && old.Stamp >= r.Stamp {
+		return false
+	}
+	if !ok && !d.makeRoom(key) {
+		return false
+	}
+	d.records[key] = r
+	return true
+}
+
+// makeRoom frees a place for a record under key once we hold dhtMaxRecords,
+// dropping the expired ones, or else the one farthest from us if key is
+// closer. It reports whether there's room. d.mu is held.
+func (d *dhtTable) makeRoom(key dhtKey) bool {
+	if len(d.records) < dhtMaxRecords {
+		return true
+	}
+	d.dropExpired()
+	if len(d.records) < dhtMaxRecords {
+		return true
+	}
+	far := key
+	farthest := d.self.distance(key)
+	for k := range d.records {
+		if dist := d.self.distance(k); bytes.Compare(dist[:], farthest[:]) > 0 {
+			far, farthest = k, dist
+		}
+	}
+	if far == key {
+		return false
+	}
+	delete(d.records, far)
+	return true
+}
+
+func (d *dhtTable) get(key dhtKey) *AddrRecord {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	r := d.records[key]
+	if r == nil || time.Since(time.Unix(0, r.Stamp)) > dhtExpiry {
+		return nil
+	}
+	return r
+}
+
+// expire drops the records that are too old.
+func (d *dhtTable) expire() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.dropExpired()
+}
+
+// dropExpired is expire with d.mu held.
+func (d *dhtTable) dropExpired() {
+	for key, r := range d.records {
+		if time.Since(time.Unix(0, r.Stamp)) > dhtExpiry {
+			delete(d.records, key)
+		}
+	}
+}
+
+// size is how many contacts and records we have.
+func (d *dhtTable) size() (int, int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	n := 0
+	for _, b := range d.buckets {
+		n += len(b)
+	}
+	return n, len(d.records)
+}
+
+// dhtSeen notes that c is alive. A full bucket keeps its contacts over
+// newcomers, unless the one seen longest ago doesn't answer a ping.
+func (host *Host) dhtSeen(c Contact) {
+	d := host.dht
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	i := d.bucket(c.ID)
+	if i < 0 {
+		return
+	}
+	d.remove(i, c.ID)
+	if len(d.buckets[i]) < dhtK {
+		d.buckets[i] = append(d.buckets[i], c)
+		return
+	}
+	oldest := d.buckets[i][0]
+	if d.pinging[oldest.ID] {
+		return
+	}
+	d.pinging[oldest.ID] = true
+	go func() {
+		_, err := host.dhtCall(oldest.Addr, &discoveryMsg{Type: "ping"})
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		delete(d.pinging, oldest.ID)
+		if err == nil {
+			return
+		}
+		d.remove(i, oldest.ID)
+		if len(d.buckets[i]) < dhtK {
+			d.buckets[i] = append(d.buckets[i], c)
+		}
+	}()
+}
+
+// dhtCall sends msg to addr and waits for the answer.
+func (host *Host) dhtCall(addr string, msg *discoveryMsg) (*discoveryMsg, error) {
+	to, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	d := host.dht
+	call := dhtCall{addr: to.String(), reply: make(chan *discoveryMsg, 1)}
+	d.mu.Lock()
+	d.nextCall++
+	msg.Call = d.nextCall
+	d.calls[msg.Call] = call
+	d.mu.Unlock()
+	defer func() {
+		d.mu.Lock()
+		delete(d.calls, msg.Call)
+		d.mu.Unlock()
+	}()
+
+	if err := host.sendDHT(call.addr, msg); err != nil {
+		return nil, err
+	}
+	select {
+	case reply := <-call.reply:
+		return reply, nil
+	case <-time.After(dhtTimeout):
+		return nil, fmt.Errorf("%s did not answer", addr)
+	}
+}
+
+// sendDHT signs msg and sends it to addr.
+func (host *Host) sendDHT(addr string, msg *discoveryMsg) error {
+	msg.Key = host.publicKey()
+	msg.Sig = nil
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	msg.Sig = ed25519.Sign(host.key, b)
+	return host.sendDiscovery(addr, msg)
+}
+
+// dhtSender returns the node that signed msg.
+func dhtSender(msg *discoveryMsg) (dhtKey, bool) {
+	c := *msg
+	c.Sig = nil
+	b, err := json.Marshal(&c)
+	if err != nil || len(msg.Key) != ed25519.PublicKeySize || !ed25519.Verify(msg.Key, b, msg.Sig) {
+		return dhtKey{}, false
+	}
+	return keyOf(msg.Key), true
+}
+
+// dhtReceived answers a DHT message, or hands an answer to the call waiting
+// for it.
+func (host *Host) dhtReceived(msg *discoveryMsg, from net.Addr) {
+	d := host.dht
+	sender, ok := dhtSender(msg)
+	if !ok {
+		return
+	}
+	host.dhtSeen(Contact{ID: sender, Addr: from.String()})
+	reply := discoveryMsg{Call: msg.Call}
+	switch msg.Type {
+	case "pong", "nodes":
+		d.mu.Lock()
+		call, ok := d.calls[msg.Call]
+		d.mu.Unlock()
+		if ok && call.addr == from.String() {
+			select {
+			case call.reply <- msg:
+			default:
+			}
+		}
+		return
+	case "ping":
+		reply.Type = "pong"
+	case "find_node", "find_value":
+		if msg.Target == nil {
+			return
+		}
+		key := *msg.Target
+		reply.Type = "nodes"
+		if msg.Type == "find_value" {
+			if r := host.dhtValue(key); r != nil {
+				reply.Records = []*AddrRecord{r}
+			}
+		}
+		if reply.Records == nil {
+			reply.Contacts = d.closest(key, dhtK)
+		}
+	case "store":
+		for _, r := range msg.Records {
+			d.put(r)
+		}
+		return
+	default:
+		return
+	}
+	host.sendDHT(from.String(), &reply)
+}
+
+// dhtValue is the record we have at key, if any.
+func (host *Host) dhtValue(key dhtKey) *AddrRecord {
+	if key == host.dht.self {
+		return host.addrRecord()
+	}
+	return host.dht.get(key)
+}
+
+// dhtLookup walks the DHT towards key, asking dhtAlpha of the closest nodes
+// we know of at a time for ones closer still, until the dhtK closest have all
+// answered. If value is set, it stops at the first node that has the record
+// stored under key and returns it. It also returns the dhtK closest nodes.
+func (host *Host) dhtLookup(key dhtKey, value bool) ([]Contact, *AddrRecord) {
+	short := host.dht.closest(key, dhtK)
+	asked := map[dhtKey]bool{}
+	failed := map[dhtKey]bool{}
+	typ := "find_node"
+	if value {
+		typ = "find_value"
+	}
+	type answer struct {
+		c     Contact
+		reply *discoveryMsg
+	}
+
+	deadline := time.Now().Add(dhtLookupTimeout)
+	for time.Now().Before(deadline) {
+		var round []Contact
+		for _, c := range short {
+			if !asked[c.ID] && len(round) < dhtAlpha {
+				asked[c.ID] = true
+				round = append(round, c)
+			}
+		}
+		if len(round) == 0 {
+			break
+		}
+		answers := make(chan answer, len(round))
+		for _, c := range round {
+			go func(c Contact) {
+				reply, _ := host.dhtCall(c.Addr, &discoveryMsg{Type: typ, Target: &key})
+				if reply != nil && keyOf(reply.Key) != c.ID {
+					// Someone else answers there
+					reply = nil
+				}
+				answers <- answer{c, reply}
+			}(c)
+		}
+
+		var found *AddrRecord
+		seen := map[dhtKey]bool{}
+		for _, c := range short {
+			seen[c.ID] = true
+		}
+		for range round {
+			a := <-answers
+			if a.reply == nil {
+				failed[a.c.ID] = true
+				continue
+			}
+			for _, r := range a.reply.Records {
+				if value && keyOf(r.Info.PublicKey) == key && r.verify() == nil {
+					found = r
+				}
+			}
+			for _, c := range a.reply.Contacts {
+				if c.ID != host.dht.self && !seen[c.ID] {
+					seen[c.ID] = true
+					short = append(short, c)
+				}
+			}
+		}
+
+		alive := short[:0]
+		for _, c := range short {
+			if !failed[c.ID] {
+				alive = append(alive, c)
+			}
+		}
+		short = alive
+		sortByDistance(short, key)
+		if len(short) > dhtK {
+			short = short[:dhtK]
+		}
+		if found != nil {
+			return short, found
+		}
+	}
+	return short, nil
+}
+
+// dhtFind returns the record node id signed with key, from those stored with
+// us or else from the DHT, or nil.
+func (host *Host) dhtFind(id string, key ed25519.PublicKey) *AddrRecord {
+	r := host.dht.get(keyOf(key))
+	if r == nil {
+		_, r = host.dhtLookup(keyOf(key), true)
+	}
+	if r == nil || r.ID != id {
+		return nil
+	}
+	return r
+}
+
+// dhtRefresh looks up a random key in each bucket as far as the one with our
+// closest contact, so we get to know someone at every distance.
+func (host *Host) dhtRefresh() {
+	d := host.dht
+	d.mu.Lock()
+	deepest := -1
+	for i, b := range d.buckets {
+		if len(b) > 0 {
+			deepest = i
+		}
+	}
+	d.mu.Unlock()
+	for i := 0; i <= deepest; i++ {
+		host.dhtLookup(d.randomKey(i), false)
+	}
+}
+
+// dhtPublish stores our record at the nodes closest to our key.
+func (host *Host) dhtPublish() {
+	closest, _ := host.dhtLookup(host.dht.self, false)
+	r := host.addrRecord()
+	for _, c := range closest {
+		host.sendDHT(c.Addr, &discoveryMsg{Type: "store", Records: []*AddrRecord{r}})
+	}
+}
+
+// runDHT joins the DHT through the bootstrap nodes, then fills in our buckets
+// and publishes our record every dhtRepublish.
+func (host *Host) runDHT(bootstrap []string) {
+	for {
+		if contacts, _ := host.dht.size(); contacts == 0 {
+			for _, addr := range bootstrap {
+				if _, err := host.dhtCall(addr, &discoveryMsg{Type: "ping"}); err != nil {
+					fmt.Printf("\nErr: Could not join the DHT through %s: %v\n", addr, err)
+					fmt.Print("> ")
+				}
+			}
+		}
+		host.dhtRefresh()
+		host.dhtPublish()
+		host.dht.expire()
+		time.Sleep(dhtRepublish)
+	}
+}
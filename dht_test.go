@@ -0,0 +1,173 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestDHTStore(t *testing.T) {
+	bob := newHost("bob", 4000, newMemChain())
+	d := newDHT(newKey().Public().(ed25519.PublicKey))
+	if !d.put(bob.addrRecord()) {
+		t.Fatal("didn't store bob's record")
+	}
+	forged := *bob.addrRecord()
+	forged.Info.Port = 6666
+	stale := bob.addrRecord()
+	stale.Stamp = time.Now().Add(-2 * dhtExpiry).UnixNano()
+	stale.Sig = ed25519.Sign(bob.key, stale.signedBytes())
+	if d.put(&forged) || d.put(stale) {
+		t.Error("stored a forged or stale record")
+	}
+	// A record for bob under another key goes in that key's place
+	mallory := newHost("bob", 6666, newMemChain())
+	if !d.put(mallory.addrRecord()) || d.get(keyOf(bob.publicKey())).Info.Port != 4000 {
+		t.Error("mallory's record took bob's place")
+	}
+}
+
+func TestDHTFull(t *testing.T) {
+	defer func(n int) { dhtMaxRecords = n }(dhtMaxRecords)
+	dhtMaxRecords = 2
+	d := newDHT(newKey().Public().(ed25519.PublicKey))
+	var recs []*AddrRecord
+	for i := 0; i < 3; i++ {
+		recs = append(recs, newHost(fmt.Sprint("n", i), 4000, newMemChain()).addrRecord())
+	}
+	dist := func(r *AddrRecord) string {
+		k := d.self.distance(keyOf(r.Info.PublicKey))
+		return string(k[:])
+	}
+	sort.Slice(recs, func(i, j int) bool { return dist(recs[i]) < dist(recs[j]) })
+
+	// Full: the farthest record gives way to a closer one, and a farther
+	// one doesn't get in
+	d.put(recs[0])
+	d.put(recs[2])
+	if !d.put(recs[1]) || d.get(keyOf(recs[2].Info.PublicKey)) != nil {
+		t.Error("farthest record kept")
+	}
+	if d.put(recs[2]) {
+		t.Error("stored a record farther than all we have")
+	}
+	if _, n := d.size(); n != 2 {
+		t.Fatalf("%d records", n)
+	}
+
+	// An expired one goes first, however close
+	d.mu.Lock()
+	d.records[keyOf(recs[0].Info.PublicKey)].Stamp = time.Now().Add(-2 * dhtExpiry).UnixNano()
+	d.mu.Unlock()
+	if !d.put(recs[2]) || d.get(keyOf(recs[1].Info.PublicKey)) == nil {
+		t.Error("expired record kept over a current one")
+	}
+}
+
+// joinDHT starts discovery for hosts with the DHT on, all joining through the
+// first, and waits for them all to publish.
+func joinDHT(t *testing.T, hosts []*Host) {
+	for i, h := range hosts {
+		var bootstrap []string
+		if i > 0 {
+			bootstrap = []string{hosts[0].discovery.LocalAddr().String()}
+		}
+		if err := h.startDiscovery("127.0.0.1:0", bootstrap, false, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for _, h := range hosts {
+		for n, _ := h.dht.size(); n == 0; n, _ = h.dht.size() {
+			if time.Now().After(deadline) {
+				t.Fatalf("%s didn't join", h.Name)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	// Once everyone is in, as republishing would
+	for _, h := range hosts {
+		h.dhtRefresh()
+	}
+	for _, h := range hosts {
+		h.dhtPublish()
+	}
+}
+
+func TestDHTLookup(t *testing.T) {
+	var hosts []*Host
+	for i := 0; i < 30; i++ {
+		// Each on a chain of its own, so only the DHT knows where the others are
+		hosts = append(hosts, newHost(fmt.Sprintf("node%02d", i), uint16(5000+i), newMemChain()))
+	}
+	// Someone else going by node03
+	hosts = append(hosts, newHost("node03", 6666, newMemChain()))
+	joinDHT(t, hosts)
+
+	for i, h := range hosts {
+		want := hosts[(i*7+3)%30]
+		if want == h {
+			continue
+		}
+		r := h.dhtFind(want.Name, want.publicKey())
+		if r == nil {
+			t.Fatalf("%s couldn't find %s", h.Name, want.Name)
+		}
+		if r.Info.Port != want.Port || !r.Info.PublicKey.Equal(want.publicKey()) {
+			t.Fatalf("%s found %+v for %s", h.Name, r.Info, want.Name)
+		}
+	}
+	if r := hosts[1].dhtFind("nobody", newKey().Public().(ed25519.PublicKey)); r != nil {
+		t.Fatalf("found %+v for nobody", r)
+	}
+	// Records are spread out rather than all with the first node
+	if _, stored := hosts[0].dht.size(); stored == len(hosts)-1 {
+		t.Error("every record is stored with the bootstrap node")
+	}
+
+	// Unsigned messages are dropped
+	to := hosts[2].discovery.LocalAddr().String()
+	dave, erin := newHost("dave", 0, newMemChain()), newHost("erin", 0, newMemChain())
+	hosts[1].sendDiscovery(to, &discoveryMsg{Type: "store", Records: []*AddrRecord{dave.addrRecord()}})
+	hosts[1].sendDHT(to, &discoveryMsg{Type: "store", Records: []*AddrRecord{erin.addrRecord()}})
+	for i := 0; hosts[2].dht.get(keyOf(erin.publicKey())) == nil; i++ {
+		if i == 200 {
+			t.Fatal("signed store was dropped")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if hosts[2].dht.get(keyOf(dave.publicKey())) != nil {
+		t.Error("stored a record from an unsigned message")
+	}
+}
+
+func TestDHTResolve(t *testing.T) {
+	chain := newMemChain()
+	boot := newHost("boot", 0, newMemChain())
+	alice := newTestHost(t, "alice", chain)
+	bob := newTestHost(t, "bob", chain)
+	carol := newTestHost(t, "carol", chain)
+	listen(t, alice)
+	listen(t, bob)
+	listen(t, carol)
+	joinDHT(t, []*Host{boot, alice, bob})
+
+	// carol isn't in the DHT, but alice can still find her on the chain
+	if pi, err := alice.resolve("carol"); err != nil || !pi.PublicKey.Equal(carol.publicKey()) {
+		t.Fatalf("resolved carol to %+v: %v", pi, err)
+	}
+	// Without the chain, alice finds where bob is now in the DHT
+	alice.chain = downChain{chain}
+	if _, err := alice.book.load(peersFile(t, movedRecord(bob, 1)), true); err != nil {
+		t.Fatal(err)
+	}
+	go alice.stateManager()
+	go bob.stateManager()
+	pi, err := alice.resolve("bob")
+	if err != nil || pi.Port != bob.Port {
+		t.Fatalf("resolved %+v: %v", pi, err)
+	}
+	openTrustline(t, alice, bob, pi)
+}
@@ -0,0 +1,464 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Nodes can find each other without the chain. Each node keeps an address
+// book of signed address records, filled from a peers file, from bootstrap
+// nodes and from other nodes on the LAN, and looks peers up there before
+// asking the chain. Anyone can sign a record for any name with a key of their
+// own, so a record is only as good as its key: each name has one key pinned,
+// and only records signed by it count. The keys in a peers file given with
+// --peers are pinned, so that file has to be one we trust. Other keys come
+// from the chain the first time a name is looked up, never from what was
+// discovered.
+//
+// Discovery runs over UDP, on the same port a node listens on over TCP. A node
+// asks its bootstrap nodes for their address books with a query carrying its
+// own record, and they answer with records. With --lan, a node also announces
+// its own record to a multicast group, and answers announcements from nodes
+// it didn't know with its own. Both are repeated every discoveryInterval.
+
+const (
+	lanGroup          = "239.255.70.71:7071"
+	discoveryInterval = 30 * time.Second
+
+	// Keeps an answer within one datagram
+	maxDiscoveryRecords = 64
+
+	// How many keys we keep records for under one name
+	maxKeysPerName = 4
+)
+
+// An AddrRecord says where node ID can be reached, as of Stamp in Unix
+// nanoseconds. It is signed by the key in Info.
+type AddrRecord struct {
+	ID    string   `json:"id"`
+	Info  PeerInfo `json:"info"`
+	Stamp int64    `json:"stamp"`
+	Sig   []byte   `json:"sig,omitempty"`
+}
+
+func (r *AddrRecord) signedBytes() []byte {
+	c := *r
+	c.Sig = nil
+	b, err := json.Marshal(&c)
+	ferror(err) // should never happen
+	return b
+}
+
+func (r *AddrRecord) verify() error {
+	key := r.Info.PublicKey
+	if r.ID == "" || len(key) != ed25519.PublicKeySize || !ed25519.Verify(key, r.signedBytes(), r.Sig) {
+		return fmt.Errorf("address record for %q is not signed by its key", r.ID)
+	}
+	return nil
+}
+
+// addrRecord is our own record, signed now.
+func (host *Host) addrRecord() *AddrRecord {
+	r := &AddrRecord{ID: host.Name, Info: host.peerInfo(), Stamp: time.Now().UnixNano()}
+	r.Sig = ed25519.Sign(host.key, r.signedBytes())
+	return r
+}
+
+// An addrBook holds the newest record we have for each name and key, and the
+// key pinned for each name. Both are saved to path, if set, as a peers file.
+type addrBook struct {
+	mu      sync.Mutex
+	path    string
+	records map[string][]*AddrRecord
+	pinned  map[string]ed25519.PublicKey
+}
+
+func newAddrBook() *addrBook {
+	return &addrBook{records: make(map[string][]*AddrRecord), pinned: make(map[string]ed25519.PublicKey)}
+}
+
+// signedBy returns the newest record for id signed by key, or nil.
+func (b *addrBook) signedBy(id string, key ed25519.PublicKey) *AddrRecord {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, r := range b.records[id] {
+		if r.Info.PublicKey.Equal(key) {
+			return r
+		}
+	}
+	return nil
+}
+
+// pinnedKey is the key pinned for id, or nil.
+func (b *addrBook) pinnedKey(id string) ed25519.PublicKey {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.pinned[id]
+}
+
+// pin trusts key for id from now on, unless another key is pinned for it
+// already. It reports whether key is the one pinned for id.
+func (b *addrBook) pin(id string, key ed25519.PublicKey) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if old, ok := b.pinned[id]; ok {
+		return old.Equal(key)
+	}
+	b.pinned[id] = key
+	if err := b.save(); err != nil {
+		fmt.Printf("\nErr: Could not save the key pinned for %s: %v\n", id, err)
+		fmt.Print("> ")
+	}
+	return true
+}
+
+// all returns every record, sorted by node.
+func (b *addrBook) all() []*AddrRecord {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.list()
+}
+
+func (b *addrBook) list() []*AddrRecord {
+	var rs []*AddrRecord
+	for _, r := range b.records {
+		rs = append(rs, r...)
+	}
+	sort.Slice(rs, func(i, j int) bool {
+		if rs[i].ID != rs[j].ID {
+			return rs[i].ID < rs[j].ID
+		}
+		return rs[i].Stamp > rs[j].Stamp
+	})
+	return rs
+}
+
+// add keeps r if it is signed and newer than what we have for its name and
+// key. It reports whether that name and key were new to us. Past
+// maxKeysPerName keys for a name, the oldest record whose key isn't pinned
+// goes.
+func (b *addrBook) add(r *AddrRecord) (bool, error) {
+	if err := r.verify(); err != nil {
+		return false, err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	rs := b.records[r.ID]
+	for i, old := range rs {
+		if old.Info.PublicKey.Equal(r.Info.PublicKey) {
+			if old.Stamp >= r.Stamp {
+				return false, nil
+			}
+			rs[i] = r
+			return false, b.save()
+		}
+	}
+	rs = append(rs, r)
+	if len(rs) > maxKeysPerName {
+		oldest := -1
+		for i, old := range rs {
+			if !old.Info.PublicKey.Equal(b.pinned[r.ID]) && (oldest < 0 || old.Stamp < rs[oldest].Stamp) {
+				oldest = i
+			}
+		}
+		rs = append(rs[:oldest], rs[oldest+1:]...)
+	}
+	b.records[r.ID] = rs
+	return true, b.save()
+}
+
+// peersData is what a peers file holds: address records, and the keys
+// pinned for some names. A plain JSON list of records is a peers file too.
+type peersData struct {
+	Records []*AddrRecord                `json:"records"`
+	Pinned  map[string]ed25519.PublicKey `json:"pinned,omitempty"`
+}
+
+func (b *addrBook) save() error {
+	if b.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(&peersData{Records: b.list(), Pinned: b.pinned}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeSynced(b.path, data)
+}
+
+// load adds the records in a peers file and pins the keys it lists as pinned.
+// With trusted set, the keys of all its records are pinned too. It returns
+// how many records were new.
+func (b *addrBook) load(path string, trusted bool) (int, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	var f peersData
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("[")) {
+		err = json.Unmarshal(data, &f.Records)
+	} else {
+		err = json.Unmarshal(data, &f)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("%s is not a peers file: %v", path, err)
+	}
+	keys := make(map[string]ed25519.PublicKey)
+	for id, key := range f.Pinned {
+		if len(key) != ed25519.PublicKeySize {
+			return 0, fmt.Errorf("%s pins an invalid key for %s", path, id)
+		}
+		keys[id] = key
+	}
+	if trusted {
+		for _, r := range f.Records {
+			if err := r.verify(); err != nil {
+				return 0, err
+			}
+			if key, ok := keys[r.ID]; ok && !key.Equal(r.Info.PublicKey) {
+				return 0, fmt.Errorf("%s gives %s more than one key", path, r.ID)
+			}
+			keys[r.ID] = r.Info.PublicKey
+		}
+	}
+	b.mu.Lock()
+	for id, key := range keys {
+		b.pinned[id] = key
+	}
+	err = b.save()
+	b.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, r := range f.Records {
+		if added, err := b.add(r); err != nil {
+			return n, err
+		} else if added {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func peersPath(dataDir string) string {
+	return filepath.Join(dataDir, "peers.json")
+}
+
+// openAddrBook loads the address book kept in dataDir and saves it there from
+// now on. What we discovered isn't trusted, so only the keys we pinned before
+// are pinned again.
+func (host *Host) openAddrBook(dataDir string) error {
+	_, err := host.book.load(peersPath(dataDir), false)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	host.book.mu.Lock()
+	defer host.book.mu.Unlock()
+	host.book.path = peersPath(dataDir)
+	return nil
+}
+
+// resolve finds where peerID can be reached and its key. The key is the one
+// pinned for peerID, or else the one the chain has for it, which is pinned
+// from then on. Where it listens comes from the newest record signed by that
+// key, in the address book or in the DHT if we're in one, and only then from
+// the chain.
+func (host *Host) resolve(peerID string) (*PeerInfo, error) {
+	key := host.book.pinnedKey(peerID)
+	var onChain *PeerInfo
+	if key == nil {
+		pi, err := host.lookupPeer(peerID)
+		if err != nil {
+			return nil, err
+		}
+		if !host.book.pin(peerID, pi.PublicKey) {
+			return nil, fmt.Errorf("%s has a key on the chain other than the one we know it by", peerID)
+		}
+		key, onChain = pi.PublicKey, pi
+	}
+	r := host.book.signedBy(peerID, key)
+	if host.dht != nil && (r == nil || time.Since(time.Unix(0, r.Stamp)) > discoveryInterval) {
+		// The node may have moved since
+		if found := host.dhtFind(peerID, key); found != nil && (r == nil || found.Stamp > r.Stamp) {
+			host.book.add(found)
+			r = found
+		}
+	}
+	if r != nil {
+		info := r.Info
+		return &info, nil
+	}
+	if onChain != nil {
+		return onChain, nil
+	}
+	pi, err := host.lookupPeer(peerID)
+	if err != nil {
+		return nil, fmt.Errorf("%v, and %s has not told us where it is", err, peerID)
+	}
+	if !pi.PublicKey.Equal(key) {
+		return nil, fmt.Errorf("%s has a key on the chain other than the one we know it by", peerID)
+	}
+	return pi, nil
+}
+
+// A discoveryMsg is a datagram between nodes looking for each other. Type is
+// query, records or announce, or for the DHT ping, pong, find_node,
+// find_value, nodes or store.
+type discoveryMsg struct {
+	Type    string        `json:"type"`
+	Records []*AddrRecord `json:"records,omitempty"`
+
+	// see dht.go
+	Call     uint64            `json:"call,omitempty"`
+	Target   *dhtKey           `json:"target,omitempty"`
+	Contacts []Contact         `json:"contacts,omitempty"`
+	Key      ed25519.PublicKey `json:"key,omitempty"`
+	Sig      []byte            `json:"sig,omitempty"`
+}
+
+// startDiscovery answers discovery queries on addr over UDP, and looks for
+// peers at the bootstrap addresses and, if lan is set, on the LAN. With dht
+// set, it joins the DHT through the bootstrap addresses instead.
+func (host *Host) startDiscovery(addr string, bootstrap []string, lan bool, dht bool) error {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	host.discovery = conn
+	if dht {
+		host.dht = newDHT(host.publicKey())
+	}
+	go host.serveDiscovery(conn)
+	if dht {
+		go host.runDHT(bootstrap)
+		bootstrap = nil
+	}
+	var group *net.UDPAddr
+	if lan {
+		group, err = net.ResolveUDPAddr("udp4", lanGroup)
+		if err != nil {
+			return err
+		}
+		mc, err := net.ListenMulticastUDP("udp4", nil, group)
+		if err != nil {
+			return err
+		}
+		go host.serveDiscovery(mc)
+	}
+	go host.discover(bootstrap, group)
+	return nil
+}
+
+// discover queries the bootstrap nodes and announces us on the LAN, every
+// discoveryInterval.
+func (host *Host) discover(bootstrap []string, group *net.UDPAddr) {
+	for {
+		for _, addr := range bootstrap {
+			query := discoveryMsg{Type: "query", Records: []*AddrRecord{host.addrRecord()}}
+			if err := host.sendDiscovery(addr, &query); err != nil {
+				fmt.Printf("\nErr: Could not query %s: %v\n", addr, err)
+				fmt.Print("> ")
+			}
+		}
+		if group != nil {
+			announce := discoveryMsg{Type: "announce", Records: []*AddrRecord{host.addrRecord()}}
+			if err := host.sendDiscovery(group.String(), &announce); err != nil {
+				fmt.Printf("\nErr: Could not announce on the LAN: %v\n", err)
+				fmt.Print("> ")
+			}
+		}
+		time.Sleep(discoveryInterval)
+	}
+}
+
+func (host *Host) sendDiscovery(addr string, msg *discoveryMsg) error {
+	to, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	_, err = host.discovery.WriteTo(b, to)
+	return err
+}
+
+// serveDiscovery answers queries and announcements arriving on conn, and
+// adds the records in them to the address book.
+func (host *Host) serveDiscovery(conn net.PacketConn) {
+	buf := make([]byte, 64*1024)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		} else if err != nil {
+			continue
+		}
+		var msg discoveryMsg
+		if json.Unmarshal(buf[:n], &msg) != nil {
+			continue
+		}
+		switch msg.Type {
+		case "query":
+			host.addRecords(msg.Records)
+			rs := append([]*AddrRecord{host.addrRecord()}, host.book.all()...)
+			if len(rs) > maxDiscoveryRecords {
+				rs = rs[:maxDiscoveryRecords]
+			}
+			host.sendDiscovery(from.String(), &discoveryMsg{Type: "records", Records: rs})
+		case "records", "announce":
+			added := host.addRecords(msg.Records)
+			if msg.Type == "announce" && added > 0 {
+				host.sendDiscovery(from.String(), &discoveryMsg{Type: "records", Records: []*AddrRecord{host.addrRecord()}})
+			}
+		default:
+			if host.dht != nil {
+				host.dhtReceived(&msg, from)
+			}
+		}
+	}
+}
+
+// addRecords adds what other nodes told us to the address book, and returns
+// how many nodes were new.
+func (host *Host) addRecords(rs []*AddrRecord) int {
+	n := 0
+	for _, r := range rs {
+		if r.ID == host.Name {
+			continue
+		}
+		added, err := host.book.add(r)
+		if err != nil {
+			continue
+		}
+		if added {
+			n++
+			scheme, addr := r.Info.endpoint()
+			fmt.Printf("\nFound %s at %s://%s\n", r.ID, scheme, addr)
+			fmt.Print("> ")
+		}
+	}
+	return n
+}
+
+func displayPeers(rs []*AddrRecord) {
+	if len(rs) == 0 {
+		fmt.Println("No peers known")
+		return
+	}
+	for _, r := range rs {
+		scheme, addr := r.Info.endpoint()
+		fmt.Printf("%s: %s://%s (%s)\n", r.ID, scheme, addr, time.Unix(0, r.Stamp).Format(time.Stamp))
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// downChain is a chain that can't be reached for lookups.
+type downChain struct{ Chain }
+
+func (downChain) Users() (map[string]PeerDetails, error) {
+	return nil, errors.New("connection refused")
+}
+
+// movedRecord is h's record from a minute ago, when it listened on port.
+func movedRecord(h *Host, port uint16) *AddrRecord {
+	r := h.addrRecord()
+	r.Info.Port = port
+	r.Stamp -= int64(time.Minute)
+	r.Sig = ed25519.Sign(h.key, r.signedBytes())
+	return r
+}
+
+// peersFile writes rs to a peers file and returns its path.
+func peersFile(t *testing.T, rs ...*AddrRecord) string {
+	book := newAddrBook()
+	book.path = filepath.Join(t.TempDir(), "peers.json")
+	for _, r := range rs {
+		if _, err := book.add(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return book.path
+}
+
+func TestAddrBook(t *testing.T) {
+	bob := newHost("bob", 4000, newMemChain())
+	book := newAddrBook()
+	r := bob.addrRecord()
+	if added, err := book.add(r); !added || err != nil {
+		t.Fatalf("added %v: %v", added, err)
+	}
+	forged := *r
+	forged.Info.IP = "10.0.0.66"
+	if _, err := book.add(&forged); err == nil {
+		t.Error("took a record with a bad signature")
+	}
+	// An old record doesn't replace a newer one
+	if added, err := book.add(movedRecord(bob, 3000)); added || err != nil || book.signedBy("bob", bob.publicKey()).Info.Port != 4000 {
+		t.Errorf("old record: %v %v", added, err)
+	}
+
+	// Someone else's record for bob sits next to his, it doesn't replace it
+	mallory := newHost("bob", 6666, newMemChain())
+	if added, err := book.add(mallory.addrRecord()); !added || err != nil {
+		t.Fatalf("added %v: %v", added, err)
+	}
+	if r := book.signedBy("bob", bob.publicKey()); r == nil || r.Info.Port != 4000 {
+		t.Fatalf("bob's record is %+v", r)
+	}
+
+	// A trusted peers file pins keys, and those records stay
+	if _, err := book.load(peersFile(t, r, mallory.addrRecord()), true); err == nil {
+		t.Error("pinned two keys for bob")
+	}
+	if _, err := book.load(peersFile(t, r), true); err != nil {
+		t.Fatal(err)
+	}
+	if !book.pinnedKey("bob").Equal(bob.publicKey()) {
+		t.Fatalf("pinned %x", book.pinnedKey("bob"))
+	}
+	for i := 0; i < maxKeysPerName; i++ {
+		book.add(newHost("bob", 6666, newMemChain()).addrRecord())
+	}
+	if book.signedBy("bob", bob.publicKey()) == nil {
+		t.Error("pinned record was pushed out")
+	}
+}
+
+func TestResolveKeys(t *testing.T) {
+	chain := newMemChain()
+	alice := newTestHost(t, "alice", chain)
+	bob := newTestHost(t, "bob", chain)
+	carol := newTestHost(t, "carol", chain)
+	mallory := newHost("bob", 6666, newMemChain())
+
+	// A record alone isn't enough to trust a key, that takes the chain
+	alice.chain = downChain{chain}
+	bob.Port = 4000
+	alice.addRecords([]*AddrRecord{bob.addrRecord()})
+	if pi, err := alice.resolve("bob"); err == nil {
+		t.Fatalf("resolved %+v", pi)
+	}
+	if alice.book.pinnedKey("bob") != nil {
+		t.Fatal("pinned a key from a record")
+	}
+	// With the chain, bob's key is pinned and his record says where he is
+	alice.chain = chain
+	pi, err := alice.resolve("bob")
+	if err != nil || !pi.PublicKey.Equal(bob.publicKey()) || pi.Port != 4000 {
+		t.Fatalf("resolved %+v: %v", pi, err)
+	}
+	// and from then on the chain isn't needed, whatever records say
+	alice.chain = downChain{chain}
+	alice.addRecords([]*AddrRecord{mallory.addrRecord()})
+	if pi, err := alice.resolve("bob"); err != nil || !pi.PublicKey.Equal(bob.publicKey()) || pi.Port != 4000 {
+		t.Fatalf("resolved %+v: %v", pi, err)
+	}
+
+	// Someone else got their record for carol in first: the chain decides
+	alice.addRecords([]*AddrRecord{newHost("carol", 6666, newMemChain()).addrRecord()})
+	alice.chain = chain
+	if pi, err := alice.resolve("carol"); err != nil || !pi.PublicKey.Equal(carol.publicKey()) || pi.Port == 6666 {
+		t.Fatalf("resolved %+v: %v", pi, err)
+	}
+
+	// A key on the chain other than the pinned one is refused
+	newTestHost(t, "dave", chain)
+	alice.book.pin("dave", mallory.publicKey())
+	if pi, err := alice.resolve("dave"); err == nil || pi != nil {
+		t.Fatalf("resolved dave to %+v", pi)
+	}
+	if !alice.book.pinnedKey("dave").Equal(mallory.publicKey()) {
+		t.Fatal("pinned key changed")
+	}
+}
+
+func TestBootstrap(t *testing.T) {
+	chain := newMemChain()
+	alice := newTestHost(t, "alice", chain)
+	bob := newTestHost(t, "bob", chain)
+	listen(t, alice)
+	listen(t, bob)
+	// alice can't reach the chain, and only knows where bob used to be
+	alice.chain = downChain{chain}
+	if _, err := alice.book.load(peersFile(t, movedRecord(bob, 1)), true); err != nil {
+		t.Fatal(err)
+	}
+	go alice.stateManager()
+	go bob.stateManager()
+
+	if err := bob.startDiscovery("127.0.0.1:0", nil, false, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.startDiscovery("127.0.0.1:0", []string{bob.discovery.LocalAddr().String()}, false, false); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, alice, func() bool {
+		r := alice.book.signedBy("bob", bob.publicKey())
+		return r != nil && r.Info.Port == bob.Port
+	})
+	waitFor(t, bob, func() bool { return bob.book.signedBy("alice", alice.publicKey()) != nil })
+
+	pi, err := alice.resolve("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	openTrustline(t, alice, bob, pi)
+}
+
+func TestBootstrapWithoutPeers(t *testing.T) {
+	chain := newMemChain()
+	alice := newTestHost(t, "alice", chain)
+	bob := newTestHost(t, "bob", chain)
+	listen(t, alice)
+	listen(t, bob)
+	// Neither was given a peers file
+	for _, h := range []*Host{alice, bob} {
+		if err := h.openAddrBook(t.TempDir()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	go alice.stateManager()
+	go bob.stateManager()
+	if err := bob.startDiscovery("127.0.0.1:0", nil, false, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.startDiscovery("127.0.0.1:0", []string{bob.discovery.LocalAddr().String()}, false, false); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, alice, func() bool { return alice.book.signedBy("bob", bob.publicKey()) != nil })
+	waitFor(t, bob, func() bool { return bob.book.signedBy("alice", alice.publicKey()) != nil })
+
+	// The keys come from the chain on first contact
+	pi, err := alice.resolve("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	openTrustline(t, alice, bob, pi)
+
+	// They are kept in the peers files, and do without the chain from then on
+	for _, c := range []struct{ h, peer *Host }{{alice, bob}, {bob, alice}} {
+		book := newAddrBook()
+		if _, err := book.load(c.h.book.path, false); err != nil {
+			t.Fatal(err)
+		}
+		if !book.pinnedKey(c.peer.Name).Equal(c.peer.publicKey()) {
+			t.Errorf("%s pinned %x for %s", c.h.Name, book.pinnedKey(c.peer.Name), c.peer.Name)
+		}
+	}
+	alice.chain = downChain{chain}
+	if pi, err := alice.resolve("bob"); err != nil || pi.Port != bob.Port {
+		t.Fatalf("resolved %+v: %v", pi, err)
+	}
+}
+
+// multicastWorks reports whether a multicast datagram sent here comes back.
+func multicastWorks() bool {
+	group, err := net.ResolveUDPAddr("udp4", lanGroup)
+	if err != nil {
+		return false
+	}
+	mc, err := net.ListenMulticastUDP("udp4", nil, group)
+	if err != nil {
+		return false
+	}
+	defer mc.Close()
+	conn, err := net.ListenPacket("udp4", ":0")
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+	if _, err := conn.WriteTo([]byte("{}"), group); err != nil {
+		return false
+	}
+	mc.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	_, _, err = mc.ReadFrom(make([]byte, 64))
+	return err == nil
+}
+
+func TestLANDiscovery(t *testing.T) {
+	if !multicastWorks() {
+		t.Skip("multicast is not available here")
+	}
+	alice := newTestHost(t, "alice", newMemChain())
+	go alice.stateManager()
+	bob := newTestHost(t, "bob", newMemChain())
+	go bob.stateManager()
+	listen(t, alice)
+	listen(t, bob)
+	for _, h := range []*Host{alice, bob} {
+		if err := h.startDiscovery(":0", nil, true, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, alice, func() bool { return alice.book.signedBy("bob", bob.publicKey()) != nil })
+	waitFor(t, bob, func() bool { return bob.book.signedBy("alice", alice.publicKey()) != nil })
+}
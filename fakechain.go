@@ -1,10 +1,16 @@
 package main
 
 import (
+	"crypto/ed25519"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/google/go-querystring/query"
 )
@@ -13,7 +19,9 @@ import (
 // Expects a REST server on the other side.
 // May want to do something with a session that's kept alive?
 
-const destURL = "http://ec2-34-222-59-29.us-west-2.compute.amazonaws.com:5000/"
+// destURL can be pointed at a local FakechainServer with --fakechain.
+var destURL = "http://ec2-34-222-59-29.us-west-2.compute.amazonaws.com:5000/"
+
 const candidateKey = "akash"
 
 // AddUser is for adding a user to FakeChain
@@ -27,8 +35,13 @@ type AddUser struct {
 
 // PeerInfo is for connection information on peers
 type PeerInfo struct {
-	IP   string `json:"host"`
-	Port uint16 `json:"port"`
+	IP          string            `json:"host"`
+	Port        uint16            `json:"port"`
+	PublicKey   ed25519.PublicKey `json:"public_key,omitempty"`
+	Fingerprint string            `json:"fingerprint,omitempty"`
+	// Addr is where the node listens as scheme://address, if not TCP on
+	// IP and Port. See transport.go.
+	Addr string `json:"addr,omitempty"`
 }
 
 // PeerDetails is used to serialize the data from getUsers
@@ -44,6 +57,15 @@ type PayUser struct {
 	Receiver  string `url:"receiver"`
 	Password  string `url:"private_key"`
 	Amount    uint32 `url:"amount"`
+	Ref       string `url:"ref,omitempty"`
+}
+
+// GetTransfer is for checking whether sender made a transfer with ref. The
+// hosted FakeChain doesn't know it and ignores ref in pay_user.
+type GetTransfer struct {
+	Candidate string `url:"candidate"`
+	Sender    string `url:"sender"`
+	Ref       string `url:"ref"`
 }
 
 // GetOrDeleteUsers is used to get a JSON of users or delete all users
@@ -51,65 +73,154 @@ type GetOrDeleteUsers struct {
 	Candidate string `url:"candidate"`
 }
 
-func addUser(id string, balance uint32, password string, ip string, port uint16) string {
-	endpoint := "add_user?"
-	p := PeerInfo{IP: ip, Port: port}
-	pb, err := json.Marshal(p)
-	ferror(err)
-	m := AddUser{Candidate: candidate, ID: id, Balance: balance, Password: password, PeerInfo: string(pb)}
+// StatusError is returned when FakeChain answers with a status other than 200.
+type StatusError struct {
+	Code   int
+	Status string
+}
+
+func (e *StatusError) Error() string {
+	return "fakechain: " + e.Status
+}
 
-	v, err := query.Values(m)
-	ferror(err)
+// errTimeout is returned when FakeChain didn't answer within fakechainClient's
+// timeout.
+var errTimeout = errors.New("fakechain: timed out")
 
+var fakechainClient = &http.Client{Timeout: 10 * time.Second}
+
+// Calls that are safe to repeat are retried up to fakechainRetries times,
+// doubling fakechainBackoff each time. pay_user is only retried when the
+// request never left this machine, since a lost response may hide a payment
+// that went through.
+var (
+	fakechainRetries = 3
+	fakechainBackoff = 250 * time.Millisecond
+)
+
+// call makes a GET request to endpoint and returns the body.
+func call(endpoint string, params interface{}, idempotent bool) ([]byte, error) {
+	v, err := query.Values(params)
+	if err != nil {
+		return nil, err
+	}
 	url := destURL + endpoint + v.Encode()
-	resp, err := http.Get(url)
-	ferror(err)
 
-	bodyBytes, err := ioutil.ReadAll(resp.Body)
-	ferror(err)
-	bodyString := string(bodyBytes)
-	return bodyString
+	backoff := fakechainBackoff
+	for attempt := 0; ; attempt++ {
+		body, err := get(url)
+		if err == nil || attempt == fakechainRetries || !retryable(err, idempotent) {
+			return body, err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
 }
 
-func payUser(sender string, receiver string, password string, amount uint32) string {
-	endpoint := "pay_user?"
-	m := PayUser{candidate, sender, receiver, password, amount}
+func get(url string) ([]byte, error) {
+	resp, err := fakechainClient.Get(url)
+	if err != nil {
+		if ue, ok := err.(interface{ Timeout() bool }); ok && ue.Timeout() {
+			return nil, fmt.Errorf("%w: %v", errTimeout, err)
+		}
+		return nil, err
+	}
+	defer resp.Body.Close()
 
-	v, err := query.Values(m)
-	ferror(err)
+	if resp.StatusCode != http.StatusOK {
+		return nil, &StatusError{resp.StatusCode, resp.Status}
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return body, nil
+}
 
-	url := destURL + endpoint + v.Encode()
-	resp, err := http.Get(url)
-	ferror(err)
+func retryable(err error, idempotent bool) bool {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return true
+	}
+	if !idempotent {
+		return false
+	}
+	var se *StatusError
+	if errors.As(err, &se) {
+		return se.Code >= 500
+	}
+	return true
+}
 
-	bodyBytes, err := ioutil.ReadAll(resp.Body)
-	ferror(err)
-	bodyString := string(bodyBytes)
-	// Should do proper error check, but leave it
-	return bodyString
+// result turns a FakeChain response body into an error unless it is "success".
+func result(body []byte) (string, error) {
+	res := strings.TrimSpace(string(body))
+	if res == "success" {
+		return res, nil
+	}
+	lower := strings.ToLower(res)
+	switch {
+	case strings.Contains(lower, "insufficient"):
+		return res, errInsufficientFunds
+	case strings.Contains(lower, "private key"), strings.Contains(lower, "password"):
+		return res, errInvalidKey
+	case strings.Contains(lower, "unknown user"), strings.Contains(lower, "not found"), strings.Contains(lower, "does not exist"):
+		return res, errUnknownUser
+	}
+	return res, errors.New("fakechain: " + res)
 }
 
-func getUsers() map[string]PeerDetails {
-	endpoint := "get_users?"
-	m := GetOrDeleteUsers{candidateKey}
+func addUser(id string, balance uint32, password string, pi PeerInfo) (string, error) {
+	pb, err := json.Marshal(pi)
+	if err != nil {
+		return "", err
+	}
+	m := AddUser{Candidate: candidate, ID: id, Balance: balance, Password: password, PeerInfo: string(pb)}
+
+	// FakeChain only refreshes peering_info for a known user, so this is
+	// safe to repeat.
+	body, err := call("add_user?", m, true)
+	if err != nil {
+		return "", err
+	}
+	return result(body)
+}
 
-	v, err := query.Values(m)
-	ferror(err)
+func payUser(sender string, receiver string, password string, amount uint32, ref string) (string, error) {
+	m := PayUser{candidate, sender, receiver, password, amount, ref}
+	body, err := call("pay_user?", m, false)
+	if err != nil {
+		return "", err
+	}
+	return result(body)
+}
 
-	url := destURL + endpoint + v.Encode()
-	resp, err := http.Get(url)
-	ferror(err)
+func getTransfer(sender string, ref string) (bool, error) {
+	m := GetTransfer{candidate, sender, ref}
+	body, err := call("get_transfer?", m, true)
+	var se *StatusError
+	if errors.As(err, &se) && se.Code == http.StatusNotFound {
+		return false, errNoTransfers
+	}
+	if err != nil {
+		return false, err
+	}
+	return strconv.ParseBool(strings.TrimSpace(string(body)))
+}
 
-	body, err := ioutil.ReadAll(resp.Body)
+func getUsers() (map[string]PeerDetails, error) {
+	m := GetOrDeleteUsers{candidateKey}
+	body, err := call("get_users?", m, true)
 	if err != nil {
-		panic(err.Error())
+		return nil, err
 	}
 
 	var data map[string]PeerDetails
 	err = json.Unmarshal(body, &data)
-	ferror(err)
-
-	return data
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
 }
 
 func printPeerDetails(data map[string]PeerDetails) {
@@ -118,23 +229,49 @@ func printPeerDetails(data map[string]PeerDetails) {
 	}
 }
 
-func deleteUsers() string {
-	endpoint := "delete_all_users?"
+func deleteUsers() (string, error) {
 	m := GetOrDeleteUsers{candidateKey}
-	v, err := query.Values(m)
-	ferror(err)
+	body, err := call("delete_all_users?", m, true)
+	if err != nil {
+		return "", err
+	}
+	return result(body)
+}
 
-	url := destURL + endpoint + v.Encode()
-	resp, err := http.Get(url)
-	ferror(err)
-
-	if resp.StatusCode == http.StatusOK {
-		bodyBytes, err := ioutil.ReadAll(resp.Body)
-		ferror(err)
-		bodyString := string(bodyBytes)
-		fmt.Println(bodyString)
-		return bodyString
-	}
-	// TODO: Should error properly
-	return resp.Status
+// httpChain is the Chain backed by the FakeChain REST server at destURL.
+type httpChain struct{}
+
+func (c *httpChain) Register(id string, balance uint32, password string, pi PeerInfo) error {
+	_, err := addUser(id, balance, password, pi)
+	return err
+}
+
+func (c *httpChain) Users() (map[string]PeerDetails, error) {
+	return getUsers()
+}
+
+func (c *httpChain) Pay(sender string, receiver string, password string, amount uint32, ref string) error {
+	_, err := payUser(sender, receiver, password, amount, ref)
+	return err
+}
+
+func (c *httpChain) Paid(sender string, ref string) (bool, error) {
+	return getTransfer(sender, ref)
+}
+
+func (c *httpChain) Balance(id string) (uint32, error) {
+	ud, err := getUsers()
+	if err != nil {
+		return 0, err
+	}
+	info, ok := ud[id]
+	if !ok {
+		return 0, fmt.Errorf("%w %s", errUnknownUser, id)
+	}
+	return info.Balance, nil
+}
+
+func (c *httpChain) Reset() error {
+	_, err := deleteUsers()
+	return err
 }
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// FakechainServer is an in-process implementation of the FakeChain REST API.
+// It serves the hosted server's four endpoints with the same query parameters
+// and JSON shapes, so whole networks can run on a laptop or in CI. Like the
+// hosted server, every candidate gets its own ledger. On top of those,
+// pay_user keeps an optional ref with the transfer, and a fifth endpoint,
+// get_transfer, answers true or false for whether sender made one with ref.
+type FakechainServer struct {
+	mu      sync.Mutex
+	ledgers map[string]*memChain
+}
+
+// NewFakechainServer returns an empty FakechainServer. Use it with
+// httptest.NewServer or http.ListenAndServe.
+func NewFakechainServer() *FakechainServer {
+	return &FakechainServer{ledgers: make(map[string]*memChain)}
+}
+
+func (s *FakechainServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	candidate := q.Get("candidate")
+	if candidate == "" {
+		http.Error(w, "missing candidate", http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	mc, ok := s.ledgers[candidate]
+	if !ok {
+		mc = newMemChain()
+		s.ledgers[candidate] = mc
+	}
+	s.mu.Unlock()
+
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	switch r.URL.Path {
+	case "/add_user":
+		if q.Get("public_key") == "" {
+			http.Error(w, "missing public_key", http.StatusBadRequest)
+			return
+		}
+		amt, err := strconv.ParseUint(q.Get("amount"), 10, 32)
+		if err != nil {
+			http.Error(w, "invalid amount", http.StatusBadRequest)
+			return
+		}
+		err = mc.register(q.Get("public_key"), uint32(amt), q.Get("private_key"), q.Get("peering_info"))
+		writeResult(w, err)
+	case "/get_users":
+		getUsersResponse(w, mc)
+	case "/pay_user":
+		amt, err := strconv.ParseUint(q.Get("amount"), 10, 32)
+		if err != nil {
+			http.Error(w, "invalid amount", http.StatusBadRequest)
+			return
+		}
+		err = mc.pay(q.Get("sender"), q.Get("receiver"), q.Get("private_key"), uint32(amt), q.Get("ref"))
+		writeResult(w, err)
+	case "/get_transfer":
+		fmt.Fprint(w, mc.refs[q.Get("sender")][q.Get("ref")])
+	case "/delete_all_users":
+		mc.users = make(map[string]*chainUser)
+		mc.refs = make(map[string]map[string]bool)
+		writeResult(w, nil)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// writeResult answers like the hosted server: "success" or an error line.
+func writeResult(w http.ResponseWriter, err error) {
+	if err != nil {
+		fmt.Fprintf(w, "error: %v", err)
+		return
+	}
+	fmt.Fprint(w, "success")
+}
+
+// getUsersResponse writes the user table. peering_info is stored as the raw
+// string the user registered and is embedded as JSON when it is valid JSON.
+func getUsersResponse(w http.ResponseWriter, mc *memChain) {
+	type user struct {
+		Balance  uint32          `json:"amount"`
+		PeerInfo json.RawMessage `json:"peering_info"`
+	}
+	out := make(map[string]user)
+	for id, u := range mc.users {
+		pi := json.RawMessage(u.PeerInfo)
+		if !json.Valid(pi) {
+			pi, _ = json.Marshal(u.PeerInfo)
+		}
+		out[id] = user{Balance: u.Balance, PeerInfo: pi}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
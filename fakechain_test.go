@@ -1,28 +1,134 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
+// useLocalFakechain points the FakeChain client at an in-process server for
+// the duration of a test.
+func useLocalFakechain(t *testing.T) {
+	useFakechainHandler(t, NewFakechainServer())
+}
+
+func useFakechainHandler(t *testing.T, h http.Handler) {
+	srv := httptest.NewServer(h)
+	old, oldBackoff := destURL, fakechainBackoff
+	destURL = srv.URL + "/"
+	fakechainBackoff = time.Millisecond
+	t.Cleanup(func() {
+		destURL, fakechainBackoff = old, oldBackoff
+		srv.Close()
+	})
+}
+
 func TestAPI(t *testing.T) {
+	useLocalFakechain(t)
+
 	// Add two users
-	res := addUser("akash", 200, "password1", "localhost", 4000)
-	fmt.Println(res)
-	res = addUser("bob", 100, "password2", "localhost", 4001)
-	fmt.Println(res)
+	res, err := addUser("akash", 200, "password1", PeerInfo{IP: "localhost", Port: 4000})
+	fmt.Println(res, err)
+	res, err = addUser("bob", 100, "password2", PeerInfo{IP: "localhost", Port: 4001})
+	fmt.Println(res, err)
 
-	ud := getUsers()
+	ud, err := getUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
 	printPeerDetails(ud)
+	if ud["bob"].PeerInfo.Port != 4001 {
+		t.Fatalf("bob peering_info = %+v", ud["bob"].PeerInfo)
+	}
 
 	// Akash pays bob 50
-	res = payUser("akash", "bob", "password1", 50)
-	fmt.Println(res)
-	ud = getUsers()
+	res, err = payUser("akash", "bob", "password1", 50, "")
+	fmt.Println(res, err)
+	ud, _ = getUsers()
 	printPeerDetails(ud)
+	if ud["akash"].Balance != 150 || ud["bob"].Balance != 100+50 {
+		t.Fatalf("balances after payment: akash=%d bob=%d", ud["akash"].Balance, ud["bob"].Balance)
+	}
+
+	// Refused payments come back as typed errors
+	if _, err = payUser("akash", "bob", "password2", 10, ""); !errors.Is(err, errInvalidKey) {
+		t.Fatalf("wrong private key: got %v", err)
+	}
+	if _, err = payUser("bob", "akash", "password2", 1000, ""); !errors.Is(err, errInsufficientFunds) {
+		t.Fatalf("overdraft: got %v", err)
+	}
+	if _, err = payUser("bob", "carol", "password2", 1, ""); !errors.Is(err, errUnknownUser) {
+		t.Fatalf("unknown receiver: got %v", err)
+	}
 
 	// Delete all users
 	deleteUsers()
-	ud = getUsers()
+	ud, _ = getUsers()
 	printPeerDetails(ud)
+	if len(ud) != 0 {
+		t.Fatalf("%d users left after delete", len(ud))
+	}
+}
+
+// flaky fails the first n requests with 503.
+type flaky struct {
+	n, calls int32
+	h        http.Handler
+}
+
+func (f *flaky) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if atomic.AddInt32(&f.calls, 1) <= atomic.LoadInt32(&f.n) {
+		http.Error(w, "try again", http.StatusServiceUnavailable)
+		return
+	}
+	f.h.ServeHTTP(w, r)
+}
+
+func TestRetries(t *testing.T) {
+	f := &flaky{n: 2, h: NewFakechainServer()}
+	useFakechainHandler(t, f)
+
+	if _, err := getUsers(); err != nil {
+		t.Fatalf("get_users not retried: %v", err)
+	}
+	if calls := atomic.LoadInt32(&f.calls); calls != 3 {
+		t.Fatalf("%d calls, want 3", calls)
+	}
+
+	// A 503 from pay_user may hide a payment that went through
+	atomic.StoreInt32(&f.n, 1)
+	atomic.StoreInt32(&f.calls, 0)
+	_, err := payUser("akash", "bob", "password1", 1, "")
+	var se *StatusError
+	if !errors.As(err, &se) || se.Code != http.StatusServiceUnavailable {
+		t.Fatalf("got %v, want 503", err)
+	}
+	if calls := atomic.LoadInt32(&f.calls); calls != 1 {
+		t.Fatalf("pay_user retried %d times", calls-1)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	useFakechainHandler(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+	}))
+	old := fakechainClient.Timeout
+	fakechainClient.Timeout = 10 * time.Millisecond
+	defer func() { fakechainClient.Timeout = old }()
+
+	if _, err := payUser("akash", "bob", "password1", 1, ""); !errors.Is(err, errTimeout) {
+		t.Fatalf("got %v, want timeout", err)
+	}
+}
+
+func TestNoTransfers(t *testing.T) {
+	// The hosted server has no get_transfer
+	useFakechainHandler(t, http.NotFoundHandler())
+	if _, err := (&httpChain{}).Paid("akash", "s1"); !errors.Is(err, errNoTransfers) {
+		t.Fatalf("got %v, want %v", err, errNoTransfers)
+	}
 }
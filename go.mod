@@ -1,7 +1,10 @@
 module messages
 
+go 1.20
+
 require (
 	github.com/google/go-querystring v1.0.0
+	github.com/gorilla/websocket v1.4.2
 	github.com/howeyc/gopass v0.0.0-20170109162249-bf9dde6d0d2c
 	github.com/oleiade/lane v1.0.0
 	github.com/urfave/cli v1.20.0
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Nodes tell each other about the trustlines in the network so payments can
+// be routed over them. Each node announces its own trustlines as edges, one
+// for each peer it can pay, with how much it can pay it rounded down to a
+// multiple of capacityStep, so the exact balance stays private. Edges are
+// signed by the node that announces them and flood from neighbour to
+// neighbour in Gossip messages: a node passes an edge on the first time it
+// sees it, and drops copies and older versions going by its timestamp.
+//
+// Nodes announce their edges again when the capacity changes and every
+// gossipRefresh, and forget other nodes' edges gossipExpiry after they were
+// announced. An edge to a peer that went offline is announced with no
+// capacity. To keep the flood in check, a node takes at most one new version
+// of an edge per gossipMinGap, passes edges on in one batch per neighbour on
+// each tick of the stateManager, at most gossipBatch edges or gossipBytes to
+// a frame, and drops edges from a neighbour past gossipBurst a tick. Names
+// longer than maxNameLen are refused.
+//
+// Edges from a node whose key we don't have yet wait while the key is looked
+// up off the stateManager, at most keyLookups at a time. A failed lookup
+// isn't tried again for keyRetry, and the node's edges are dropped until then.
+
+const (
+	capacityStep  = 10
+	gossipRefresh = 5 * time.Minute
+	gossipExpiry  = 15 * time.Minute
+	gossipMinGap  = time.Second
+	gossipBurst   = 500
+	gossipBatch   = 200
+	gossipBytes   = maxFrameSize / 2
+	maxNameLen    = 64
+	keyLookups    = 8
+	keyRetry      = gossipRefresh
+)
+
+var errUnknownKey = errors.New("key not known yet")
+
+// A keyLookup is a node whose key we are looking up or failed to, with the
+// edges waiting for it.
+type keyLookup struct {
+	started time.Time
+	failed  bool
+	edges   []*Edge
+}
+
+// An Edge says From can pay To about Capacity over their trustline, as of
+// Stamp in Unix nanoseconds.
+type Edge struct {
+	From     string `json:"from"`
+	To       string `json:"to"`
+	Capacity uint32 `json:"cap"`
+	Stamp    int64  `json:"stamp"`
+	Sig      []byte `json:"sig,omitempty"`
+
+	// The neighbour we got it from, who doesn't need it back
+	via string
+}
+
+func (e *Edge) signedBytes() []byte {
+	c := *e
+	c.Sig = nil
+	b, err := json.Marshal(&c)
+	ferror(err) // should never happen
+	return b
+}
+
+func (e *Edge) time() time.Time {
+	return time.Unix(0, e.Stamp)
+}
+
+// edge returns the edge we know from one node to another, or nil.
+func (host *Host) edge(from string, to string) *Edge {
+	return host.graph[from][to]
+}
+
+func (host *Host) putEdge(e *Edge) {
+	if host.graph[e.From] == nil {
+		host.graph[e.From] = make(map[string]*Edge)
+	}
+	host.graph[e.From][e.To] = e
+}
+
+// capacity is how much we can pay peer, rounded down to a multiple of
+// capacityStep.
+func (host *Host) capacity(peer *Peer) uint32 {
+	free := int(peer.trustline.PeerLimit) - host.exposure(peer)
+	if free < capacityStep {
+		return 0
+	}
+	return uint32(free - free%capacityStep)
+}
+
+// announceEdges announces our edges that changed, or all of them if it's
+// been gossipRefresh. Runs from the stateManager.
+func (host *Host) announceEdges() {
+	now := time.Now()
+	caps := make(map[string]uint32)
+	for _, id := range host.openLinks() {
+		caps[id] = host.capacity(host.peerIDtoPeer[id])
+	}
+	// Trustlines we no longer have, or whose peer went offline
+	for id, e := range host.graph[host.Name] {
+		if _, ok := caps[id]; !ok && e.Capacity > 0 {
+			caps[id] = 0
+		}
+	}
+	for id, c := range caps {
+		old := host.edge(host.Name, id)
+		if old != nil && now.Sub(old.time()) < gossipMinGap {
+			continue
+		}
+		if old != nil && old.Capacity == c && now.Sub(old.time()) < gossipRefresh {
+			continue
+		}
+		e := &Edge{From: host.Name, To: id, Capacity: c, Stamp: now.UnixNano()}
+		e.Sig = ed25519.Sign(host.key, e.signedBytes())
+		host.putEdge(e)
+		host.relay = append(host.relay, e)
+	}
+}
+
+// newNeighbour brings peer up to date on the graph once a trustline with it
+// opens or resumes, and tells everyone about our edge to it.
+func (host *Host) newNeighbour(peer *Peer) {
+	host.announceEdges()
+	host.sendGraph(peer)
+}
+
+// sendGraph sends peer every edge we know of, when it has just become our
+// neighbour.
+func (host *Host) sendGraph(peer *Peer) {
+	var edges []*Edge
+	for _, to := range host.graph {
+		for _, e := range to {
+			edges = append(edges, e)
+		}
+	}
+	host.sendEdges(peer, edges)
+}
+
+func (host *Host) sendEdges(peer *Peer, edges []*Edge) {
+	if !peer.supports("Gossip") {
+		return
+	}
+	for len(edges) > 0 {
+		n, size := 0, 0
+		for n < len(edges) && n < gossipBatch {
+			b, err := json.Marshal(edges[n])
+			ferror(err) // should never happen
+			if n > 0 && size+len(b) > gossipBytes {
+				break
+			}
+			size += len(b)
+			n++
+		}
+		msg := Message{HostID: host.Name, PeerID: peer.PeerID, Type: "Gossip", Edges: edges[:n]}
+		host.sendTo(peer, &msg)
+		edges = edges[n:]
+	}
+}
+
+// flushGossip passes the edges that came in since the last tick on to our
+// neighbours, and forgets the ones that expired. Runs from the stateManager.
+func (host *Host) flushGossip() {
+	host.announceEdges()
+	for _, id := range host.openLinks() {
+		var edges []*Edge
+		for _, e := range host.relay {
+			if e.via != id {
+				edges = append(edges, e)
+			}
+		}
+		host.sendEdges(host.peerIDtoPeer[id], edges)
+	}
+	host.relay = nil
+	host.gossipRecv = make(map[string]int)
+	for id, l := range host.keyLookups {
+		if l.failed && time.Since(l.started) > keyRetry {
+			delete(host.keyLookups, id)
+		}
+	}
+
+	for from, to := range host.graph {
+		if from == host.Name {
+			continue
+		}
+		for id, e := range to {
+			if time.Since(e.time()) > gossipExpiry {
+				delete(to, id)
+			}
+		}
+		if len(to) == 0 {
+			delete(host.graph, from)
+		}
+	}
+}
+
+// gossipReceived takes in the edges peer passed on, keeping and passing on
+// the ones that are new to us.
+func (host *Host) gossipReceived(peer *Peer, msg *Message) {
+	if peer.pending {
+		return
+	}
+	for _, e := range msg.Edges {
+		host.gossipRecv[peer.PeerID]++
+		if host.gossipRecv[peer.PeerID] > gossipBurst {
+			return
+		}
+		e.via = peer.PeerID
+		err := host.checkEdge(e)
+		if errors.Is(err, errUnknownKey) {
+			host.awaitKey(e)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		host.putEdge(e)
+		host.relay = append(host.relay, e)
+	}
+}
+
+// awaitKey holds on to e until we have the key of the node that signed it,
+// starting a lookup if there's room for one.
+func (host *Host) awaitKey(e *Edge) {
+	l := host.keyLookups[e.From]
+	if l == nil {
+		running := 0
+		for _, l := range host.keyLookups {
+			if !l.failed {
+				running++
+			}
+		}
+		if running >= keyLookups {
+			return
+		}
+		l = &keyLookup{started: time.Now()}
+		host.keyLookups[e.From] = l
+		go host.lookupKey(e.From)
+	}
+	if !l.failed && len(l.edges) < gossipBatch {
+		l.edges = append(l.edges, e)
+	}
+}
+
+// lookupKey finds the key of node id, then checks the edges waiting for it.
+func (host *Host) lookupKey(id string) {
+	pi, err := host.resolve(id)
+	host.run(func() {
+		l := host.keyLookups[id]
+		if l == nil {
+			return
+		}
+		if err != nil {
+			l.failed = true
+			l.edges = nil
+			return
+		}
+		delete(host.keyLookups, id)
+		host.keys[id] = pi.PublicKey
+		for _, e := range l.edges {
+			if host.checkEdge(e) == nil {
+				host.putEdge(e)
+				host.relay = append(host.relay, e)
+			}
+		}
+	})
+}
+
+// checkEdge returns an error if e isn't a new, signed version of an edge that
+// hasn't expired.
+func (host *Host) checkEdge(e *Edge) error {
+	switch age := time.Since(e.time()); {
+	case e.From == "" || e.To == "" || e.From == e.To:
+		return fmt.Errorf("invalid edge")
+	case len(e.From) > maxNameLen || len(e.To) > maxNameLen:
+		return fmt.Errorf("name too long")
+	case e.From == host.Name:
+		return fmt.Errorf("our own edge")
+	case age > gossipExpiry || age < -gossipMinGap:
+		return fmt.Errorf("edge from %s to %s is out of date", e.From, e.To)
+	}
+	if old := host.edge(e.From, e.To); old != nil && e.Stamp-old.Stamp < int64(gossipMinGap) {
+		return fmt.Errorf("edge from %s to %s is not new", e.From, e.To)
+	}
+	key := host.nodeKey(e.From)
+	if key == nil {
+		return fmt.Errorf("%s: %w", e.From, errUnknownKey)
+	}
+	if !ed25519.Verify(key, e.signedBytes(), e.Sig) {
+		return fmt.Errorf("edge from %s to %s is not signed by %s", e.From, e.To, e.From)
+	}
+	return nil
+}
+
+// nodeKey returns the public key of node id, from the handshake if it's a
+// peer or else from an earlier lookup, or nil if we don't have it.
+func (host *Host) nodeKey(id string) ed25519.PublicKey {
+	if peer, ok := host.peerIDtoPeer[id]; ok && peer.key != nil {
+		return peer.key
+	}
+	return host.keys[id]
+}
+
+// graphEdges returns a copy of every edge we know of, sorted.
+func (host *Host) graphEdges() []Edge {
+	var edges []Edge
+	for _, to := range host.graph {
+		for _, e := range to {
+			edges = append(edges, *e)
+		}
+	}
+	sort.Slice(edges, func(i, j int) bool {
+		if edges[i].From != edges[j].From {
+			return edges[i].From < edges[j].From
+		}
+		return edges[i].To < edges[j].To
+	})
+	return edges
+}
+
+func displayGraph(edges []Edge) {
+	if len(edges) == 0 {
+		fmt.Println("No trustlines known")
+		return
+	}
+	for _, e := range edges {
+		fmt.Printf("%s -> %s: %d (%s ago)\n", e.From, e.To, e.Capacity, time.Since(e.time()).Round(time.Second))
+	}
+}
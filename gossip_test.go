@@ -0,0 +1,204 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestGossipFlood(t *testing.T) {
+	defer func(i time.Duration) { settleCheckInterval = i }(settleCheckInterval)
+	settleCheckInterval = 5 * time.Millisecond
+	chain := newMemChain()
+	alice := newTestHost(t, "alice", chain)
+	go alice.stateManager()
+	bob := newTestHost(t, "bob", chain)
+	go bob.stateManager()
+	carol := newTestHost(t, "carol", chain)
+	go carol.stateManager()
+	_, bobInfo := listen(t, bob)
+	_, carolInfo := listen(t, carol)
+	openTrustline(t, alice, bob, bobInfo)
+	openTrustline(t, bob, carol, carolInfo)
+
+	// Carol's edge reaches alice through bob
+	waitFor(t, alice, func() bool {
+		e := alice.edge("carol", "bob")
+		return e != nil && e.Capacity == defaultTrustlineLimit
+	})
+
+	// Bob owes carol 45, leaving 55 to pay her, announced as 50
+	bob.outbound <- &Message{HostID: "bob", PeerID: "carol", Type: "Pay", Amount: 45}
+	deadline := time.Now().Add(3 * gossipMinGap)
+	for {
+		var capacity uint32
+		alice.run(func() { capacity = alice.edge("bob", "carol").Capacity })
+		if capacity == 50 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("alice still sees %d from bob to carol", capacity)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	alice.run(func() {
+		if route := alice.findRoute("carol", 60); route != nil {
+			t.Errorf("routed 60 over %v", route)
+		}
+		if route := alice.findRoute("carol", 50); len(route) != 3 {
+			t.Errorf("no route for 50: %v", route)
+		}
+	})
+}
+
+// nextEdges returns the edges from node in the next Gossip sent to peer that
+// has any.
+func nextEdges(peer *Peer, node string) []*Edge {
+	for {
+		msg := parseRawBytes(<-peer.data)
+		var edges []*Edge
+		for _, e := range msg.Edges {
+			if e.From == node {
+				edges = append(edges, e)
+			}
+		}
+		if len(edges) > 0 {
+			return edges
+		}
+	}
+}
+
+func TestGossipChecks(t *testing.T) {
+	chain := newMemChain()
+	host := newTestHost(t, "bob", chain)
+	go host.stateManager()
+	alice := testPeer(host, "alice")
+	carol := testPeer(host, "carol")
+	dave := newTestHost(t, "dave", chain)
+	edge := func(to string, stamp time.Time, capacity uint32) *Edge {
+		e := &Edge{From: "dave", To: to, Capacity: capacity, Stamp: stamp.UnixNano()}
+		e.Sig = ed25519.Sign(dave.key, e.signedBytes())
+		return e
+	}
+	now := time.Now()
+	forged := edge("erin", now, 10)
+	forged.Capacity = 1000
+	good := edge("erin", now, 10)
+	gossip := func(edges ...*Edge) {
+		host.inbound <- &Message{HostID: "alice", PeerID: "bob", Type: "Gossip", Edges: edges}
+	}
+
+	gossip(forged, edge("erin", now.Add(-gossipExpiry-time.Minute), 20), good)
+	// Copies and updates too soon after are dropped
+	gossip(good, edge("erin", now.Add(gossipMinGap/2), 30))
+	if edges := nextEdges(carol, "dave"); len(edges) != 1 || edges[0].Capacity != 10 {
+		t.Fatalf("passed on %+v", edges)
+	}
+	// Not back to where it came from
+	for len(alice.data) > 0 {
+		if msg := parseRawBytes(<-alice.data); len(msg.Edges) > 0 && msg.Edges[0].From == "dave" {
+			t.Fatalf("sent back %+v", msg.Edges)
+		}
+	}
+
+	// Past the burst, the rest is dropped
+	flood := make([]*Edge, gossipBurst)
+	for i := range flood {
+		flood[i] = forged
+	}
+	gossip(append(flood, edge("frank", now, 10))...)
+	host.run(func() {
+		if e := host.edge("dave", "erin"); e.Capacity != 10 {
+			t.Errorf("kept %+v", e)
+		}
+		if e := host.edge("dave", "frank"); e != nil {
+			t.Errorf("kept %+v past the burst", e)
+		}
+	})
+}
+
+func TestGossipUnknownKey(t *testing.T) {
+	chain := newMemChain()
+	host := newTestHost(t, "bob", chain)
+	go host.stateManager()
+	testPeer(host, "alice")
+	key := newKey()
+	e := &Edge{From: "mallory", To: "erin", Capacity: 10, Stamp: time.Now().UnixNano()}
+	e.Sig = ed25519.Sign(key, e.signedBytes())
+	host.inbound <- &Message{HostID: "alice", PeerID: "bob", Type: "Gossip", Edges: []*Edge{e}}
+
+	// Mallory isn't on the chain, so the lookup fails and isn't tried again
+	waitFor(t, host, func() bool {
+		l := host.keyLookups["mallory"]
+		return l != nil && l.failed
+	})
+	host.inbound <- &Message{HostID: "alice", PeerID: "bob", Type: "Gossip", Edges: []*Edge{e}}
+	host.run(func() {
+		if l := host.keyLookups["mallory"]; !l.failed || len(l.edges) > 0 {
+			t.Errorf("lookup %+v", l)
+		}
+		if e := host.edge("mallory", "erin"); e != nil {
+			t.Errorf("kept %+v", e)
+		}
+	})
+}
+
+func TestRouteNeedsBothEdges(t *testing.T) {
+	host := newTestHost(t, "bob", newMemChain())
+	go host.stateManager()
+	testPeer(host, "alice")
+	edge := func(from string, to string) {
+		host.putEdge(&Edge{From: from, To: to, Capacity: 10, Stamp: time.Now().UnixNano()})
+	}
+	host.run(func() {
+		edge("alice", "dave")
+		edge("dave", "erin")
+		if path := host.findPath("alice", "erin", "", 10); path != nil {
+			t.Errorf("routed over one-way edge: %v", path)
+		}
+		edge("erin", "dave")
+		if path := host.findPath("alice", "erin", "", 10); len(path) != 3 {
+			t.Errorf("no route: %v", path)
+		}
+	})
+}
+
+func TestGossipFrameSize(t *testing.T) {
+	host := newTestHost(t, "bob", newMemChain())
+	go host.stateManager()
+	alice := testPeer(host, "alice")
+	carol := testPeer(host, "carol")
+
+	// Names past maxNameLen are refused
+	long := &Edge{From: "dave", To: string(make([]byte, 300)), Capacity: 10, Stamp: time.Now().UnixNano()}
+	host.run(func() {
+		if err := host.checkEdge(long); err == nil {
+			t.Error("took an edge with a 300 byte name")
+		}
+	})
+
+	// A full batch of long names is split over frames that fit
+	var edges []*Edge
+	for i := 0; i < gossipBatch; i++ {
+		name := fmt.Sprintf("%0*d", maxNameLen, i)
+		edges = append(edges, &Edge{From: name, To: "x" + name[1:], Capacity: 10, Stamp: time.Now().UnixNano(), Sig: make([]byte, ed25519.SignatureSize)})
+	}
+	host.run(func() { host.sendEdges(carol, edges) })
+	frames, sent := 0, 0
+	for sent < len(edges) {
+		msg := parseRawBytes(<-carol.data)
+		frames++
+		sent += len(msg.Edges)
+	}
+	if frames < 2 || sent != len(edges) {
+		t.Fatalf("sent %d edges in %d frames", sent, frames)
+	}
+
+	// A frame that is too large is reported, not sent
+	host.run(func() {
+		if host.sendTo(alice, &Message{HostID: "bob", PeerID: "alice", Type: "Reject", Reason: string(make([]byte, maxFrameSize))}) {
+			t.Error("sent an oversized frame")
+		}
+	})
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// Every connection starts with a Hello from the dialing side, answered with a
+// HelloAck or a HelloReject, before any trustline message. Hello carries the
+// protocol version, the node's name and the message types and optional
+// features it supports. The connection runs at the lower of both versions as
+// long as that is at least minProtocolVersion, with the features both sides
+// support. Since version 2 every frame is signed, including the Hello, which
+// proves the node is who it claims to be.
+//
+// A Hello from a node whose key is pinned is checked against that key before
+// anything else. For any other node the key has to be looked up on the chain
+// first, which anyone can make us do, so at most helloLookups run at a time,
+// and a name the lookup failed for is refused for helloRetry.
+const (
+	protocolVersion    = 2
+	minProtocolVersion = 2
+
+	helloLookups = 4
+	helloRetry   = time.Minute
+)
+
+var handshakeTimeout = 10 * time.Second
+
+// supportedTypes are the message types this node handles after the handshake.
+var supportedTypes = []string{
+	"Propose", "ProposeAccept", "ProposeReject",
+	"Resume", "ResumeAccept", "ResumeReject",
+	"Pay", "PayAck", "Reject",
+	"Settle", "SettleAck",
+	"State", "StateAck",
+	"Limit", "LimitAccept", "LimitReject",
+	"Prepare", "Fulfill", "Cancel", "Gossip",
+}
+
+// supportedFeatures are the optional protocol features every node offers, see
+// also host.features.
+var supportedFeatures = []string{resyncFeature}
+
+func (host *Host) hello(typ string, version int, features []string) *Message {
+	return &Message{
+		HostID:   host.Name,
+		Type:     typ,
+		Version:  version,
+		Types:    supportedTypes,
+		Features: features,
+	}
+}
+
+// dialHandshake introduces us to peerID over a new connection and checks that
+// it is who we dialed.
+func (host *Host) dialHandshake(peer *Peer) error {
+	peer.socket.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer peer.socket.SetDeadline(time.Time{})
+
+	if len(peer.key) == 0 {
+		return fmt.Errorf("%s has not published a public key", peer.PeerID)
+	}
+	hello := host.hello("Hello", protocolVersion, host.features())
+	host.sign(hello)
+	if _, err := peer.socket.Write(serialize(hello)); err != nil {
+		return err
+	}
+	ack, err := peer.frames.Next()
+	if err != nil {
+		return err
+	}
+	switch {
+	case ack.Type == "HelloReject":
+		return fmt.Errorf("%s refused the connection: %s", peer.PeerID, ack.Reason)
+	case ack.Type != "HelloAck":
+		return fmt.Errorf("expected HelloAck from %s, got %s", peer.PeerID, ack.Type)
+	case ack.HostID != peer.PeerID:
+		return fmt.Errorf("dialed %s but reached %s", peer.PeerID, ack.HostID)
+	case !verifySig(peer.key, ack):
+		return fmt.Errorf("%s answered with a bad signature", peer.PeerID)
+	case ack.Version < minProtocolVersion || ack.Version > protocolVersion:
+		return fmt.Errorf("%s answered with unsupported protocol version %d", peer.PeerID, ack.Version)
+	}
+	peer.negotiated(ack)
+	return host.startTLS(peer, true)
+}
+
+// acceptHandshake reads the Hello on an inbound connection and identifies the
+// peer from it.
+func (host *Host) acceptHandshake(peer *Peer) error {
+	peer.socket.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer peer.socket.SetDeadline(time.Time{})
+
+	hello, err := peer.frames.Next()
+	if err != nil {
+		return err
+	}
+	from := hello.HostID
+	if len(from) > maxNameLen {
+		from = from[:maxNameLen] + "..."
+	}
+	// Nothing the peer sent goes into the reject, so it always fits in a
+	// frame
+	reject := func(reason string) error {
+		msg := Message{HostID: host.Name, Type: "HelloReject", Reason: reason}
+		host.sign(&msg)
+		if mb, err := encodeFrame(&msg); err == nil {
+			peer.socket.Write(mb)
+		}
+		return fmt.Errorf("refused connection from %q: %s", from, reason)
+	}
+	switch {
+	case len(hello.HostID) > maxNameLen:
+		return reject("node ID too long")
+	case hello.Type != "Hello":
+		return reject("expected Hello")
+	case hello.HostID == "" || hello.HostID == host.Name:
+		return reject("invalid node ID")
+	case hello.Version < minProtocolVersion:
+		return reject(fmt.Sprintf("protocol version %d is older than %d", hello.Version, minProtocolVersion))
+	}
+	key := host.book.pinnedKey(hello.HostID)
+	if key != nil && !verifySig(key, hello) {
+		return reject("bad signature")
+	}
+	if key == nil && !host.startLookup(hello.HostID) {
+		return reject("unknown node, try again later")
+	}
+	pi, err := host.resolve(hello.HostID)
+	if key == nil {
+		host.lookupDone(hello.HostID, err)
+	}
+	if err != nil {
+		reject("unknown node")
+		return fmt.Errorf("refused connection from %q: %v", from, err)
+	}
+	if !verifySig(pi.PublicKey, hello) {
+		return reject("bad signature")
+	}
+	features := intersect(host.features(), hello.Features)
+	if !host.insecure && !contains(features, tlsFeature) {
+		return reject("encryption required")
+	}
+	peer.key = pi.PublicKey
+	peer.PeerInfo = pi
+
+	version := hello.Version
+	if version > protocolVersion {
+		version = protocolVersion
+	}
+	ack := host.hello("HelloAck", version, features)
+	ack.PeerID = hello.HostID
+	host.sign(ack)
+	mb, err := encodeFrame(ack)
+	if err != nil {
+		return err
+	}
+	if _, err := peer.socket.Write(mb); err != nil {
+		return err
+	}
+	peer.PeerID = hello.HostID
+	hello.Version = version
+	hello.Features = features
+	peer.negotiated(hello)
+	return host.startTLS(peer, false)
+}
+
+// startLookup reports whether the key of id, a node that said Hello, may be
+// looked up now, and counts the lookup as running if so.
+func (host *Host) startLookup(id string) bool {
+	ok := false
+	host.run(func() {
+		running := 0
+		for id, l := range host.helloLookups {
+			if l.failed && time.Since(l.started) > helloRetry {
+				delete(host.helloLookups, id)
+			} else if !l.failed {
+				running++
+			}
+		}
+		if _, seen := host.helloLookups[id]; seen || running >= helloLookups {
+			return
+		}
+		host.helloLookups[id] = &keyLookup{started: time.Now()}
+		ok = true
+	})
+	return ok
+}
+
+// lookupDone ends the lookup of id's key, keeping it for helloRetry if it
+// failed.
+func (host *Host) lookupDone(id string, err error) {
+	host.run(func() {
+		if err == nil {
+			delete(host.helloLookups, id)
+			return
+		}
+		host.helloLookups[id] = &keyLookup{started: time.Now(), failed: true}
+	})
+}
+
+// negotiated records what the other side of a finished handshake supports.
+func (peer *Peer) negotiated(m *Message) {
+	peer.version = m.Version
+	peer.types = make(map[string]bool)
+	for _, t := range m.Types {
+		peer.types[t] = true
+	}
+	peer.features = make(map[string]bool)
+	for _, f := range m.Features {
+		peer.features[f] = true
+	}
+}
+
+// supports reports whether peer accepts messages of type typ. Peers that
+// never went through a handshake are assumed to accept everything.
+func (peer *Peer) supports(typ string) bool {
+	return peer.types == nil || peer.types[typ]
+}
+
+func contains(a []string, x string) bool {
+	for _, y := range a {
+		if x == y {
+			return true
+		}
+	}
+	return false
+}
+
+func intersect(a []string, b []string) []string {
+	var out []string
+	for _, x := range a {
+		for _, y := range b {
+			if x == y {
+				out = append(out, x)
+				break
+			}
+		}
+	}
+	return out
+}
+
+// handshakeConn runs the accepting side of the handshake for a new connection
+// and starts serving the peer if it succeeds.
+func (host *Host) handshakeConn(conn net.Conn) {
+	data := make(chan []byte)
+	peer := &Peer{socket: conn, frames: newFrameReader(conn), data: data, pending: true}
+	if err := host.acceptHandshake(peer); err != nil {
+		fmt.Printf("\nErr: %v\n", err)
+		fmt.Print("> ")
+		conn.Close()
+		return
+	}
+	host.register <- peer
+	go host.receive(peer)
+	go host.send(peer, data)
+}
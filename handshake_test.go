@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandshakeIdentifiesPeers(t *testing.T) {
+	chain := newMemChain()
+	alice := newTestHost(t, "alice", chain)
+	go alice.stateManager()
+	bob := newTestHost(t, "bob", chain)
+	go bob.stateManager()
+	_, pi := listen(t, bob)
+
+	if err := alice.createConnection("carol", pi); err == nil || !strings.Contains(err.Error(), "reached bob") {
+		t.Fatalf("dialing the wrong node: %v", err)
+	}
+	if err := alice.createConnection("bob", pi); err != nil {
+		t.Fatal(err)
+	}
+	// Bob knows who connected before any trustline message
+	waitFor(t, bob, func() bool {
+		peer, ok := bob.peerIDtoPeer["alice"]
+		return ok && peer.online() && peer.version == protocolVersion && peer.supports("Pay")
+	})
+
+	// Someone else's key doesn't get past bob
+	wrong := *pi
+	wrong.PublicKey = alice.publicKey()
+	if err := alice.createConnection("bob", &wrong); err == nil || !strings.Contains(err.Error(), "bad signature") {
+		t.Fatalf("bob answered with a key that isn't his: %v", err)
+	}
+}
+
+// node is a fake node with its own key, registered on chain, that talks to
+// hosts over plain connections.
+type node struct {
+	name string
+	key  ed25519.PrivateKey
+}
+
+func newNode(chain Chain, name string) *node {
+	n := &node{name: name, key: newKey()}
+	chain.Register(name, 0, "pw", PeerInfo{PublicKey: n.key.Public().(ed25519.PublicKey)})
+	return n
+}
+
+func (n *node) sign(msg *Message) []byte {
+	msg.Sig = ed25519.Sign(n.key, signedBytes(msg))
+	return serialize(msg)
+}
+
+// rawHello sends hello to host over a plain connection and returns the
+// connection with the answer.
+func rawHello(t *testing.T, pi *PeerInfo, hello []byte) (net.Conn, *Message) {
+	conn, err := net.Dial("tcp", net.JoinHostPort(pi.IP, strconv.Itoa(int(pi.Port))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.Write(hello)
+	ack, err := newFrameReader(conn).Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, ack
+}
+
+func TestHandshakeVersions(t *testing.T) {
+	chain := newMemChain()
+	bob := newTestHost(t, "bob", chain)
+	bob.insecure = true // The fake node speaks no TLS
+	go bob.stateManager()
+	_, pi := listen(t, bob)
+	n := newNode(chain, "new")
+
+	_, ack := rawHello(t, pi, n.sign(&Message{HostID: "new", Type: "Hello", Version: minProtocolVersion - 1}))
+	if ack.Type != "HelloReject" || ack.Reason == "" {
+		t.Fatalf("old version: %+v", ack)
+	}
+	_, ack = rawHello(t, pi, n.sign(&Message{HostID: "new", Type: "Hello", Version: protocolVersion + 1, Features: []string{"teleport"}}))
+	if ack.Type != "HelloAck" || ack.Version != protocolVersion || len(ack.Features) != 0 {
+		t.Fatalf("newer version not downgraded: %+v", ack)
+	}
+	if !verifySig(bob.publicKey(), ack) {
+		t.Fatal("HelloAck not signed by bob")
+	}
+	_, ack = rawHello(t, pi, n.sign(&Message{HostID: "new", Type: "Pay"}))
+	if ack.Type != "HelloReject" {
+		t.Fatalf("no Hello: %+v", ack)
+	}
+}
+
+func TestHandshakeRejectsLongIDs(t *testing.T) {
+	chain := newMemChain()
+	bob := newTestHost(t, "bob", chain)
+	bob.insecure = true
+	go bob.stateManager()
+	_, pi := listen(t, bob)
+
+	// Fits in a frame as sent, but not once escaped by json.Marshal
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.Encode(&Message{HostID: strings.Repeat("<", 12*1024), Type: "Hello", Version: protocolVersion})
+	mb := buf.Bytes()[:buf.Len()-1]
+	frame := binary.AppendUvarint(nil, uint64(len(mb)))
+	_, ack := rawHello(t, pi, append(frame, mb...))
+	if ack.Type != "HelloReject" || ack.PeerID != "" {
+		t.Fatalf("long ID answered with %+v", ack)
+	}
+	// Bob is still up
+	n := newNode(chain, "new")
+	if _, ack = rawHello(t, pi, n.sign(&Message{HostID: "new", Type: "Hello", Version: protocolVersion})); ack.Type != "HelloAck" {
+		t.Fatalf("%+v", ack)
+	}
+}
+
+func TestHandshakeLookups(t *testing.T) {
+	chain := newMemChain()
+	bob := newTestHost(t, "bob", chain)
+	bob.insecure = true
+	go bob.stateManager()
+	_, pi := listen(t, bob)
+
+	// A key is pinned for carol: a Hello signed by another is refused before
+	// anything is looked up
+	n := newNode(chain, "carol")
+	bob.book.pin("carol", newKey().Public().(ed25519.PublicKey))
+	if _, ack := rawHello(t, pi, n.sign(&Message{HostID: "carol", Type: "Hello", Version: protocolVersion})); ack.Type != "HelloReject" || ack.Reason != "bad signature" {
+		t.Fatalf("carol answered with %+v", ack)
+	}
+
+	// Not on the chain yet: refused, and not looked up again for a while
+	n = &node{name: "ghost", key: newKey()}
+	if _, ack := rawHello(t, pi, n.sign(&Message{HostID: "ghost", Type: "Hello", Version: protocolVersion})); ack.Type != "HelloReject" || ack.Reason != "unknown node" {
+		t.Fatalf("ghost answered with %+v", ack)
+	}
+	chain.Register("ghost", 0, "pw", PeerInfo{PublicKey: n.key.Public().(ed25519.PublicKey)})
+	if _, ack := rawHello(t, pi, n.sign(&Message{HostID: "ghost", Type: "Hello", Version: protocolVersion})); ack.Type != "HelloReject" {
+		t.Fatalf("ghost looked up again: %+v", ack)
+	}
+}
+
+func TestForgedFramesDropped(t *testing.T) {
+	chain := newMemChain()
+	bob := newTestHost(t, "bob", chain)
+	bob.insecure = true
+	go bob.stateManager()
+	_, pi := listen(t, bob)
+	mallory := newNode(chain, "mallory")
+	newNode(chain, "alice")
+
+	// Claiming to be alice without her key
+	_, ack := rawHello(t, pi, mallory.sign(&Message{HostID: "alice", Type: "Hello", Version: protocolVersion}))
+	if ack.Type != "HelloReject" || ack.Reason != "bad signature" {
+		t.Fatalf("impersonation answered with %+v", ack)
+	}
+
+	conn, ack := rawHello(t, pi, mallory.sign(&Message{HostID: "mallory", Type: "Hello", Version: protocolVersion}))
+	if ack.Type != "HelloAck" {
+		t.Fatalf("%+v", ack)
+	}
+	conn.Write(mallory.sign(&Message{HostID: "alice", PeerID: "bob", Type: "Propose"}))
+	conn.Write(serialize(&Message{HostID: "mallory", PeerID: "bob", Type: "Propose", Amount: 1}))
+	conn.Write(mallory.sign(&Message{HostID: "mallory", PeerID: "bob", Type: "Propose", Amount: 2}))
+	var prop *Proposal
+	waitFor(t, bob, func() bool {
+		if bob.urgentcmd.Head() == nil {
+			return false
+		}
+		prop = bob.urgentcmd.Dequeue().(*Proposal)
+		return true
+	})
+	if prop.msg.HostID != "mallory" || prop.msg.Amount != 2 {
+		t.Fatalf("forged proposal got through: %+v", prop.msg)
+	}
+}
+
+func TestFramesBeforeTrustline(t *testing.T) {
+	chain := newMemChain()
+	bob := newTestHost(t, "bob", chain)
+	bob.insecure = true
+	go bob.stateManager()
+	_, pi := listen(t, bob)
+	mallory := newNode(chain, "mallory")
+
+	conn, ack := rawHello(t, pi, mallory.sign(&Message{HostID: "mallory", Type: "Hello", Version: protocolVersion}))
+	if ack.Type != "HelloAck" {
+		t.Fatalf("%+v", ack)
+	}
+	// Nothing but a Propose applies before bob accepts one
+	for _, typ := range supportedTypes {
+		if typ == "Propose" || typ == "Resume" || typ == "Limit" {
+			continue
+		}
+		conn.Write(mallory.sign(&Message{HostID: "mallory", PeerID: "bob", Type: typ, Amount: 5, Limit: 5, ID: "x", Seq: 1, Expiry: time.Now().Add(time.Minute).UnixNano()}))
+	}
+	conn.Write(mallory.sign(&Message{HostID: "mallory", PeerID: "bob", Type: "Propose", Limit: 7}))
+	waitFor(t, bob, func() bool { return bob.urgentcmd.Head() != nil })
+	bob.run(func() {
+		if peer := bob.peerIDtoPeer["mallory"]; peer == nil || peer.trustline != nil || !peer.pending {
+			t.Errorf("mallory got a trustline: %+v", peer)
+		}
+	})
+}
@@ -14,10 +14,24 @@ import (
 func displayTrustlineBalances(host *Host) {
 	totalTrustlineBalance := 0
 	for id, peer := range host.peerIDtoPeer {
-		fmt.Printf("%s: %d\n", id, peer.trustline.HostBalance)
+		if peer.trustline == nil {
+			continue
+		}
+		status := ""
+		if p := peer.trustline.pendingOut(); p > 0 {
+			status = fmt.Sprintf(" (%d pending)", p)
+		}
+		if f := peer.trustline.inFlight(true) + peer.trustline.inFlight(false); f > 0 {
+			status += fmt.Sprintf(" (%d in flight)", f)
+		}
+		if !peer.online() {
+			status += " (offline)"
+		}
+		fmt.Printf("%s: %d (limits: %d to them, %d to us)%s\n", id, peer.trustline.HostBalance, peer.trustline.HostLimit, peer.trustline.PeerLimit, status)
 		totalTrustlineBalance += peer.trustline.HostBalance
 	}
 	fmt.Printf("Total: %d\n", totalTrustlineBalance)
+	displayDisputes(host)
 }
 
 // GetOutboundIP gets preferred outbound ip of this machine
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// A historyEntry is one event on a trustline. Direction is "in" when the peer
+// started it and "out" when we did. Balance is our HostBalance afterwards. ID
+// is the payment or settlement ID, if the event had one.
+type historyEntry struct {
+	Time      time.Time `json:"time"`
+	PeerID    string    `json:"peer"`
+	Type      string    `json:"type"`
+	Direction string    `json:"dir"`
+	Amount    uint32    `json:"amt"`
+	Balance   int       `json:"balance"`
+	ID        string    `json:"id,omitempty"`
+}
+
+// history is the ledger of every trustline event, kept in the data directory
+// as one JSON line per entry.
+type history struct {
+	f       *os.File
+	entries []historyEntry
+	ids     map[string]bool
+}
+
+func historyPath(dataDir string) string {
+	return filepath.Join(dataDir, "history.log")
+}
+
+func openHistory(path string) (*history, error) {
+	h := &history{ids: make(map[string]bool)}
+	if f, err := os.Open(path); err == nil {
+		sc := bufio.NewScanner(f)
+		for sc.Scan() {
+			var e historyEntry
+			if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+				// A torn last line from a crash mid-write
+				break
+			}
+			h.entries = append(h.entries, e)
+			h.ids[e.ID] = true
+		}
+		f.Close()
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	h.f = f
+	return h, nil
+}
+
+func (h *history) add(e historyEntry) error {
+	b, err := json.Marshal(&e)
+	if err != nil {
+		return err
+	}
+	if _, err := h.f.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	h.entries = append(h.entries, e)
+	h.ids[e.ID] = true
+	return nil
+}
+
+// seen reports whether an event with id was already recorded.
+func (h *history) seen(id string) bool {
+	return id != "" && h.ids[id]
+}
+
+// query returns the last limit entries with peerID since the given time,
+// oldest first. An empty peerID matches every trustline and a limit of 0 or
+// less returns all of them.
+func (h *history) query(peerID string, since time.Time, limit int) []historyEntry {
+	var out []historyEntry
+	for i := len(h.entries) - 1; i >= 0; i-- {
+		e := h.entries[i]
+		if e.Time.Before(since) {
+			break
+		}
+		if peerID != "" && e.PeerID != peerID {
+			continue
+		}
+		out = append(out, e)
+		if limit > 0 && len(out) == limit {
+			break
+		}
+	}
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+	return out
+}
+
+// logHistory records an event on peer's trustline after it was applied.
+func (host *Host) logHistory(peer *Peer, typ string, dir string, amount uint32, id string) {
+	if host.history == nil {
+		return
+	}
+	e := historyEntry{
+		Time:      time.Now(),
+		PeerID:    peer.PeerID,
+		Type:      typ,
+		Direction: dir,
+		Amount:    amount,
+		Balance:   peer.trustline.HostBalance,
+		ID:        id,
+	}
+	if err := host.history.add(e); err != nil {
+		fmt.Printf("\nErr: Could not record history: %v\n", err)
+		fmt.Print("> ")
+	}
+}
+
+// parseHistoryArgs reads the arguments of the history command:
+// [peerID] [--since TIME] [--limit N]. TIME is a duration back from now, such
+// as 2h, a date or an RFC 3339 timestamp.
+func parseHistoryArgs(args []string) (peerID string, since time.Time, limit int, err error) {
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "--since", "--limit":
+			if i+1 == len(args) {
+				return "", since, 0, fmt.Errorf("%s needs a value", args[i])
+			}
+			v := args[i+1]
+			if args[i] == "--limit" {
+				limit, err = strconv.Atoi(v)
+			} else {
+				since, err = parseSince(v)
+			}
+			if err != nil {
+				return "", since, 0, err
+			}
+			i++
+		default:
+			peerID = args[i]
+		}
+	}
+	return peerID, since, limit, nil
+}
+
+func parseSince(v string) (time.Time, error) {
+	if d, err := time.ParseDuration(v); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", v, time.Local); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return t, fmt.Errorf("invalid time %q, use a duration like 2h, a date or RFC 3339", v)
+	}
+	return t, nil
+}
+
+func displayHistory(entries []historyEntry) {
+	for _, e := range entries {
+		fmt.Printf("%s  %-10s %-13s %-3s %6d  balance %d\n",
+			e.Time.Format("2006-01-02 15:04:05"), e.PeerID, e.Type, e.Direction, e.Amount, e.Balance)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHistory(t *testing.T) {
+	chain := newMemChain()
+	chain.Register("alice", 50, "pw", PeerInfo{})
+	chain.Register("bob", 0, "pw", PeerInfo{})
+	path := filepath.Join(t.TempDir(), "history.log")
+	host := newTestHost(t, "alice", chain)
+	host.history, _ = openHistory(path)
+	go host.stateManager()
+	bob := testPeer(host, "bob")
+	carol := testPeer(host, "carol")
+
+	host.outbound <- &Message{HostID: "alice", PeerID: "bob", Type: "Pay", Amount: 20}
+	ackPay(t, host, bob)
+	host.inbound <- &Message{HostID: "bob", PeerID: "alice", Type: "Pay", Amount: 5, ID: "p1", Seq: 1}
+	next(bob)
+	host.outbound <- &Message{HostID: "alice", PeerID: "carol", Type: "Pay", Amount: 1}
+	ackPay(t, host, carol)
+	host.outbound <- &Message{HostID: "alice", PeerID: "bob", Type: "Settle", Amount: 15}
+	next(bob)
+
+	// Reopened from disk, bob's trustline explains how it got to 0
+	var h *history
+	host.run(func() { h, _ = openHistory(path) })
+	got := h.query("bob", time.Time{}, 0)
+	want := []historyEntry{
+		{Type: "Pay", Direction: "out", Amount: 20, Balance: -20},
+		{Type: "Pay", Direction: "in", Amount: 5, Balance: -15},
+		{Type: "Settle", Direction: "out", Amount: 15, Balance: 0},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d entries: %+v", len(got), got)
+	}
+	for i, e := range got {
+		w := want[i]
+		if e.Type != w.Type || e.Direction != w.Direction || e.Amount != w.Amount || e.Balance != w.Balance {
+			t.Errorf("entry %d = %+v, want %+v", i, e, w)
+		}
+	}
+	if got := h.query("", time.Time{}, 2); len(got) != 2 || got[1].Type != "Settle" || got[0].PeerID != "carol" {
+		t.Errorf("last 2 entries: %+v", got)
+	}
+	if got := h.query("", time.Now().Add(time.Hour), 0); len(got) != 0 {
+		t.Errorf("entries from the future: %+v", got)
+	}
+}
+
+func TestParseHistoryArgs(t *testing.T) {
+	peer, since, limit, err := parseHistoryArgs([]string{"bob", "--since", "2h", "--limit", "5"})
+	if err != nil || peer != "bob" || limit != 5 || time.Since(since) < 2*time.Hour-time.Minute {
+		t.Fatalf("got %q %v %d %v", peer, since, limit, err)
+	}
+	if _, since, _, err = parseHistoryArgs([]string{"--since", "2026-01-02"}); err != nil || since.Day() != 2 {
+		t.Fatalf("date: %v %v", since, err)
+	}
+	if _, _, _, err = parseHistoryArgs([]string{"--limit"}); err == nil {
+		t.Fatal("missing value accepted")
+	}
+}
@@ -2,10 +2,13 @@ package main
 
 import (
 	"bufio"
-	"bytes"
-	"encoding/json"
+	"crypto/ed25519"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
 	"net"
+	"time"
 
 	"github.com/oleiade/lane"
 )
@@ -16,16 +19,58 @@ type Trustline struct {
 	// passing scheme.
 	HostBalance int
 	PeerBalance int
+
+	// Totals settled on the chain in each direction. The settlement journal
+	// compares against them to tell whether a settlement reached the
+	// trustline before a crash.
+	SettledOut uint64
+	SettledIn  uint64
+
+	// Sequence numbers of the last Pay or Settle sent to and received from
+	// the peer, see seq.go
+	SendSeq uint64
+	RecvSeq uint64
+
+	// The credit each side extends to the other: the most the peer may owe
+	// us, and the most we may owe it, see limit.go
+	HostLimit uint32
+	PeerLimit uint32
+
+	// Payments sent but not acknowledged yet, the last ones we gave up on
+	// waiting for, and how we answered the last ones the peer sent, see
+	// pay.go
+	Pending []*PendingPay `json:",omitempty"`
+	GivenUp []*PendingPay `json:",omitempty"`
+	Answers []*PayAnswer  `json:",omitempty"`
+
+	// Conditional payments in flight either way, see htlc.go
+	HTLCs []*HTLC `json:",omitempty"`
+
+	// The latest state both sides signed, see state.go
+	State *StateRecord `json:",omitempty"`
+
+	// The record format, trustlineVersion when saved. Records from before
+	// it have none, see limit.go
+	Version int `json:",omitempty"`
 }
 
-// Peer will hold information about the socket connection and data to be sent
+// Peer will hold information about the socket connection and data to be sent.
+// A Peer with a trustline but no connection is offline; its data is nil.
 type Peer struct {
 	PeerID    string
 	trustline *Trustline
-	socket    *net.TCPConn
+	socket    net.Conn
 	data      chan []byte
 	PeerInfo  *PeerInfo
+	key       ed25519.PublicKey
 	pending   bool
+	resuming  bool
+	frames    *frameReader
+
+	// Agreed in the handshake
+	version  int
+	types    map[string]bool
+	features map[string]bool
 }
 
 // Host will hold all of the available peer received data and
@@ -41,15 +86,82 @@ type Host struct {
 	register     chan *Peer
 	unregister   chan *Peer
 	urgentcmd    *lane.Queue
-	Balance      uint32
+	chain        Chain
 	password     string
 	IP           string
 	reader       *bufio.Reader
+	do           chan func()
+	key          ed25519.PrivateKey
+	cert         tls.Certificate
+	insecure     bool
+	addr         string
+
+	// chainBalance is our last confirmed balance on the chain. Inbound
+	// settlements are verified against it, see settle.go.
+	chainBalance uint32
+	balanceGen   uint64
+	balances     chan *balanceReport
+	polling      bool
+	checking     bool
+	unverified   []*inboundSettle
+	disputes     []*inboundSettle
+	deposits     []*deposit
+	journal      *journal
+	store        *store
+	history      *history
+
+	// Our settlements go to the chain one at a time: the queue, the peer of
+	// the one at the chain and its journal entry once it's being paid
+	settleQueue  []*Message
+	settlingWith string
+	paying       *journalEntry
+
+	// Payments over the credit limit waiting for a settlement, and limit
+	// changes the peer hasn't answered yet, by peer
+	held      map[string][]*Message
+	limitReqs map[string]uint32
+
+	// The trustline graph, by the node paying and the one paid, the edges
+	// to pass on at the next tick, how many each neighbour sent this tick,
+	// the keys of nodes that announced edges, and the ones we're looking up,
+	// see gossip.go
+	graph      map[string]map[string]*Edge
+	relay      []*Edge
+	gossipRecv map[string]int
+	keys       map[string]ed25519.PublicKey
+	keyLookups map[string]*keyLookup
+
+	// Where other nodes can be reached, and the socket we find them over,
+	// see discovery.go
+	book      *addrBook
+	discovery net.PacketConn
+	dht       *dhtTable
+
+	// Nodes we have no key for that said Hello, whose key we're looking up
+	// or failed to, see handshake.go
+	helloLookups map[string]*keyLookup
+
+	// The largest single payment we accept, if not 0, see reject.go
+	maxPayment uint32
+
+	// How much earlier each hop's HTLC expires, and how long we wait past
+	// expiry for the next hop's answer, see htlc.go
+	htlcDelta time.Duration
+	htlcGrace time.Duration
+
+	// Whether we refuse to take part in clearing, how often we look for
+	// cycles to clear ourselves, and the cycles tried since we last ran out,
+	// see clear.go
+	noClear    bool
+	clearEvery time.Duration
+	lastClear  time.Time
+	clearTried map[string]bool
 }
 
 // A Proposal is used to read the first message from the socket connection
 // and set values in the peerIDtoPeer map within the stateManager, and also set
-// the PeerID for a Peer.
+// the PeerID for a Peer. Propose and Resume messages arrive as a Proposal, and
+// so do Limit changes, which go through the same prompt.
 type Proposal struct {
 	peer *Peer
 	msg  *Message
@@ -58,53 +170,126 @@ type Proposal struct {
 // The stateManager manages states from inbound and outbound and sends messages
 // outbound.
 func (host *Host) stateManager() {
+	ticker := time.NewTicker(settleCheckInterval)
+	defer ticker.Stop()
 	for {
 		select {
+		case <-ticker.C:
+			host.pollBalance()
+			host.checkIntents()
+			host.retryPending()
+			host.expireHTLCs()
+			host.clearOnSchedule()
+			host.flushGossip()
+		case r := <-host.balances:
+			host.verifySettlements(r)
+		case f := <-host.do:
+			f()
 		case peer := <-host.register:
 			host.peers[peer] = true
-			// for the createConnection case
-			if peer.PeerID != "" {
-				host.peerIDtoPeer[peer.PeerID] = peer
+			if known, ok := host.peerIDtoPeer[peer.PeerID]; ok {
+				if known.online() {
+					// A stale connection, the new one replaces it
+					host.hangUp(known)
+				}
+				if known.trustline != nil && (!known.pending || known.resuming) {
+					// Reconnecting, the trustline resumes once a Resume
+					// is accepted
+					peer.trustline = known.trustline
+					peer.resuming = true
+				}
 			}
+			host.peerIDtoPeer[peer.PeerID] = peer
 		case peer := <-host.unregister:
 			if _, ok := host.peers[peer]; ok {
-				close(peer.data)
-				delete(host.peers, peer)
-				if _, ok := host.peerIDtoPeer[peer.PeerID]; ok {
-					delete(host.peerIDtoPeer, peer.PeerID)
-				}
+				host.hangUp(peer)
+				host.disconnected(peer)
 			}
 			peer.socket.Close() // Maybe you don't want to close socket on unregister.
 		case prop := <-host.proposal:
+			if prop.msg.Type == "Resume" {
+				host.resumeTrustline(prop)
+				break
+			}
+			if prop.msg.Type == "Limit" {
+				host.limitRequested(prop)
+				break
+			}
+			if prop.peer.resuming {
+				host.refuseProposal(prop)
+				break
+			}
 			// TODO: This could probably be done more seamlessly.
 			fmt.Println("\nProposal Received!")
-			fmt.Printf("\n%s is trying to open a trustline. Accept? [y/n]: ", prop.msg.HostID)
+			fmt.Printf("\n%s is trying to open a trustline with a limit of %d. Accept? [y [limit]/n]: ", prop.msg.HostID, prop.msg.Limit)
 			host.urgentcmd.Enqueue(prop)
 		case msg := <-host.inbound:
+			if peer, ok := host.peerIDtoPeer[msg.HostID]; ok && !peer.expects(msg.Type) {
+				fmt.Printf("\nErr: Dropped %s message from %s, which has no trustline with us\n", msg.Type, msg.HostID)
+				fmt.Print("> ")
+				break
+			}
 			// Update local state
 			// msg.HostID here will be our PeerID.
 			switch msg.Type {
 			case "Pay":
 				if peer, ok := host.peerIDtoPeer[msg.HostID]; ok {
-					fmt.Printf("\n%s has paid you %d!\n", msg.HostID, msg.Amount)
-					fmt.Print("> ")
-					peer.trustline.HostBalance += int(msg.Amount)
-					peer.trustline.PeerBalance -= int(msg.Amount)
+					host.receivePay(peer, msg)
+				}
+			case "Prepare":
+				if peer, ok := host.peerIDtoPeer[msg.HostID]; ok {
+					host.receivePrepare(peer, msg)
+				}
+			case "Fulfill":
+				if peer, ok := host.peerIDtoPeer[msg.HostID]; ok {
+					host.fulfilled(peer, msg)
+				}
+			case "Cancel":
+				if peer, ok := host.peerIDtoPeer[msg.HostID]; ok {
+					host.canceled(peer, msg)
+				}
+			case "Gossip":
+				if peer, ok := host.peerIDtoPeer[msg.HostID]; ok {
+					host.gossipReceived(peer, msg)
+				}
+			case "PayAck":
+				if peer, ok := host.peerIDtoPeer[msg.HostID]; ok {
+					host.payAcked(peer, msg)
+				}
+			case "Reject":
+				if peer, ok := host.peerIDtoPeer[msg.HostID]; ok {
+					host.rejected(peer, msg)
+				}
+			case "State":
+				if peer, ok := host.peerIDtoPeer[msg.HostID]; ok {
+					host.cosignState(peer, msg)
+				}
+			case "StateAck":
+				if peer, ok := host.peerIDtoPeer[msg.HostID]; ok {
+					host.stateAcked(peer, msg)
 				}
 			case "Settle":
-				// In the real case, we should verify, but this is not real
+				// Only credited once the funds show up on the chain
 				if peer, ok := host.peerIDtoPeer[msg.HostID]; ok {
-					fmt.Printf("\n%s has settled a payment of %d!\n", msg.HostID, msg.Amount)
-					fmt.Print("> ")
-					peer.trustline.HostBalance -= int(msg.Amount)
-					peer.trustline.PeerBalance += int(msg.Amount)
+					host.expectSettlement(peer, msg)
+				}
+			case "SettleAck":
+				host.settleAcked(msg)
+			case "LimitAccept", "LimitReject":
+				if peer, ok := host.peerIDtoPeer[msg.HostID]; ok {
+					host.limitAnswered(peer, msg)
 				}
 			case "ProposeAccept":
 				// fmt.Println("Received ProposeAccept")
 				if peer, ok := host.peerIDtoPeer[msg.HostID]; ok {
 					peer.pending = false
+					peer.trustline.PeerLimit = msg.Limit
+					host.saveTrustline(peer)
+					host.logHistory(peer, "ProposeAccept", "in", 0, "")
 					fmt.Printf("\n%s has accepted your trustline request!\n", msg.HostID)
 					fmt.Print("> ")
+					host.resendUnacked(peer)
+					host.newNeighbour(peer)
 				} else {
 					fmt.Printf("\nErr: PeerID %s not found\n", msg.HostID)
 					fmt.Print("> ")
@@ -112,8 +297,7 @@ func (host *Host) stateManager() {
 			case "ProposeReject":
 				if peer, ok := host.peerIDtoPeer[msg.HostID]; ok {
 					if _, ok := host.peers[peer]; ok {
-						close(peer.data)
-						delete(host.peers, peer)
+						host.hangUp(peer)
 						delete(host.peerIDtoPeer, msg.HostID)
 						// println("Deleted from host.peerIDtoPeer")
 					}
@@ -123,46 +307,74 @@ func (host *Host) stateManager() {
 					fmt.Printf("\nErr: PeerID %s not found\n", msg.HostID)
 					fmt.Print("> ")
 				}
+			case "ResumeAccept":
+				if peer, ok := host.peerIDtoPeer[msg.HostID]; ok && peer.online() {
+					peer.pending = false
+					peer.resuming = false
+					fmt.Printf("\n%s is back online!\n", msg.HostID)
+					fmt.Print("> ")
+					host.resendUnacked(peer)
+					host.newNeighbour(peer)
+				}
+			case "ResumeReject":
+				if peer, ok := host.peerIDtoPeer[msg.HostID]; ok && peer.online() {
+					fmt.Printf("\nErr: %s has no record of our trustline\n", msg.HostID)
+					fmt.Print("> ")
+					host.hangUp(peer)
+					host.disconnected(peer)
+				}
 			}
 		case msg := <-host.outbound:
 			// Update local state
 			switch msg.Type {
 			case "Pay":
-				if peer, ok := host.peerIDtoPeer[msg.PeerID]; ok {
-					peer.trustline.HostBalance -= int(msg.Amount)
-					peer.trustline.PeerBalance += int(msg.Amount)
-					peer.data <- serialize(msg)
+				if peer, ok := host.peerIDtoPeer[msg.PeerID]; ok && peer.online() {
+					host.pay(peer, msg)
+				} else if ok {
+					fmt.Printf("\nErr: %s is offline\n", msg.PeerID)
+					fmt.Print("> ")
 				}
+			case "Prepare":
+				host.route(msg)
 			case "Settle":
-				if host.Balance > msg.Amount {
-					if peer, ok := host.peerIDtoPeer[msg.PeerID]; ok {
-						payUser(msg.HostID, msg.PeerID, host.password, msg.Amount)
-						peer.trustline.HostBalance += int(msg.Amount)
-						peer.trustline.PeerBalance -= int(msg.Amount)
-						host.Balance -= msg.Amount
-						peer.data <- serialize(msg)
-					}
-				} else {
-					fmt.Printf("\nErr: Insufficient funds to settle with %s at amount: %d\n", msg.PeerID, msg.Amount)
-					fmt.Print("> ")
+				if peer, ok := host.peerIDtoPeer[msg.PeerID]; ok {
+					host.settle(peer, msg)
+				}
+			case "Limit":
+				if peer, ok := host.peerIDtoPeer[msg.PeerID]; ok {
+					host.requestLimit(peer, msg)
+				}
+			case "LimitAccept":
+				if peer, ok := host.peerIDtoPeer[msg.PeerID]; ok {
+					host.acceptLimit(peer, msg)
 				}
-			case "Propose":
+			case "LimitReject":
+				if peer, ok := host.peerIDtoPeer[msg.PeerID]; ok {
+					host.sendTo(peer, msg)
+				}
+			case "Propose", "Resume":
 				// fmt.Println("Sending Propose")
 				if peer, ok := host.peerIDtoPeer[msg.PeerID]; ok {
-					peer.data <- serialize(msg)
+					if msg.Type == "Propose" {
+						peer.trustline.HostLimit = msg.Limit
+					}
+					host.sendTo(peer, msg)
 				}
 			case "ProposeAccept":
 				// fmt.Println("Sending ProposeAccept")
 				if peer, ok := host.peerIDtoPeer[msg.PeerID]; ok {
-					peer.data <- serialize(msg)
+					host.saveTrustline(peer)
+					host.logHistory(peer, "ProposeAccept", "out", 0, "")
+					host.sendTo(peer, msg)
+					host.resendUnacked(peer)
+					host.newNeighbour(peer)
 				}
 			case "ProposeReject":
 				// fmt.Println("Sending ProposeReject")
 				if peer, ok := host.peerIDtoPeer[msg.PeerID]; ok {
-					peer.data <- serialize(msg)
+					host.sendTo(peer, msg)
 					if _, ok := host.peers[peer]; ok {
-						close(peer.data)
-						delete(host.peers, peer)
+						host.hangUp(peer)
 						delete(host.peerIDtoPeer, msg.PeerID)
 					}
 				}
@@ -171,11 +383,85 @@ func (host *Host) stateManager() {
 	}
 }
 
-func (host *Host) send(peer *Peer) {
+func (peer *Peer) online() bool {
+	return peer.data != nil
+}
+
+// trustlineTypes are the messages that only apply to an open trustline, or
+// one being resumed.
+var trustlineTypes = []string{
+	"Pay", "PayAck", "Reject",
+	"Settle",
+	"State", "StateAck",
+	"LimitAccept", "LimitReject",
+	"Prepare", "Fulfill", "Cancel",
+}
+
+// expects reports whether a message of type typ fits where our trustline
+// with peer stands. A connection that hasn't opened or resumed a trustline
+// only gets answers to the Propose or Resume we sent it.
+func (peer *Peer) expects(typ string) bool {
+	switch {
+	case contains(trustlineTypes, typ):
+		return peer.trustline != nil && (!peer.pending || peer.resuming)
+	case typ == "ProposeAccept" || typ == "ProposeReject":
+		return peer.trustline != nil && peer.pending && !peer.resuming
+	case typ == "ResumeAccept" || typ == "ResumeReject":
+		return peer.resuming
+	}
+	return true
+}
+
+// sendTo queues msg for peer. Returns false if peer is offline or doesn't
+// support the message type.
+func (host *Host) sendTo(peer *Peer, msg *Message) bool {
+	if !peer.online() {
+		return false
+	}
+	if !peer.supports(msg.Type) {
+		fmt.Printf("\nErr: %s does not support %s messages\n", peer.PeerID, msg.Type)
+		fmt.Print("> ")
+		return false
+	}
+	host.sign(msg)
+	mb, err := encodeFrame(msg)
+	if err != nil {
+		fmt.Printf("\nErr: Could not send %s to %s: %v\n", msg.Type, peer.PeerID, err)
+		fmt.Print("> ")
+		return false
+	}
+	peer.data <- mb
+	return true
+}
+
+// hangUp closes the connection with peer: its send goroutine stops and the
+// peer is offline from then on. Hanging up twice does nothing.
+func (host *Host) hangUp(peer *Peer) {
+	if peer.data != nil {
+		close(peer.data)
+		peer.data = nil
+	}
+	delete(host.peers, peer)
+}
+
+// run calls f on the stateManager goroutine and waits for it to return, so f
+// can safely read and change Host state.
+func (host *Host) run(f func()) {
+	done := make(chan struct{})
+	host.do <- func() {
+		f()
+		close(done)
+	}
+	<-done
+}
+
+// send writes the frames queued on data, peer's channel, until the
+// stateManager hangs up on it.
+func (host *Host) send(peer *Peer, data chan []byte) {
 	defer peer.socket.Close()
 	for {
 		select {
-		case mb, ok := <-peer.data:
+		case mb, ok := <-data:
 			if !ok {
 				host.unregister <- peer
 				return
@@ -189,73 +475,64 @@ func (host *Host) send(peer *Peer) {
 // is ran as a goroutine. Shutsdown if invalid peer.
 func (host *Host) receive(peer *Peer) {
 	for {
-		b := make([]byte, bufSize)
-		n, err := peer.socket.Read(b)
+		msg, err := peer.frames.Next()
 		if err != nil {
+			if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+				fmt.Println(err)
+			}
 			host.unregister <- peer
-			// peer.socket.Close()
-			break
+			return
 		}
-		if n > 0 {
-			// fmt.Println("RECEIVED: " + string(b))
-			var buf bytes.Buffer
-			buf.Write(b[:n])
-			for buf.Len() > 0 {
-				var msg Message
-				d, err := buf.ReadBytes('}')
-				// fmt.Println(string(d))
-				// pp.Println(d)
-				err = json.Unmarshal(d, &msg)
-				if err != nil {
-					fmt.Println(err)
-					host.unregister <- peer
-					break
-				}
-				if msg.Type == "Propose" {
-					prop := Proposal{peer, &msg}
-					host.proposal <- &prop
-				} else {
-					host.inbound <- &msg
-				}
-				// fmt.Println(buf.Len())
-			}
+		if msg.HostID != peer.PeerID {
+			fmt.Printf("\nErr: Dropped %s message claiming to be from %q on connection with %s\n", msg.Type, msg.HostID, peer.PeerID)
+			fmt.Print("> ")
+			continue
+		}
+		if !verifySig(peer.key, msg) {
+			fmt.Printf("\nErr: Dropped %s message from %s with a bad signature\n", msg.Type, msg.HostID)
+			fmt.Print("> ")
+			continue
+		}
+		if msg.Type == "Propose" || msg.Type == "Resume" || msg.Type == "Limit" {
+			prop := Proposal{peer, msg}
+			host.proposal <- &prop
+		} else {
+			host.inbound <- msg
 		}
-
 	}
 }
 
 // connectionListener will wait for connections and create a receive and send
-// goroutine for each peer.
-func (host *Host) connectionListener(ln *net.TCPListener) {
+// goroutine for each peer once it has introduced itself.
+func (host *Host) connectionListener(ln net.Listener) {
 	for {
-		conn, err := ln.AcceptTCP()
-		if err != nil {
+		conn, err := ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		} else if err != nil {
 			fmt.Println(err)
+			continue
 		}
-		// Empty PeerID until identified
-		peer := &Peer{PeerID: "", socket: conn, trustline: nil, data: make(chan []byte), pending: true}
-		host.register <- peer
-		go host.receive(peer)
-		go host.send(peer)
+		go host.handshakeConn(conn)
 	}
 }
 
 // createConnection is for the host to create connections and creates a receive
 // and send goroutine for the specified peer.
 func (host *Host) createConnection(peerID string, pi *PeerInfo) error {
-	cstr := fmt.Sprintf("%s:%d", pi.IP, pi.Port)
-	addr, err := net.ResolveTCPAddr("tcp", cstr)
+	conn, err := dialPeer(pi)
 	if err != nil {
 		return err
 	}
-	conn, err := net.DialTCP("tcp", nil, addr)
-	if err != nil {
+	// Create peer, place in mapping
+	data := make(chan []byte)
+	peer := &Peer{PeerID: peerID, socket: conn, frames: newFrameReader(conn), key: pi.PublicKey, PeerInfo: pi, trustline: &Trustline{}, data: data, pending: true}
+	if err := host.dialHandshake(peer); err != nil {
+		conn.Close()
 		return err
 	}
-	// Create peer, place in mapping
-	peer := &Peer{PeerID: peerID, socket: conn, trustline: &Trustline{0, 0}, data: make(chan []byte), pending: true}
 	host.register <- peer
 	go host.receive(peer)
-	go host.send(peer)
+	go host.send(peer, data)
 	return nil
 }
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// newTestHost returns a Host settling over chain with its state in a
+// temporary directory. The stateManager is not started.
+func newTestHost(t *testing.T, name string, chain Chain) *Host {
+	host := newHost(name, 0, chain)
+	host.password = "pw"
+	// Publishes the key, and registers name with nothing if it is new
+	chain.Register(name, 0, "pw", host.peerInfo())
+	var err error
+	host.journal, err = openJournal(journalPath(t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	host.chainBalance, _ = chain.Balance(name)
+	return host
+}
+
+// testPeer registers a connected peer with an open trustline on host and
+// returns it. Frames the host sends to it can be read from peer.data.
+func testPeer(host *Host, id string) *Peer {
+	peer := &Peer{PeerID: id, trustline: &Trustline{HostLimit: defaultTrustlineLimit, PeerLimit: defaultTrustlineLimit}, data: make(chan []byte, 16)}
+	host.register <- peer
+	return peer
+}
+
+func TestSettleOverChain(t *testing.T) {
+	chain := newMemChain()
+	chain.Register("alice", 50, "pw", PeerInfo{})
+	chain.Register("bob", 0, "pw", PeerInfo{})
+	host := newTestHost(t, "alice", chain)
+	go host.stateManager()
+	bob := testPeer(host, "bob")
+
+	host.outbound <- &Message{HostID: "alice", PeerID: "bob", Type: "Pay", Amount: 40}
+	ackPay(t, host, bob)
+	host.outbound <- &Message{HostID: "alice", PeerID: "bob", Type: "Settle", Amount: 30}
+	if msg := next(bob); msg.Type != "Settle" || msg.Amount != 30 {
+		t.Fatalf("peer got %+v", msg)
+	}
+	// Too much to settle: the chain refuses and the trustline is untouched
+	host.outbound <- &Message{HostID: "alice", PeerID: "bob", Type: "Settle", Amount: 30}
+	host.outbound <- &Message{HostID: "alice", PeerID: "bob", Type: "Pay", Amount: 1}
+	if msg := next(bob); msg.Type != "Pay" {
+		t.Fatalf("failed settlement reached the peer: %+v", msg)
+	}
+
+	host.run(func() {
+		if bob.trustline.HostBalance != -10 {
+			t.Errorf("HostBalance = %d, want -10", bob.trustline.HostBalance)
+		}
+	})
+	if bal, _ := chain.Balance("bob"); bal != 30 {
+		t.Fatalf("bob chain balance = %d, want 30", bal)
+	}
+}
+
+// lossyChain loses the answer to every payment, whether it went through or
+// not.
+type lossyChain struct {
+	*memChain
+}
+
+func (c lossyChain) Pay(sender string, receiver string, password string, amount uint32, ref string) error {
+	if err := c.memChain.Pay(sender, receiver, password, amount, ref); err != nil && !errors.Is(err, errInsufficientFunds) {
+		return err
+	}
+	return errTimeout
+}
+
+func TestSettleUnknownOutcome(t *testing.T) {
+	defer func(i time.Duration) { settleCheckInterval = i }(settleCheckInterval)
+	settleCheckInterval = 5 * time.Millisecond
+
+	chain := newMemChain()
+	chain.Register("alice", 50, "pw", PeerInfo{})
+	chain.Register("bob", 0, "pw", PeerInfo{})
+	host := newTestHost(t, "alice", lossyChain{chain})
+	go host.stateManager()
+	bob := testPeer(host, "bob")
+	host.run(func() { bob.trustline.HostBalance, bob.trustline.PeerBalance = -40, 40 })
+
+	// The money moved but the answer got lost: once the chain has the
+	// transfer, the trustline catches up and bob hears about it
+	host.outbound <- &Message{HostID: "alice", PeerID: "bob", Type: "Settle", Amount: 30}
+	if msg := next(bob); msg.Type != "Settle" || msg.Amount != 30 {
+		t.Fatalf("peer got %+v", msg)
+	}
+	host.run(func() {
+		if bob.trustline.HostBalance != -10 {
+			t.Errorf("HostBalance = %d, want -10", bob.trustline.HostBalance)
+		}
+	})
+
+	// Nothing moved: aborted once the chain says so
+	host.outbound <- &Message{HostID: "alice", PeerID: "bob", Type: "Settle", Amount: 30}
+	waitFor(t, host, func() bool {
+		for _, e := range host.journal.entries {
+			if e.State == settleAborted {
+				return !host.unsure()
+			}
+		}
+		return false
+	})
+	host.run(func() {
+		if bob.trustline.HostBalance != -10 {
+			t.Errorf("HostBalance = %d, want -10", bob.trustline.HostBalance)
+		}
+	})
+
+	// Checked once the trustline is gone: settled all the same, and later
+	// settlements aren't held up
+	e := &journalEntry{ID: "gone", PeerID: "carol", Amount: 5}
+	host.run(func() {
+		if err := host.journal.record(e, settleIntent); err != nil {
+			t.Fatal(err)
+		}
+		host.intentChecked(e, true)
+		if e.State != settleSubmitted || host.unsure() {
+			t.Errorf("settlement left %s", e.State)
+		}
+	})
+}
+
+func TestSettleOffStateManager(t *testing.T) {
+	chain := newMemChain()
+	chain.Register("alice", 50, "pw", PeerInfo{})
+	chain.Register("bob", 0, "pw", PeerInfo{})
+	stalled := stalledChain{chain, make(chan struct{})}
+	host := newTestHost(t, "alice", stalled)
+	go host.stateManager()
+	bob := testPeer(host, "bob")
+	host.run(func() { bob.trustline.HostBalance, bob.trustline.PeerBalance = -40, 40 })
+
+	// The chain is slow to take the payment, everything else carries on
+	host.outbound <- &Message{HostID: "alice", PeerID: "bob", Type: "Settle", Amount: 30}
+	done := make(chan struct{})
+	go func() {
+		host.run(func() {})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("stateManager waited for the chain")
+	}
+	close(stalled.release)
+	if msg := next(bob); msg.Type != "Settle" || msg.Amount != 30 {
+		t.Fatalf("peer got %+v", msg)
+	}
+}
+
+func TestVerifyInboundSettlement(t *testing.T) {
+	defer func(i, d time.Duration) { settleCheckInterval, settleTimeout = i, d }(settleCheckInterval, settleTimeout)
+	settleCheckInterval, settleTimeout = 5*time.Millisecond, 50*time.Millisecond
+
+	chain := newMemChain()
+	chain.Register("alice", 50, "pw", PeerInfo{})
+	chain.Register("bob", 0, "pw", PeerInfo{})
+	host := newTestHost(t, "bob", chain)
+	go host.stateManager()
+	alice := testPeer(host, "alice")
+	host.run(func() { alice.trustline.HostBalance, alice.trustline.PeerBalance = 40, -40 })
+
+	// Alice pays on chain and tells us: credited once it shows up
+	chain.Pay("alice", "bob", "pw", 30, "")
+	host.inbound <- &Message{HostID: "alice", PeerID: "bob", Type: "Settle", Amount: 30, ID: "s1", Seq: 1}
+	waitFor(t, host, func() bool { return alice.trustline.HostBalance == 10 })
+	if msg := next(alice); msg.Type != "SettleAck" || msg.ID != "s1" {
+		t.Fatalf("peer got %+v", msg)
+	}
+
+	// A replayed settlement is acknowledged again but not credited twice
+	host.inbound <- &Message{HostID: "alice", PeerID: "bob", Type: "Settle", Amount: 30, ID: "s1", Seq: 1}
+	if msg := next(alice); msg.Type != "SettleAck" || msg.ID != "s1" {
+		t.Fatalf("peer got %+v", msg)
+	}
+
+	// Alice claims a settlement she never made: disputed, not credited
+	host.inbound <- &Message{HostID: "alice", PeerID: "bob", Type: "Settle", Amount: 10, ID: "s2", Seq: 2}
+	waitFor(t, host, func() bool { return len(host.disputes) == 1 })
+	host.run(func() {
+		if alice.trustline.HostBalance != 10 || host.chainBalance != 30 {
+			t.Errorf("HostBalance = %d, chainBalance = %d", alice.trustline.HostBalance, host.chainBalance)
+		}
+	})
+
+	// Carol pays us 10 outright while alice settles 20 for real. Once
+	// nobody claims carol's 10 in time, alice can't claim it either
+	chain.Register("carol", 10, "pw", PeerInfo{})
+	chain.Pay("carol", "bob", "pw", 10, "")
+	chain.Pay("alice", "bob", "pw", 20, "")
+	host.inbound <- &Message{HostID: "alice", PeerID: "bob", Type: "Settle", Amount: 20, ID: "s3", Seq: 3}
+	waitFor(t, host, func() bool { return alice.trustline.HostBalance == -10 })
+	time.Sleep(2 * settleTimeout)
+	host.inbound <- &Message{HostID: "alice", PeerID: "bob", Type: "Settle", Amount: 10, ID: "s4", Seq: 4}
+	waitFor(t, host, func() bool { return len(host.disputes) == 2 })
+	host.run(func() {
+		if alice.trustline.HostBalance != -10 || host.chainBalance != 60 {
+			t.Errorf("HostBalance = %d, chainBalance = %d", alice.trustline.HostBalance, host.chainBalance)
+		}
+	})
+}
+
+func TestSettlementIDsPerPeer(t *testing.T) {
+	defer func(i time.Duration) { settleCheckInterval = i }(settleCheckInterval)
+	settleCheckInterval = 5 * time.Millisecond
+
+	chain := newMemChain()
+	chain.Register("alice", 50, "pw", PeerInfo{})
+	chain.Register("carol", 50, "pw", PeerInfo{})
+	host := newTestHost(t, "bob", chain)
+	go host.stateManager()
+	alice := testPeer(host, "alice")
+	carol := testPeer(host, "carol")
+	host.run(func() {
+		alice.trustline.HostBalance, alice.trustline.PeerBalance = 40, -40
+		carol.trustline.HostBalance, carol.trustline.PeerBalance = 40, -40
+	})
+
+	// Alice and carol each pick the same ID for their settlement
+	chain.Pay("alice", "bob", "pw", 30, "")
+	host.inbound <- &Message{HostID: "alice", PeerID: "bob", Type: "Settle", Amount: 30, ID: "s1", Seq: 1}
+	if msg := next(alice); msg.Type != "SettleAck" || msg.ID != "s1" {
+		t.Fatalf("alice got %+v", msg)
+	}
+	chain.Pay("carol", "bob", "pw", 20, "")
+	host.inbound <- &Message{HostID: "carol", PeerID: "bob", Type: "Settle", Amount: 20, ID: "s1", Seq: 1}
+	if msg := next(carol); msg.Type != "SettleAck" || msg.ID != "s1" {
+		t.Fatalf("carol got %+v", msg)
+	}
+	host.run(func() {
+		if alice.trustline.HostBalance != 10 || carol.trustline.HostBalance != 20 {
+			t.Errorf("HostBalance = %d and %d", alice.trustline.HostBalance, carol.trustline.HostBalance)
+		}
+	})
+}
+
+// next returns the next frame sent to peer, skipping state records and
+// gossip, see state.go and gossip.go.
+func next(peer *Peer) Message {
+	for {
+		msg := parseRawBytes(<-peer.data)
+		if msg.Type != "State" && msg.Type != "StateAck" && msg.Type != "Gossip" {
+			return msg
+		}
+	}
+}
+
+// ackPay acknowledges the next payment host sent to peer and waits for host
+// to commit it.
+func ackPay(t *testing.T, host *Host, peer *Peer) {
+	t.Helper()
+	msg := next(peer)
+	if msg.Type != "Pay" {
+		t.Fatalf("expected Pay, got %+v", msg)
+	}
+	host.inbound <- &Message{HostID: peer.PeerID, PeerID: host.Name, Type: "PayAck", Amount: msg.Amount, ID: msg.ID}
+	waitFor(t, host, func() bool { return len(peer.trustline.Pending) == 0 })
+}
+
+// waitFor polls cond on the stateManager goroutine until it holds.
+func waitFor(t *testing.T, host *Host, cond func() bool) {
+	t.Helper()
+	for i := 0; i < 200; i++ {
+		ok := false
+		host.run(func() { ok = cond() })
+		if ok {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatal("condition not met")
+}
+
+func TestJournalReplay(t *testing.T) {
+	chain := newMemChain()
+	chain.Register("alice", 80, "pw", PeerInfo{})
+	chain.Register("bob", 0, "pw", PeerInfo{})
+	dir := t.TempDir()
+
+	// Crashed right after writing intents, one of which reached the chain,
+	// and after notifying the peer about another
+	j, err := openJournal(journalPath(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	j.record(&journalEntry{ID: "paid", PeerID: "bob", Amount: 30, Before: 80}, settleIntent)
+	j.record(&journalEntry{ID: "unpaid", PeerID: "bob", Amount: 10, Before: 50}, settleIntent)
+	chain.Pay("alice", "bob", "pw", 30, "paid")
+	// Bob paid it back since, so alice's balance doesn't show it
+	chain.Pay("bob", "alice", "pw", 30, "")
+	j.record(&journalEntry{ID: "notified", PeerID: "bob", Amount: 5}, settleNotified)
+	j.record(&journalEntry{ID: "done", PeerID: "bob", Amount: 5}, settleAcked)
+
+	host := newHost("alice", 0, chain)
+	host.chainBalance = 80
+	if host.journal, err = openJournal(journalPath(dir)); err != nil {
+		t.Fatal(err)
+	}
+	if err := host.replayJournal(80); err != nil {
+		t.Fatal(err)
+	}
+	if e, _ := host.journal.get("bob", "unpaid", false); e.State != settleAborted {
+		t.Fatalf("unpaid intent is %s", e.State)
+	}
+	go host.stateManager()
+
+	// Once bob is back both paid settlements are sent again
+	bob := testPeer(host, "bob")
+	host.run(func() { bob.pending = true })
+	host.inbound <- &Message{HostID: "bob", PeerID: "alice", Type: "ProposeAccept"}
+	got := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		msg := next(bob)
+		got[msg.ID] = msg.Type == "Settle"
+	}
+	if !got["paid"] || !got["notified"] {
+		t.Fatalf("resent %v", got)
+	}
+
+	host.inbound <- &Message{HostID: "bob", PeerID: "alice", Type: "SettleAck", ID: "paid"}
+	waitFor(t, host, func() bool {
+		e, _ := host.journal.get("bob", "paid", false)
+		return e.State == settleAcked
+	})
+}
@@ -0,0 +1,486 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// A routed payment is a chain of hash-locked conditional payments, HTLCs,
+// one per trustline on the path. The sender picks a random preimage and
+// sends a Prepare with its hash to the first hop, along with the preimage
+// sealed to the recipient's key, see sign.go. Each hop holds the amount in
+// flight and prepares the same hash with the next one. The recipient opens
+// the preimage and answers with a Fulfill, which travels back and commits
+// every hop on the way, since it proves the next hop was paid. A Cancel
+// travels back the same way and unwinds every hop instead.
+//
+// Each hop's Prepare expires host.htlcDelta before the one it came from. The
+// receiving side of an HTLC cancels it once it expires, and the sending side
+// gives up on it host.htlcGrace later, so a node always hears back from the
+// next hop before it has to answer the previous one. Once we give up on an
+// HTLC and cancel the previous hop, a Fulfill for it is refused: paying it
+// would let the two ends of a path hold back the preimage until then and take
+// the amount from us. An honest next hop never fulfills it that late, since
+// its own side expired htlcGrace earlier. A payment of our own has no
+// previous hop, so a late Fulfill for it is paid: the recipient got the
+// money. We keep the HTLC, marked cancelled, for htlcKeep so a late Fulfill
+// is recognized.
+//
+// A Prepare can't expire more than maxHops deltas from now, so nobody can tie
+// up our credit for longer than the longest path would. We send over at most
+// maxHops-1 hops, leaving one delta for clocks that don't quite agree.
+const (
+	defaultHTLCDelta = 20 * time.Second
+	defaultHTLCGrace = 5 * time.Second
+	maxHops          = 20
+	htlcKeep         = time.Hour
+)
+
+const (
+	rejectExpiry   = "expiry"
+	rejectBadHTLC  = "bad_htlc"
+	rejectPreimage = "bad_preimage"
+)
+
+// An HTLC is a conditional payment on a trustline, sent by us if Out. It
+// counts toward neither balance until it is fulfilled. From is the peer a
+// forwarded HTLC came from. One we received stays after it is resolved, with
+// its Preimage or Canceled set, so the answer can be sent again if the peer
+// missed it. Limit is how much a cancelled clearing could have cleared
+// instead, see clear.go.
+type HTLC struct {
+	ID       string
+	Amount   uint32
+	Hash     []byte
+	Expiry   time.Time
+	Out      bool
+	Seq      uint64   `json:",omitempty"`
+	Path     []string `json:",omitempty"`
+	Sealed   []byte   `json:",omitempty"`
+	From     string   `json:",omitempty"`
+	Preimage []byte   `json:",omitempty"`
+	Canceled bool     `json:",omitempty"`
+	Code     string   `json:",omitempty"`
+	Reason   string   `json:",omitempty"`
+	Limit    uint32   `json:",omitempty"`
+}
+
+func (h *HTLC) resolved() bool {
+	return h.Preimage != nil || h.Canceled
+}
+
+func (h *HTLC) prepare(from string, to string) *Message {
+	return &Message{
+		HostID: from,
+		PeerID: to,
+		Type:   "Prepare",
+		Amount: h.Amount,
+		ID:     h.ID,
+		Seq:    h.Seq,
+		Path:   h.Path,
+		Hash:   h.Hash,
+		Expiry: h.Expiry.UnixNano(),
+		Sealed: h.Sealed,
+	}
+}
+
+// inFlight is the total of the unresolved HTLCs we sent, or received.
+func (tl *Trustline) inFlight(out bool) uint32 {
+	var total uint32
+	for _, h := range tl.HTLCs {
+		if h.Out == out && !h.resolved() {
+			total += h.Amount
+		}
+	}
+	return total
+}
+
+func (tl *Trustline) htlc(id string, out bool) *HTLC {
+	for _, h := range tl.HTLCs {
+		if h.ID == id && h.Out == out {
+			return h
+		}
+	}
+	return nil
+}
+
+// putHTLC adds h, replacing the HTLC with its ID in the same direction. Like
+// takePending, it rebuilds the slice since the store may still hold the old
+// one.
+func (tl *Trustline) putHTLC(h *HTLC) {
+	tl.dropHTLC(h.ID, h.Out)
+	tl.HTLCs = append(tl.HTLCs, h)
+}
+
+func (tl *Trustline) dropHTLC(id string, out bool) {
+	rest := make([]*HTLC, 0, len(tl.HTLCs))
+	for _, h := range tl.HTLCs {
+		if h.ID != id || h.Out != out {
+			rest = append(rest, h)
+		}
+	}
+	tl.HTLCs = rest
+}
+
+// route sends a payment to msg.PeerID along the shortest known path, as a
+// plain Pay if we have a trustline with it. Runs from the stateManager; the
+// recipient's key is looked up outside it, and the route is found again once
+// we have it.
+func (host *Host) route(msg *Message) {
+	path := host.pathFor(msg)
+	if path == nil {
+		return
+	}
+	if len(path) == 2 {
+		msg.Type = "Pay"
+		host.pay(host.peerIDtoPeer[path[1]], msg)
+		return
+	}
+	go func() {
+		pi, err := host.resolve(msg.PeerID)
+		host.run(func() {
+			if err != nil {
+				fmt.Printf("\nErr: Could not pay %s: %v\n", msg.PeerID, err)
+				fmt.Print("> ")
+				return
+			}
+			path := host.pathFor(msg)
+			if path == nil {
+				return
+			}
+			if len(path) == 2 {
+				msg.Type = "Pay"
+				host.pay(host.peerIDtoPeer[path[1]], msg)
+				return
+			}
+			if err := host.sendHTLC(path, msg.Amount, pi.PublicKey); err != nil {
+				fmt.Printf("\nErr: Could not pay %s: %v\n", msg.PeerID, err)
+				fmt.Print("> ")
+			}
+		})
+	}()
+}
+
+// pathFor finds the path for payment msg, or reports why there is none and
+// returns nil.
+func (host *Host) pathFor(msg *Message) []string {
+	path := host.findRoute(msg.PeerID, msg.Amount)
+	if len(path) < 2 {
+		fmt.Printf("\nErr: No route to %s\n", msg.PeerID)
+		fmt.Print("> ")
+		return nil
+	}
+	first := host.peerIDtoPeer[path[1]]
+	if len(path) > 2 && host.exposure(first)+int(msg.Amount) > int(first.trustline.PeerLimit) {
+		fmt.Printf("\nErr: Payment of %d to %s exceeds the credit limit of %d with %s\n", msg.Amount, msg.PeerID, first.trustline.PeerLimit, first.PeerID)
+		fmt.Print("> ")
+		return nil
+	}
+	return path
+}
+
+// sendHTLC starts a conditional payment along path, locked to a new preimage
+// sealed to pub.
+func (host *Host) sendHTLC(path []string, amount uint32, pub ed25519.PublicKey) error {
+	preimage := make([]byte, sha256.Size)
+	if _, err := rand.Read(preimage); err != nil {
+		return err
+	}
+	sealed, err := sealPreimage(pub, preimage)
+	if err != nil {
+		return err
+	}
+	if len(path)-1 >= maxHops {
+		return fmt.Errorf("route is longer than %d hops", maxHops-1)
+	}
+	hash := sha256.Sum256(preimage)
+	h := &HTLC{
+		ID:     newID(),
+		Amount: amount,
+		Hash:   hash[:],
+		Expiry: time.Now().Add(time.Duration(len(path)-1) * host.htlcDelta),
+		Out:    true,
+		Path:   path,
+		Sealed: sealed,
+	}
+	if !host.prepare(host.peerIDtoPeer[path[1]], h) {
+		return fmt.Errorf("could not reach %s", path[1])
+	}
+	return nil
+}
+
+// prepare sends HTLC h to peer and keeps it in flight. Returns false if it
+// wasn't sent.
+func (host *Host) prepare(peer *Peer, h *HTLC) bool {
+	tl := peer.trustline
+	tl.SendSeq++
+	h.Seq = tl.SendSeq
+	tl.putHTLC(h)
+	host.saveTrustline(peer)
+	if !host.sendTo(peer, h.prepare(host.Name, peer.PeerID)) {
+		tl.dropHTLC(h.ID, true)
+		tl.SendSeq--
+		host.saveTrustline(peer)
+		return false
+	}
+	return true
+}
+
+// receivePrepare takes on an HTLC from peer. If the payment is for us it is
+// fulfilled right away, otherwise it is prepared with the next hop. A Prepare
+// we already answered is answered again; other replays are dropped.
+func (host *Host) receivePrepare(peer *Peer, msg *Message) {
+	if peer.pending && !peer.resuming {
+		host.cancel(peer, msg, rejectNoTrustline, "no open trustline", 0)
+		return
+	}
+	tl := peer.trustline
+	if err := checkSeq(tl, msg.Seq); err != nil {
+		if h := tl.htlc(msg.ID, false); h != nil && errors.Is(err, errReplayed) {
+			if h.resolved() {
+				host.sendResolution(peer, h)
+			}
+			return
+		}
+		reportSeq(msg, err)
+		if !errors.Is(err, errReplayed) {
+			host.rejectSeq(peer, msg, err)
+		}
+		return
+	}
+	tl.RecvSeq = msg.Seq
+	h := &HTLC{ID: msg.ID, Amount: msg.Amount, Hash: msg.Hash, Expiry: time.Unix(0, msg.Expiry), Path: msg.Path}
+	next, _ := host.nextHop(peer, msg)
+	code, reason := host.checkPay(peer, msg)
+	if code == "" {
+		code, reason = host.checkRoute(peer, msg)
+	}
+	var most uint32
+	if code == "" && isCycle(msg.Path) {
+		code, reason, most = host.checkClear(peer, next, msg)
+	}
+	if code == "" {
+		code, reason = host.checkHTLC(h, next != "")
+	}
+	var preimage []byte
+	if code == "" && next == "" {
+		var err error
+		if preimage, err = host.openPreimage(msg.Sealed, msg.Hash); err != nil {
+			code, reason = rejectPreimage, err.Error()
+		}
+	}
+	if code != "" {
+		host.saveTrustline(peer)
+		host.cancel(peer, msg, code, reason, most)
+		return
+	}
+
+	if next == "" {
+		host.fulfillIn(peer, h, preimage)
+		if isCycle(msg.Path) {
+			return
+		}
+		fmt.Printf("\n%s has paid you %d via %s!\n", msg.Path[0], msg.Amount, peer.PeerID)
+		fmt.Print("> ")
+		return
+	}
+	tl.putHTLC(h)
+	host.saveTrustline(peer)
+	out := &HTLC{
+		ID:     h.ID,
+		Amount: h.Amount,
+		Hash:   h.Hash,
+		Expiry: h.Expiry.Add(-host.htlcDelta),
+		Out:    true,
+		Path:   h.Path,
+		Sealed: msg.Sealed,
+		From:   peer.PeerID,
+	}
+	if !host.prepare(host.peerIDtoPeer[next], out) {
+		host.cancelIn(peer, h, rejectNoRoute, "could not reach "+next)
+	}
+}
+
+// checkHTLC makes sure h can be fulfilled in time, with enough left over to
+// forward it if it isn't for us.
+func (host *Host) checkHTLC(h *HTLC, forward bool) (code string, reason string) {
+	left := time.Until(h.Expiry)
+	if forward {
+		left -= host.htlcDelta
+	}
+	switch {
+	case len(h.Hash) != sha256.Size:
+		return rejectBadHTLC, "invalid hash"
+	case left <= 0:
+		return rejectExpiry, "expires too soon"
+	case time.Until(h.Expiry) > maxHops*host.htlcDelta:
+		return rejectExpiry, "expires too late"
+	}
+	return "", ""
+}
+
+// cancel refuses a Prepare from peer that never went in flight. A clearing
+// refused for its amount carries the most we could clear in limit.
+func (host *Host) cancel(peer *Peer, msg *Message, code string, reason string, limit uint32) {
+	reply := Message{HostID: host.Name, PeerID: peer.PeerID, Type: "Cancel", Amount: msg.Amount, ID: msg.ID, Code: code, Reason: reason, Limit: limit}
+	host.sendTo(peer, &reply)
+}
+
+// fulfillIn commits an HTLC peer sent us now that we know its preimage, and
+// tells peer.
+func (host *Host) fulfillIn(peer *Peer, h *HTLC, preimage []byte) {
+	tl := peer.trustline
+	c := *h
+	c.Preimage = preimage
+	tl.putHTLC(&c)
+	tl.HostBalance += int(h.Amount)
+	tl.PeerBalance -= int(h.Amount)
+	host.saveTrustline(peer)
+	host.logHistory(peer, "Pay", "in", h.Amount, h.ID)
+	host.sendResolution(peer, &c)
+	host.proposeState(peer)
+}
+
+// cancelIn drops an HTLC peer sent us and tells peer.
+func (host *Host) cancelIn(peer *Peer, h *HTLC, code string, reason string) {
+	c := *h
+	c.Canceled, c.Code, c.Reason = true, code, reason
+	peer.trustline.putHTLC(&c)
+	host.saveTrustline(peer)
+	host.sendResolution(peer, &c)
+}
+
+func (host *Host) sendResolution(peer *Peer, h *HTLC) {
+	msg := Message{HostID: host.Name, PeerID: peer.PeerID, Type: "Fulfill", Amount: h.Amount, ID: h.ID, Preimage: h.Preimage}
+	if h.Canceled {
+		msg = Message{HostID: host.Name, PeerID: peer.PeerID, Type: "Cancel", Amount: h.Amount, ID: h.ID, Code: h.Code, Reason: h.Reason, Limit: h.Limit}
+	}
+	host.sendTo(peer, &msg)
+}
+
+// fulfilled commits an HTLC we sent peer, and the one it was forwarded from.
+func (host *Host) fulfilled(peer *Peer, msg *Message) {
+	tl := peer.trustline
+	h := tl.htlc(msg.ID, true)
+	if h == nil {
+		return
+	}
+	if sum := sha256.Sum256(msg.Preimage); !bytes.Equal(sum[:], h.Hash) {
+		fmt.Printf("\nErr: %s fulfilled payment %s with the wrong preimage\n", peer.PeerID, h.ID)
+		fmt.Print("> ")
+		return
+	}
+	if h.Canceled && h.From != "" {
+		// We gave up on it, and unwound the previous hop, already
+		fmt.Printf("\nErr: %s fulfilled payment %s of %d after it expired; refused\n", peer.PeerID, h.ID, h.Amount)
+		fmt.Print("> ")
+		return
+	}
+	tl.dropHTLC(h.ID, true)
+	tl.HostBalance -= int(h.Amount)
+	tl.PeerBalance += int(h.Amount)
+	host.saveTrustline(peer)
+	host.logHistory(peer, "Pay", "out", h.Amount, h.ID)
+	host.proposeState(peer)
+	if h.From == "" && isCycle(h.Path) {
+		host.cleared(h)
+		return
+	}
+	if h.From == "" && h.Canceled {
+		fmt.Printf("\nPayment of %d to %s went through after all\n", h.Amount, h.Path[len(h.Path)-1])
+		fmt.Print("> ")
+		return
+	}
+	if h.From == "" {
+		fmt.Printf("\nSent %d to %s via %s\n", h.Amount, h.Path[len(h.Path)-1], peer.PeerID)
+		fmt.Print("> ")
+		return
+	}
+	if from, ok := host.peerIDtoPeer[h.From]; ok {
+		if in := from.trustline.htlc(h.ID, false); in != nil && !in.resolved() {
+			host.fulfillIn(from, in, msg.Preimage)
+			if isCycle(h.Path) {
+				fmt.Printf("\nCleared %d with %s and %s\n", h.Amount, h.From, peer.PeerID)
+			} else {
+				fmt.Printf("\nForwarded %d from %s to %s\n", h.Amount, h.From, peer.PeerID)
+			}
+			fmt.Print("> ")
+		}
+	}
+}
+
+// canceled drops an HTLC we sent peer and unwinds the one it was forwarded
+// from.
+func (host *Host) canceled(peer *Peer, msg *Message) {
+	h := peer.trustline.htlc(msg.ID, true)
+	if h == nil {
+		return
+	}
+	if msg.Code == rejectSequence && !h.resolved() && peer.resyncs() {
+		host.resync(peer, msg.Seq)
+		return
+	}
+	peer.trustline.dropHTLC(h.ID, true)
+	host.saveTrustline(peer)
+	if !h.Canceled {
+		host.unwind(h, msg.Code, msg.Reason, msg.Limit)
+	}
+}
+
+// unwind passes the failure of an HTLC we sent back to where it came from,
+// or reports it if the payment was ours.
+func (host *Host) unwind(h *HTLC, code string, reason string, limit uint32) {
+	if h.From == "" && isCycle(h.Path) {
+		host.clearFailed(h, code, reason, limit)
+		return
+	}
+	if h.From == "" {
+		fmt.Printf("\nErr: Payment of %d to %s failed (%s): %s\n", h.Amount, h.Path[len(h.Path)-1], code, reason)
+		fmt.Print("> ")
+		return
+	}
+	if from, ok := host.peerIDtoPeer[h.From]; ok {
+		if in := from.trustline.htlc(h.ID, false); in != nil && !in.resolved() {
+			// The most the rest of the cycle can clear is the most it
+			// can clear through us
+			c := *in
+			c.Limit = limit
+			host.cancelIn(from, &c, code, reason)
+		}
+	}
+}
+
+// expireHTLCs cancels HTLCs whose time ran out and forgets answered ones the
+// peer can no longer ask about, or try to fulfill late. Runs from the stateManager.
+func (host *Host) expireHTLCs() {
+	now := time.Now()
+	for _, peer := range host.peerIDtoPeer {
+		if peer.trustline == nil {
+			continue
+		}
+		tl := peer.trustline
+		for _, h := range tl.HTLCs {
+			switch {
+			case !h.Out && !h.resolved() && now.After(h.Expiry):
+				host.cancelIn(peer, h, rejectExpiry, "expired")
+			case !h.Out && h.resolved() && now.After(h.Expiry.Add(host.htlcGrace)):
+				tl.dropHTLC(h.ID, false)
+				host.saveTrustline(peer)
+			case h.Out && !h.resolved() && now.After(h.Expiry.Add(host.htlcGrace)):
+				c := *h
+				c.Canceled, c.Code, c.Reason = true, rejectExpiry, "expired"
+				tl.putHTLC(&c)
+				host.saveTrustline(peer)
+				host.unwind(h, rejectExpiry, "expired", 0)
+			case h.Out && now.After(h.Expiry.Add(htlcKeep)):
+				tl.dropHTLC(h.ID, true)
+				host.saveTrustline(peer)
+			}
+		}
+	}
+}
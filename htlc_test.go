@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"testing"
+	"time"
+)
+
+// prepareVia has alice's Prepare for carol arrive at host, a hop in between.
+func prepareVia(host *Host, preimage []byte, seq uint64, expiry time.Time) *Message {
+	hash := sha256.Sum256(preimage)
+	msg := &Message{HostID: "alice", PeerID: "bob", Type: "Prepare", Amount: 10, ID: newID(), Seq: seq,
+		Path: []string{"alice", "bob", "carol"}, Hash: hash[:], Expiry: expiry.UnixNano(), Sealed: make([]byte, 64)}
+	host.inbound <- msg
+	return msg
+}
+
+func TestForwardedHTLC(t *testing.T) {
+	host := newTestHost(t, "bob", newMemChain())
+	go host.stateManager()
+	alice := testPeer(host, "alice")
+	carol := testPeer(host, "carol")
+	preimage := bytes.Repeat([]byte{1}, 32)
+
+	in := prepareVia(host, preimage, 1, time.Now().Add(2*host.htlcDelta))
+	out := next(carol)
+	if out.Type != "Prepare" || out.ID != in.ID || out.Expiry != in.Expiry-int64(host.htlcDelta) {
+		t.Fatalf("forwarded %+v", out)
+	}
+	// Held apart from the balances until carol answers
+	host.run(func() {
+		if alice.trustline.inFlight(false) != 10 || carol.trustline.inFlight(true) != 10 || alice.trustline.HostBalance != 0 {
+			t.Errorf("in flight: %+v %+v", alice.trustline, carol.trustline)
+		}
+	})
+
+	host.inbound <- &Message{HostID: "carol", PeerID: "bob", Type: "Fulfill", ID: in.ID, Preimage: []byte("wrong")}
+	host.inbound <- &Message{HostID: "carol", PeerID: "bob", Type: "Fulfill", ID: in.ID, Preimage: preimage}
+	if msg := next(alice); msg.Type != "Fulfill" || !bytes.Equal(msg.Preimage, preimage) {
+		t.Fatalf("alice got %+v", msg)
+	}
+	host.run(func() {
+		if alice.trustline.HostBalance != 10 || carol.trustline.PeerBalance != 10 || carol.trustline.inFlight(true) != 0 {
+			t.Errorf("after fulfill: %+v %+v", alice.trustline, carol.trustline)
+		}
+	})
+
+	// Alice missed the Fulfill and prepares again: answered the same
+	host.inbound <- in
+	if msg := next(alice); msg.Type != "Fulfill" || msg.ID != in.ID {
+		t.Fatalf("replay answered with %+v", msg)
+	}
+
+	// Carol cancels the next one, and it is unwound on alice's side
+	in = prepareVia(host, preimage, 2, time.Now().Add(2*host.htlcDelta))
+	next(carol)
+	host.inbound <- &Message{HostID: "carol", PeerID: "bob", Type: "Cancel", ID: in.ID, Code: rejectTooLarge, Reason: "no"}
+	if msg := next(alice); msg.Type != "Cancel" || msg.Code != rejectTooLarge {
+		t.Fatalf("alice got %+v", msg)
+	}
+
+	// Too little time left to pass it on
+	prepareVia(host, preimage, 3, time.Now().Add(host.htlcDelta/2))
+	if msg := next(alice); msg.Type != "Cancel" || msg.Code != rejectExpiry {
+		t.Fatalf("alice got %+v", msg)
+	}
+	// Or too much, holding the credit longer than any route needs
+	prepareVia(host, preimage, 4, time.Now().Add((maxHops+1)*host.htlcDelta))
+	if msg := next(alice); msg.Type != "Cancel" || msg.Code != rejectExpiry {
+		t.Fatalf("alice got %+v", msg)
+	}
+}
+
+func TestHTLCExpiry(t *testing.T) {
+	defer func(i time.Duration) { settleCheckInterval = i }(settleCheckInterval)
+	settleCheckInterval = 5 * time.Millisecond
+	host := newTestHost(t, "bob", newMemChain())
+	host.htlcDelta, host.htlcGrace = 100*time.Millisecond, 20*time.Millisecond
+	go host.stateManager()
+	alice := testPeer(host, "alice")
+	carol := testPeer(host, "carol")
+
+	// Carol never answers: bob gives up on her before alice's runs out
+	preimage := bytes.Repeat([]byte{1}, 32)
+	in := prepareVia(host, preimage, 1, time.Now().Add(2*host.htlcDelta))
+	next(carol)
+	msg := next(alice)
+	if msg.Type != "Cancel" || msg.ID != in.ID || msg.Code != rejectExpiry {
+		t.Fatalf("alice got %+v", msg)
+	}
+	if time.Now().After(time.Unix(0, in.Expiry)) {
+		t.Error("cancelled after alice's HTLC expired")
+	}
+	waitFor(t, host, func() bool {
+		return carol.trustline.inFlight(true) == 0 && alice.trustline.inFlight(false) == 0 && alice.trustline.HostBalance == 0
+	})
+
+	// Carol fulfills it after bob gave up and cancelled alice's: refused,
+	// so bob isn't left paying for it
+	host.inbound <- &Message{HostID: "carol", PeerID: "bob", Type: "Fulfill", ID: in.ID, Preimage: preimage}
+	host.inbound <- &Message{HostID: "carol", PeerID: "bob", Type: "Cancel", ID: in.ID}
+	waitFor(t, host, func() bool { return carol.trustline.htlc(in.ID, true) == nil })
+	host.run(func() {
+		if carol.trustline.PeerBalance != 0 || alice.trustline.HostBalance != 0 {
+			t.Errorf("late Fulfill paid: carol %d, alice %d", carol.trustline.PeerBalance, alice.trustline.HostBalance)
+		}
+	})
+
+	// A payment of bob's own that he gave up on is paid all the same once
+	// carol fulfills it: dave got the money
+	hash := sha256.Sum256(preimage)
+	host.run(func() {
+		carol.trustline.putHTLC(&HTLC{ID: "own", Amount: 10, Hash: hash[:], Expiry: time.Now(), Out: true, Path: []string{"bob", "carol", "dave"}})
+	})
+	waitFor(t, host, func() bool { return carol.trustline.htlc("own", true).Canceled })
+	host.inbound <- &Message{HostID: "carol", PeerID: "bob", Type: "Fulfill", ID: "own", Preimage: preimage}
+	waitFor(t, host, func() bool { return carol.trustline.htlc("own", true) == nil })
+	host.run(func() {
+		if carol.trustline.PeerBalance != 10 {
+			t.Errorf("late Fulfill of our own payment: carol %d", carol.trustline.PeerBalance)
+		}
+	})
+}
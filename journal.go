@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Settlement states. Ours go intent -> chain-submitted -> peer-notified ->
+// acknowledged, or intent -> aborted if the chain refused the payment. A
+// peer's go received -> credited, or received -> disputed.
+const (
+	settleIntent    = "intent"
+	settleSubmitted = "chain-submitted"
+	settleNotified  = "peer-notified"
+	settleAcked     = "acknowledged"
+	settleAborted   = "aborted"
+
+	settleReceived = "received"
+	settleCredited = "credited"
+	settleDisputed = "disputed"
+)
+
+// A journalEntry is one settlement state change. The ID goes with our payment
+// on the chain, which tells on replay whether it got there. Before is our
+// chain balance when the intent was written, for chains that can't tell.
+// Mark is the trustline's SettledOut (or SettledIn) total once the settlement
+// is applied, which tells whether it reached the trustline. Seq is the
+// sequence number the Settle went out with, once it has.
+type journalEntry struct {
+	ID      string    `json:"id"`
+	PeerID  string    `json:"peer"`
+	Amount  uint32    `json:"amt"`
+	State   string    `json:"state"`
+	Inbound bool      `json:"inbound,omitempty"`
+	Before  uint32    `json:"before,omitempty"`
+	Mark    uint64    `json:"mark,omitempty"`
+	Seq     uint64    `json:"seq,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+// A journalKey tells settlements apart. IDs are only unique per peer and
+// direction, since peers pick the IDs of their own.
+type journalKey struct {
+	peer    string
+	id      string
+	inbound bool
+}
+
+func (e *journalEntry) key() journalKey {
+	return journalKey{e.PeerID, e.ID, e.Inbound}
+}
+
+func (e *journalEntry) done() bool {
+	switch e.State {
+	case settleAcked, settleAborted, settleCredited, settleDisputed:
+		return true
+	}
+	return false
+}
+
+// journal is a durable, append-only log of settlement state changes. Each
+// change is synced to disk before the step it records is taken further, so a
+// crash never leaves the chain and a trustline disagreeing without a trace.
+type journal struct {
+	f       *os.File
+	entries map[journalKey]*journalEntry
+}
+
+// openJournal replays the journal at path, compacts it down to the latest
+// state of each settlement and opens it for appending.
+func openJournal(path string) (*journal, error) {
+	j := &journal{entries: make(map[journalKey]*journalEntry)}
+	if f, err := os.Open(path); err == nil {
+		sc := bufio.NewScanner(f)
+		for sc.Scan() {
+			var e journalEntry
+			if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+				// A torn last line from a crash mid-write
+				break
+			}
+			j.entries[e.key()] = &e
+		}
+		f.Close()
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range j.entries {
+		if err := writeEntry(f, e); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	f.Close()
+	if err := os.Rename(tmp, path); err != nil {
+		return nil, err
+	}
+
+	j.f, err = os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+func writeEntry(f *os.File, e *journalEntry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(b, '\n'))
+	return err
+}
+
+// record moves a settlement to state and syncs it to disk.
+func (j *journal) record(e *journalEntry, state string) error {
+	e.State = state
+	e.Time = time.Now()
+	j.entries[e.key()] = e
+	if err := writeEntry(j.f, e); err != nil {
+		return err
+	}
+	return j.f.Sync()
+}
+
+// get returns the settlement id, to or from peer as inbound says.
+func (j *journal) get(peer string, id string, inbound bool) (*journalEntry, bool) {
+	e, ok := j.entries[journalKey{peer, id, inbound}]
+	return e, ok
+}
+
+// unfinished returns every settlement that isn't in a final state.
+func (j *journal) unfinished() []*journalEntry {
+	var es []*journalEntry
+	for _, e := range j.entries {
+		if !e.done() {
+			es = append(es, e)
+		}
+	}
+	return es
+}
+
+// journalPath is where a node keeps its settlement journal.
+func journalPath(dataDir string) string {
+	return filepath.Join(dataDir, "settlements.journal")
+}
+
+// logJournalErr reports a journal write that failed. The step it was meant to
+// record has not been taken.
+func logJournalErr(err error) {
+	fmt.Printf("\nErr: Settlement journal: %v\n", err)
+	fmt.Print("> ")
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// defaultTrustlineLimit is the credit each side extends when a proposal
+// doesn't name a limit.
+const defaultTrustlineLimit = 100
+
+// Each side of a trustline decides how much credit it extends. The proposer
+// sends its limit with the Propose and the acceptor answers with its own in
+// the ProposeAccept, the proposed one unless it names another. A node refuses
+// payments that would take the peer's debt past the credit it extends, and
+// doesn't send payments that would take its own debt past what the peer
+// extends.
+
+// trustlineVersion marks trustline records that store negotiated limits, so
+// limits of 0 aren't taken for a record from before limits.
+const trustlineVersion = 1
+
+// withDefaultLimits fills in the limits of a trustline stored before they
+// were negotiated.
+func (tl *Trustline) withDefaultLimits() *Trustline {
+	if tl.Version == 0 {
+		tl.HostLimit, tl.PeerLimit = defaultTrustlineLimit, defaultTrustlineLimit
+		tl.Version = trustlineVersion
+	}
+	return tl
+}
+
+// parseLimit reads a credit limit typed at the prompt.
+func parseLimit(s string) (uint32, error) {
+	n, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid limit %q", s)
+	}
+	return uint32(n), nil
+}
+
+// parseProposeArgs reads the arguments of the propose command:
+// <peerID> [--limit N].
+func parseProposeArgs(args []string) (peerID string, limit uint32, err error) {
+	limit = defaultTrustlineLimit
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "--limit":
+			if i+1 == len(args) {
+				return "", 0, fmt.Errorf("--limit needs a value")
+			}
+			if limit, err = parseLimit(args[i+1]); err != nil {
+				return "", 0, err
+			}
+			i++
+		default:
+			if peerID != "" {
+				return "", 0, fmt.Errorf("usage: propose <peerID> [--limit N]")
+			}
+			peerID = args[i]
+		}
+	}
+	if peerID == "" {
+		return "", 0, fmt.Errorf("usage: propose <peerID> [--limit N]")
+	}
+	return peerID, limit, nil
+}
+
+// settling is the total of our settlements with peer that are on the chain
+// but that it hasn't credited yet. Until it does, the peer still counts them
+// as our debt.
+func (host *Host) settling(peer *Peer) uint32 {
+	var total uint32
+	for _, e := range host.journal.unfinished() {
+		if !e.Inbound && e.PeerID == peer.PeerID && (e.State == settleSubmitted || e.State == settleNotified) {
+			total += e.Amount
+		}
+	}
+	return total
+}
+
+// exposure is the most the peer may think we owe it: our balance plus every
+// payment and settlement it hasn't acknowledged, and the conditional payments
+// we have in flight with it.
+func (host *Host) exposure(peer *Peer) int {
+	tl := peer.trustline
+	return tl.PeerBalance + int(tl.pendingOut()) + int(host.settling(peer)) + int(tl.inFlight(true))
+}
+
+// owed is what the peer may think we owe it once our settlements on the
+// chain are credited: exposure less those.
+func (host *Host) owed(peer *Peer) int {
+	return host.exposure(peer) - int(host.settling(peer))
+}
+
+// withinLimit checks a payment of amount to peer against the credit it
+// extends. A payment over it waits in host.held if one of our settlements is
+// on its way to freeing up credit, and is refused otherwise. Runs from the
+// stateManager.
+func (host *Host) withinLimit(peer *Peer, msg *Message) bool {
+	limit := int(peer.trustline.PeerLimit)
+	if host.exposure(peer)+int(msg.Amount) <= limit {
+		return true
+	}
+	if host.settling(peer) > 0 || host.settleQueued(peer) {
+		host.held[peer.PeerID] = append(host.held[peer.PeerID], msg)
+		fmt.Printf("\nPayment of %d to %s waits for a settlement to clear\n", msg.Amount, peer.PeerID)
+		fmt.Print("> ")
+		return false
+	}
+	fmt.Printf("\nErr: Payment of %d to %s exceeds the credit limit of %d\n", msg.Amount, peer.PeerID, limit)
+	fmt.Print("> ")
+	return false
+}
+
+// releaseHeld sends the payments to peer that waited for a settlement.
+func (host *Host) releaseHeld(peer *Peer) {
+	held := host.held[peer.PeerID]
+	delete(host.held, peer.PeerID)
+	for _, msg := range held {
+		host.pay(peer, msg)
+	}
+}
+
+// An open trustline's limits change the same way they were set: a node asks
+// to change the credit it extends with a Limit message, and the peer accepts
+// or rejects it at the prompt. A node owing more than a lowered limit settles
+// the difference on the chain once it accepts.
+
+// requestLimit asks peer to agree to a new limit on the credit we extend.
+// Runs from the stateManager.
+func (host *Host) requestLimit(peer *Peer, msg *Message) {
+	if peer.pending || peer.trustline == nil {
+		fmt.Printf("\nErr: No open trustline with %s\n", peer.PeerID)
+		fmt.Print("> ")
+		return
+	}
+	if !host.sendTo(peer, msg) {
+		fmt.Printf("\nErr: Could not ask %s for a new limit\n", peer.PeerID)
+		fmt.Print("> ")
+		return
+	}
+	host.limitReqs[peer.PeerID] = msg.Limit
+}
+
+// limitRequested puts a peer's limit change up for the user to answer.
+func (host *Host) limitRequested(prop *Proposal) {
+	peer, msg := prop.peer, prop.msg
+	if peer.pending || peer.trustline == nil {
+		reply := Message{HostID: host.Name, PeerID: peer.PeerID, Type: "LimitReject", Limit: msg.Limit, Reason: "no open trustline"}
+		host.sendTo(peer, &reply)
+		return
+	}
+	fmt.Printf("\n%s wants to change the credit they extend you from %d to %d", peer.PeerID, peer.trustline.PeerLimit, msg.Limit)
+	if owed := host.owed(peer); owed > int(msg.Limit) {
+		fmt.Printf(", you would settle %d of the %d you owe", owed-int(msg.Limit), owed)
+	}
+	fmt.Print(". Accept? [y/n]: ")
+	host.urgentcmd.Enqueue(prop)
+}
+
+// acceptLimit agrees to the credit peer extends going to msg.Limit, and
+// settles down to it if we owe more, counting payments and HTLCs it hasn't
+// answered. Runs from the stateManager.
+func (host *Host) acceptLimit(peer *Peer, msg *Message) {
+	if !peer.online() || peer.pending {
+		fmt.Printf("\nErr: %s is offline, limit change dropped\n", peer.PeerID)
+		fmt.Print("> ")
+		return
+	}
+	tl := peer.trustline
+	tl.PeerLimit = msg.Limit
+	host.saveTrustline(peer)
+	host.logHistory(peer, "Limit", "in", msg.Limit, "")
+	host.sendTo(peer, msg)
+	if over := host.owed(peer) - int(tl.PeerLimit); over > 0 {
+		fmt.Printf("\nSettling %d with %s to get under the new limit of %d\n", over, peer.PeerID, tl.PeerLimit)
+		fmt.Print("> ")
+		host.settle(peer, &Message{HostID: host.Name, PeerID: peer.PeerID, Type: "Settle", Amount: uint32(over)})
+	}
+}
+
+// limitAnswered applies the peer's answer to a limit change we asked for.
+func (host *Host) limitAnswered(peer *Peer, msg *Message) {
+	want, ok := host.limitReqs[peer.PeerID]
+	if !ok || want != msg.Limit {
+		fmt.Printf("\nErr: Dropped %s for a limit of %d we didn't ask %s for\n", msg.Type, msg.Limit, peer.PeerID)
+		fmt.Print("> ")
+		return
+	}
+	delete(host.limitReqs, peer.PeerID)
+	if msg.Type == "LimitReject" {
+		fmt.Printf("\n%s has rejected a limit of %d: %s\n", peer.PeerID, msg.Limit, msg.Reason)
+		fmt.Print("> ")
+		return
+	}
+	tl := peer.trustline
+	tl.HostLimit = msg.Limit
+	host.saveTrustline(peer)
+	host.logHistory(peer, "Limit", "out", msg.Limit, "")
+	fmt.Printf("\n%s has accepted a limit of %d!\n", peer.PeerID, msg.Limit)
+	if tl.HostBalance > int(tl.HostLimit) {
+		fmt.Printf("They owe %d and are settling down to it\n", tl.HostBalance)
+	}
+	fmt.Print("> ")
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAsymmetricLimits(t *testing.T) {
+	chain := newMemChain()
+	alice := newTestHost(t, "alice", chain)
+	go alice.stateManager()
+	bob := newTestHost(t, "bob", chain)
+	go bob.stateManager()
+	_, pi := listen(t, bob)
+
+	if err := alice.createConnection("bob", pi); err != nil {
+		t.Fatal(err)
+	}
+	alice.outbound <- &Message{HostID: "alice", PeerID: "bob", Type: "Propose", Limit: 30}
+	// Bob only extends 10, like answering "y 10"
+	var prop *Proposal
+	waitFor(t, bob, func() bool {
+		if bob.urgentcmd.Head() == nil {
+			return false
+		}
+		prop = bob.urgentcmd.Dequeue().(*Proposal)
+		prop.peer.PeerID = prop.msg.HostID
+		prop.peer.trustline = &Trustline{HostLimit: 10, PeerLimit: prop.msg.Limit}
+		prop.peer.pending = false
+		bob.peerIDtoPeer[prop.msg.HostID] = prop.peer
+		return true
+	})
+	if prop.msg.Limit != 30 {
+		t.Fatalf("proposed limit %d", prop.msg.Limit)
+	}
+	bob.outbound <- &Message{HostID: "bob", PeerID: "alice", Type: "ProposeAccept", Limit: 10}
+	waitFor(t, alice, func() bool { return !alice.peerIDtoPeer["bob"].pending })
+	var tl Trustline
+	alice.run(func() { tl = *alice.peerIDtoPeer["bob"].trustline })
+	if tl.HostLimit != 30 || tl.PeerLimit != 10 {
+		t.Fatalf("alice agreed to %d/%d", tl.HostLimit, tl.PeerLimit)
+	}
+
+	// Over what bob extends: alice doesn't even send it
+	alice.outbound <- &Message{HostID: "alice", PeerID: "bob", Type: "Pay", Amount: 11}
+	alice.outbound <- &Message{HostID: "alice", PeerID: "bob", Type: "Pay", Amount: 10}
+	waitFor(t, bob, func() bool { return bob.peerIDtoPeer["alice"].trustline.HostBalance == 10 })
+	waitFor(t, alice, func() bool {
+		tl := alice.peerIDtoPeer["bob"].trustline
+		return tl.PeerBalance == 10 && len(tl.Pending) == 0 && tl.SendSeq == 1
+	})
+	// Bob can still run up to 40 the other way
+	bob.outbound <- &Message{HostID: "bob", PeerID: "alice", Type: "Pay", Amount: 40}
+	waitFor(t, alice, func() bool { return alice.peerIDtoPeer["bob"].trustline.HostBalance == 30 })
+}
+
+func TestReceiverEnforcesLimit(t *testing.T) {
+	host := newTestHost(t, "alice", newMemChain())
+	go host.stateManager()
+	bob := testPeer(host, "bob")
+
+	host.inbound <- &Message{HostID: "bob", PeerID: "alice", Type: "Pay", Amount: defaultTrustlineLimit + 1, ID: "big", Seq: 1}
+	if msg := next(bob); msg.Type != "Reject" || msg.Code != rejectOverLimit || msg.ID != "big" {
+		t.Fatalf("over the limit: %+v", msg)
+	}
+	host.inbound <- &Message{HostID: "bob", PeerID: "alice", Type: "Pay", Amount: defaultTrustlineLimit, ID: "full", Seq: 2}
+	if msg := next(bob); msg.Type != "PayAck" {
+		t.Fatalf("up to the limit: %+v", msg)
+	}
+}
+
+func TestPayHeldForSettlement(t *testing.T) {
+	chain := newMemChain()
+	chain.Register("alice", 100, "pw", PeerInfo{})
+	chain.Register("bob", 0, "pw", PeerInfo{})
+	host := newTestHost(t, "alice", chain)
+	go host.stateManager()
+	bob := testPeer(host, "bob")
+
+	host.outbound <- &Message{HostID: "alice", PeerID: "bob", Type: "Pay", Amount: defaultTrustlineLimit}
+	ackPay(t, host, bob)
+	host.outbound <- &Message{HostID: "alice", PeerID: "bob", Type: "Settle", Amount: 50}
+	settle := next(bob)
+	if settle.Type != "Settle" {
+		t.Fatalf("peer got %+v", settle)
+	}
+	// Bob still counts the settled 50 as debt until he has seen it
+	host.outbound <- &Message{HostID: "alice", PeerID: "bob", Type: "Pay", Amount: 30}
+	waitFor(t, host, func() bool { return len(host.held["bob"]) == 1 })
+
+	host.inbound <- &Message{HostID: "bob", PeerID: "alice", Type: "SettleAck", Amount: 50, ID: settle.ID}
+	if msg := next(bob); msg.Type != "Pay" || msg.Amount != 30 {
+		t.Fatalf("held payment not sent: %+v", msg)
+	}
+}
+
+// answerPrompt takes the next prompt on host off the queue, like the REPL.
+func answerPrompt(t *testing.T, host *Host) *Proposal {
+	t.Helper()
+	var prop *Proposal
+	waitFor(t, host, func() bool {
+		if host.urgentcmd.Head() == nil {
+			return false
+		}
+		prop = host.urgentcmd.Dequeue().(*Proposal)
+		return true
+	})
+	return prop
+}
+
+func TestPayCommandOverLimit(t *testing.T) {
+	host := newTestHost(t, "alice", newMemChain())
+	go host.stateManager()
+	bob := testPeer(host, "bob")
+
+	// Owing more than the limit, after bob lowered it
+	host.run(func() { bob.trustline.HostBalance, bob.trustline.PeerBalance = -120, 120 })
+	msgs := payCommand(host, "bob", 10)
+	if len(msgs) != 2 || msgs[0].Type != "Settle" || msgs[0].Amount != 120 || msgs[1].Type != "Pay" || msgs[1].Amount != 10 {
+		t.Fatalf("queued %+v", msgs)
+	}
+	// Within the limit, just the payment
+	host.run(func() { bob.trustline.HostBalance, bob.trustline.PeerBalance = -20, 20 })
+	if msgs := payCommand(host, "bob", 10); len(msgs) != 1 || msgs[0].Type != "Pay" || msgs[0].Amount != 10 {
+		t.Fatalf("queued %+v", msgs)
+	}
+	// No trustline, routed
+	if msgs := payCommand(host, "carol", 10); len(msgs) != 1 || msgs[0].Type != "Prepare" {
+		t.Fatalf("queued %+v", msgs)
+	}
+}
+
+func TestLimitChange(t *testing.T) {
+	defer func(i time.Duration) { settleCheckInterval = i }(settleCheckInterval)
+	settleCheckInterval = 5 * time.Millisecond
+	chain := newMemChain()
+	chain.Register("bob", 100, "pw", PeerInfo{})
+	alice := newTestHost(t, "alice", chain)
+	go alice.stateManager()
+	bob := newTestHost(t, "bob", chain)
+	go bob.stateManager()
+	_, pi := listen(t, bob)
+
+	if err := alice.createConnection("bob", pi); err != nil {
+		t.Fatal(err)
+	}
+	alice.outbound <- &Message{HostID: "alice", PeerID: "bob", Type: "Propose", Limit: defaultTrustlineLimit}
+	acceptProposal(t, bob)
+	waitFor(t, alice, func() bool { return !alice.peerIDtoPeer["bob"].pending })
+	bob.outbound <- &Message{HostID: "bob", PeerID: "alice", Type: "Pay", Amount: 60}
+	waitFor(t, bob, func() bool { return bob.peerIDtoPeer["alice"].trustline.PeerBalance == 60 })
+
+	// Bob turns a change down, nothing changes
+	alice.outbound <- &Message{HostID: "alice", PeerID: "bob", Type: "Limit", Limit: 200}
+	if prop := answerPrompt(t, bob); prop.msg.Type != "Limit" || prop.msg.Limit != 200 {
+		t.Fatalf("bob was asked %+v", prop.msg)
+	}
+	bob.outbound <- &Message{HostID: "bob", PeerID: "alice", Type: "LimitReject", Limit: 200, Reason: "rejected"}
+	waitFor(t, alice, func() bool { return len(alice.limitReqs) == 0 })
+
+	// Lowered under what bob owes: bob settles the 40 over it
+	alice.outbound <- &Message{HostID: "alice", PeerID: "bob", Type: "Limit", Limit: 20}
+	answerPrompt(t, bob)
+	bob.outbound <- &Message{HostID: "bob", PeerID: "alice", Type: "LimitAccept", Limit: 20}
+	waitFor(t, alice, func() bool {
+		tl := alice.peerIDtoPeer["bob"].trustline
+		return tl.HostLimit == 20 && tl.HostBalance == 20
+	})
+	var tl Trustline
+	bob.run(func() { tl = *bob.peerIDtoPeer["alice"].trustline })
+	if tl.PeerLimit != 20 || tl.PeerBalance != 20 || tl.HostLimit != defaultTrustlineLimit {
+		t.Fatalf("bob ended up with %+v", tl)
+	}
+	if bal, _ := chain.Balance("alice"); bal != 40 {
+		t.Fatalf("alice has %d on chain", bal)
+	}
+}
+
+func TestLimitSettlesUnanswered(t *testing.T) {
+	chain := newMemChain()
+	chain.Register("alice", 100, "pw", PeerInfo{})
+	chain.Register("bob", 0, "pw", PeerInfo{})
+	host := newTestHost(t, "alice", chain)
+	go host.stateManager()
+	bob := testPeer(host, "bob")
+
+	// Bob may count the payment and HTLC he hasn't answered as owed too
+	host.run(func() {
+		tl := bob.trustline
+		tl.HostBalance, tl.PeerBalance = -40, 40
+		tl.Pending = []*PendingPay{{ID: "p", Amount: 10, Seq: 1, Sent: time.Now()}}
+		tl.putHTLC(&HTLC{ID: "h", Amount: 5, Expiry: time.Now().Add(time.Hour), Out: true, Path: []string{"alice", "bob"}})
+		host.acceptLimit(bob, &Message{HostID: "alice", PeerID: "bob", Type: "LimitAccept", Limit: 20})
+	})
+	if msg := next(bob); msg.Type != "LimitAccept" {
+		t.Fatalf("peer got %+v", msg)
+	}
+	if msg := next(bob); msg.Type != "Settle" || msg.Amount != 35 {
+		t.Fatalf("peer got %+v", msg)
+	}
+}
+
+func TestUnaskedLimitAnswerDropped(t *testing.T) {
+	host := newTestHost(t, "alice", newMemChain())
+	go host.stateManager()
+	bob := testPeer(host, "bob")
+
+	host.outbound <- &Message{HostID: "alice", PeerID: "bob", Type: "Limit", Limit: 50}
+	if msg := next(bob); msg.Type != "Limit" || msg.Limit != 50 {
+		t.Fatalf("peer got %+v", msg)
+	}
+	// Bob can't accept a bigger limit than alice asked for
+	host.inbound <- &Message{HostID: "bob", PeerID: "alice", Type: "LimitAccept", Limit: 500}
+	host.inbound <- &Message{HostID: "bob", PeerID: "alice", Type: "LimitAccept", Limit: 50}
+	waitFor(t, host, func() bool { return bob.trustline.HostLimit != defaultTrustlineLimit })
+	if bob.trustline.HostLimit != 50 {
+		t.Fatalf("limit is %d", bob.trustline.HostLimit)
+	}
+}
+
+func TestParseProposeArgs(t *testing.T) {
+	if id, limit, err := parseProposeArgs([]string{"bob"}); err != nil || id != "bob" || limit != defaultTrustlineLimit {
+		t.Errorf("got %q %d %v", id, limit, err)
+	}
+	if id, limit, err := parseProposeArgs([]string{"bob", "--limit", "25"}); err != nil || id != "bob" || limit != 25 {
+		t.Errorf("got %q %d %v", id, limit, err)
+	}
+	for _, args := range [][]string{{"--limit", "5"}, {"bob", "--limit"}, {"bob", "--limit", "-1"}} {
+		if _, _, err := parseProposeArgs(args); err == nil {
+			t.Errorf("%v accepted", args)
+		}
+	}
+}
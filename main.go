@@ -2,22 +2,27 @@ package main
 
 import (
 	"bufio"
+	"crypto/ed25519"
 	"fmt"
 	"log"
+	"math"
 	"net"
+	"net/http"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/oleiade/lane"
 	"github.com/urfave/cli"
 )
 
-// bufSize is the size of the buffers for receiving and sending messages
+// bufSize is the size of the buffers for receiving messages
 const bufSize = 4096
 const defaultPort = 12345
+const defaultFakechainPort = 5000
 const candidate = "akash"
-const trustlineLimit = 100
 
 func startClient(host *Host) {
 	// Send loop
@@ -33,154 +38,190 @@ func startClient(host *Host) {
 		case "pay":
 			// example: pay Bob 10
 			if len(s) == 3 {
-				peerID := s[1]
-				if peer, exists := host.peerIDtoPeer[peerID]; exists {
-					amt, err := strconv.ParseUint(s[2], 10, 32)
-					if err != nil {
-						fmt.Println(err)
-						continue
-					}
-					if amt > trustlineLimit {
-						fmt.Printf("Err: Payment of %d exceeds trustline limit of %d\n", amt, trustlineLimit)
-						continue
-					}
-					if !peer.pending {
-						// TODO: Messages are bundling up, need to fix
-						bal := peer.trustline.PeerBalance
-						newBal := bal + int(amt)
-						if newBal > trustlineLimit {
-							// Send the amount that will increase the balance to 100
-							payment := trustlineLimit - bal
-							msgPay := Message{host.Name, peerID, "Pay", uint32(payment)}
-							fmt.Printf("Payment of %d (trustlineLimit) with %s queued\n", trustlineLimit, peerID)
-							host.outbound <- &msgPay
-
-							// Settle on the blockchain
-							msgSettle := Message{host.Name, peerID, "Settle", trustlineLimit}
-							fmt.Printf("Settlement with %s queued\n", peerID)
-							host.outbound <- &msgSettle
-
-							// Send the remaining amount
-							remainder := newBal - trustlineLimit
-							amt = uint64(remainder)
-						}
-						msg := Message{host.Name, peerID, "Pay", uint32(amt)}
-						fmt.Printf("Payment of %d with %s queued\n", amt, peerID)
-						host.outbound <- &msg
-					} else {
-						fmt.Printf("Err: Connection with %s is waiting to be accepted.\n", peerID)
-					}
-				} else {
-					fmt.Printf("Err: Connection with %s does not exists.\n", peerID)
+				amt, err := strconv.ParseUint(s[2], 10, 32)
+				if err != nil {
+					fmt.Println(err)
+					continue
 				}
+				queue(host, payCommand(host, s[1], uint32(amt)))
 			}
 		case "settle":
 			// example: settle Bob 20
 			// only the person with debt can settle. (i.e. negative balance)
 			if len(s) == 3 {
 				peerID := s[1]
-				if peer, exists := host.peerIDtoPeer[peerID]; exists {
-					amt, err := strconv.ParseUint(s[2], 10, 32)
-					if err != nil {
-						fmt.Println(err)
-						continue
-					}
-					if peer.trustline.HostBalance >= 0 {
-						fmt.Printf("Err: Nothing to settle as HostBalance is %d - your peer must settle!\n", peer.trustline.HostBalance)
-					} else {
-						if !peer.pending {
-							msg := Message{host.Name, peerID, "Settle", uint32(amt)}
-							fmt.Printf("Settlement with %s queued\n", peerID)
-							host.outbound <- &msg
-						} else {
-							fmt.Printf("Err: Connection with %s is waiting to be accepted.\n", peerID)
-						}
+				var found, pending bool
+				var bal int
+				host.run(func() {
+					if peer, exists := host.peerIDtoPeer[peerID]; exists && peer.trustline != nil {
+						found, pending, bal = true, peer.pending, peer.trustline.HostBalance
 					}
+				})
+				if !found {
+					fmt.Printf("Err: No trustline with %s.\n", peerID)
+					continue
+				}
+				amt, err := strconv.ParseUint(s[2], 10, 32)
+				if err != nil {
+					fmt.Println(err)
+				} else if bal >= 0 {
+					fmt.Printf("Err: Nothing to settle as HostBalance is %d - your peer must settle!\n", bal)
+				} else if pending {
+					fmt.Printf("Err: Connection with %s is waiting to be accepted.\n", peerID)
 				} else {
-					fmt.Printf("Err: Connection with %s does not exists.\n", peerID)
+					msg := Message{HostID: host.Name, PeerID: peerID, Type: "Settle", Amount: uint32(amt)}
+					fmt.Printf("Settlement with %s queued\n", peerID)
+					host.outbound <- &msg
 				}
 			}
 		case "propose":
 			// same as open_trustline
-			// example: propose Bob
+			// example: propose Bob --limit 50
 			// look up PeerID, obtain connection details
-			if len(s) == 2 {
-				peerID := s[1]
-				if _, exists := host.peerIDtoPeer[peerID]; !exists {
-					ud := getUsers()
-					for id, info := range ud {
-						if id == peerID {
-							err := host.createConnection(peerID, &info.PeerInfo)
-							if err != nil {
-								fmt.Println(err)
-							} else {
-								msg := Message{host.Name, peerID, "Propose", 0}
-								fmt.Println("Propose queued.")
-								host.outbound <- &msg
-							}
-						}
+			if len(s) >= 2 {
+				peerID, limit, err := parseProposeArgs(s[1:])
+				if err != nil {
+					fmt.Println(err)
+					continue
+				}
+				var exists, online bool
+				host.run(func() {
+					var known *Peer
+					known, exists = host.peerIDtoPeer[peerID]
+					online = exists && known.online()
+				})
+				if online {
+					fmt.Printf("Err: Connection with %s already exists.\n", peerID)
+					continue
+				}
+				// The address book, the DHT or the chain
+				pi, err := host.resolve(peerID)
+				if err != nil {
+					fmt.Println(err)
+					continue
+				}
+				if exists {
+					// Known trustline, pick it up where we left off
+					if err := host.reconnect(peerID, pi); err != nil {
+						fmt.Println(err)
+					} else {
+						fmt.Println("Resume queued.")
 					}
+				} else if err := host.createConnection(peerID, pi); err != nil {
+					fmt.Println(err)
 				} else {
-					fmt.Printf("Err: Connection with %s already exists.\n", peerID)
+					msg := Message{HostID: host.Name, PeerID: peerID, Type: "Propose", Amount: 0, Limit: limit}
+					fmt.Println("Propose queued.")
+					host.outbound <- &msg
 				}
 			}
+		case "limit":
+			// example: limit Bob 50
+			// asks Bob to agree to a new limit on the credit we extend him
+			if len(s) != 3 {
+				fmt.Println("usage: limit <peerID> <limit>")
+				continue
+			}
+			limit, err := parseLimit(s[2])
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			var online bool
+			host.run(func() {
+				peer, exists := host.peerIDtoPeer[s[1]]
+				online = exists && peer.online()
+			})
+			if !online {
+				fmt.Printf("Err: %s is not connected.\n", s[1])
+			} else {
+				msg := Message{HostID: host.Name, PeerID: s[1], Type: "Limit", Limit: limit}
+				fmt.Println("Limit change queued.")
+				host.outbound <- &msg
+			}
+		case "clear":
+			// nets out debt that goes around in a circle
+			host.run(func() { host.clearCycles(true) })
+		case "peers":
+			// the address book
+			displayPeers(host.book.all())
+			if host.dht != nil {
+				contacts, records := host.dht.size()
+				fmt.Printf("DHT: %d nodes known, %d records stored\n", contacts, records)
+			}
+		case "graph":
+			// trustlines we know of and how much can be paid over them
+			var edges []Edge
+			host.run(func() { edges = host.graphEdges() })
+			displayGraph(edges)
 		case "balance":
-			displayTrustlineBalances(host)
+			host.run(func() { displayTrustlineBalances(host) })
+		case "history":
+			// example: history Bob --since 24h --limit 10
+			peerID, since, limit, err := parseHistoryArgs(s[1:])
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			var entries []historyEntry
+			host.run(func() { entries = host.history.query(peerID, since, limit) })
+			displayHistory(entries)
+		case "export":
+			// example: export Bob bob-state.json
+			if len(s) < 2 || len(s) > 3 {
+				fmt.Println("usage: export <peerID> [file]")
+				continue
+			}
+			path := ""
+			if len(s) == 3 {
+				path = s[2]
+			}
+			if err := exportState(host, s[1], path); err != nil {
+				fmt.Println(err)
+			}
 		case "users":
 			// print users on the FakeChain
-			ud := getUsers()
+			ud, err := host.chain.Users()
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
 			printPeerDetails(ud)
 		case "delete":
 			// delete all users on the FakeChain
-			deleteUsers()
-		case "y":
-			if host.urgentcmd.Head() != nil {
-				p := host.urgentcmd.Dequeue()
-				prop := p.(*Proposal)
-				prop.peer.PeerID = prop.msg.HostID
-				prop.peer.trustline = &Trustline{0, 0}
-				prop.peer.pending = false
-				host.peerIDtoPeer[prop.msg.HostID] = prop.peer
-				msg := Message{host.Name, prop.msg.HostID, "ProposeAccept", 0}
-				host.outbound <- &msg
+			if err := host.chain.Reset(); err != nil {
+				fmt.Println(err)
+			} else {
+				fmt.Println("All users deleted")
 			}
+		case "y":
+			// example: y 50 to extend 50 instead of the proposed limit
+			queue(host, answerProposal(host, true, s[1:]))
 		case "n":
-			if host.urgentcmd.Head() != nil {
-				p := host.urgentcmd.Dequeue()
-				prop := p.(*Proposal)
-				host.peerIDtoPeer[prop.msg.HostID] = prop.peer
-				msg := Message{host.Name, prop.msg.HostID, "ProposeReject", 0}
-				host.outbound <- &msg
-			}
+			queue(host, answerProposal(host, false, nil))
 		case "exit":
 			fmt.Println("Exiting...")
-			bal := int(host.Balance)
-			// TODO: Could prevent the host from accumulating more debt than it
-			// can handle by keeping track of trustline debt in the host, and
-			// then preventing pays
-			// For now, we just settle what we can if the trustline debt exceeds
-			// what we have on Fakechain
-			for id, peer := range host.peerIDtoPeer {
-				if peer.trustline.HostBalance < 0 {
-					if bal-peer.trustline.PeerBalance > 0 {
-						msg := Message{host.Name, id, "Settle", uint32(peer.trustline.PeerBalance)}
-						fmt.Printf("Settlement with %s queued\n", id)
-						host.outbound <- &msg
-						bal -= peer.trustline.PeerBalance
-					} else {
-						fmt.Printf("Err: Insufficient balance to settle with %s\n", id)
-					}
-				}
+			chainBal, err := host.chain.Balance(host.Name)
+			if err != nil {
+				fmt.Println(err)
 			}
+			queue(host, exitSettlements(host, int(chainBal)))
 			// TODO: Should notify the other party to shutdown, perhaps create
 			// new message type of SettleClose?
 			os.Exit(1)
 		default:
 			fmt.Println("Command options:")
-			fmt.Println("pay <peerID> <amount> - pays peerID the amount in a trustline")
+			fmt.Println("pay <peerID> <amount> - pays peerID the amount in a trustline, or through peers if there's none")
 			fmt.Println("settle <peerID> <amount> - settles amount on Fakechain with peerID for trustline")
-			fmt.Println("propose <peerID> - proposes a trustline to peerID")
+			fmt.Println("propose <peerID> [--limit N] - proposes a trustline to peerID, extending N credit")
+			fmt.Println("y [limit] - accepts a proposal, extending the proposed limit or your own")
+			fmt.Println("limit <peerID> <limit> - asks peerID to agree to a new limit on the credit you extend")
+			fmt.Println("clear - nets out debt that goes around a cycle of trustlines")
+			fmt.Println("peers - lists the nodes in the address book and where they listen")
+			fmt.Println("graph - lists the trustlines known for routing and their capacity")
 			fmt.Println("balance - displays peerID and corresponding trustline balance")
+			fmt.Println("history [peerID] [--since TIME] [--limit N] - lists trustline events")
+			fmt.Println("export <peerID> [file] - prints or saves the last state both sides signed")
 			fmt.Println("users - query Fakechain for user information")
 			fmt.Println("exit - settle as much debt as possible and exit")
 			fmt.Println("delete - deletes all users")
@@ -188,11 +229,133 @@ func startClient(host *Host) {
 	}
 }
 
-func startService(name string, balance uint32, port uint16, isLocal bool) {
-	fmt.Println("Starting...")
-	reader := bufio.NewReader(os.Stdin)
-	queue := lane.NewQueue()
-	host := Host{
+// queue hands msgs to the stateManager to send, in order.
+func queue(host *Host, msgs []*Message) {
+	for _, msg := range msgs {
+		host.outbound <- msg
+	}
+}
+
+// payCommand works out what "pay" sends: a payment over the trustline with
+// peerID, or one routed through peers that have one if there's none. The
+// checks run on the stateManager.
+func payCommand(host *Host, peerID string, amt uint32) []*Message {
+	var msgs []*Message
+	host.run(func() {
+		// A peer that only connected has no trustline yet
+		peer, exists := host.peerIDtoPeer[peerID]
+		if !exists || peer.trustline == nil {
+			msgs = append(msgs, &Message{HostID: host.Name, PeerID: peerID, Type: "Prepare", Amount: amt})
+			fmt.Printf("Payment of %d to %s queued, looking for a route\n", amt, peerID)
+			return
+		}
+		limit := int(peer.trustline.PeerLimit)
+		switch {
+		case !peer.online():
+			fmt.Printf("Err: %s is offline.\n", peerID)
+		case peer.pending:
+			fmt.Printf("Err: Connection with %s is waiting to be accepted.\n", peerID)
+		case int(amt) > limit:
+			fmt.Printf("Err: Payment of %d exceeds trustline limit of %d\n", amt, limit)
+		default:
+			// Over the limit, settle what we owe first. The payment waits
+			// in withinLimit until the settlement clears, or is refused if
+			// it still doesn't fit.
+			if owed := peer.trustline.PeerBalance; owed > 0 && host.exposure(peer)+int(amt) > limit {
+				msgs = append(msgs, &Message{HostID: host.Name, PeerID: peerID, Type: "Settle", Amount: uint32(owed)})
+				fmt.Printf("Settlement of %d with %s queued\n", owed, peerID)
+			}
+			msgs = append(msgs, &Message{HostID: host.Name, PeerID: peerID, Type: "Pay", Amount: amt})
+			fmt.Printf("Payment of %d with %s queued\n", amt, peerID)
+		}
+	})
+	return msgs
+}
+
+// answerProposal accepts or rejects the proposal at the head of the prompt,
+// and returns the answer to send. args may hold the limit to extend instead
+// of the proposed one.
+func answerProposal(host *Host, accept bool, args []string) []*Message {
+	var msgs []*Message
+	host.run(func() {
+		if host.urgentcmd.Head() == nil {
+			return
+		}
+		prop := host.urgentcmd.Head().(*Proposal)
+		id := prop.msg.HostID
+		if _, ok := host.peers[prop.peer]; !ok {
+			// Disconnected since it asked, there is no one to answer
+			host.urgentcmd.Dequeue()
+			fmt.Printf("Err: %s has disconnected, dropped its request.\n", id)
+			return
+		}
+		if prop.msg.Type == "Limit" {
+			host.urgentcmd.Dequeue()
+			if accept {
+				msgs = append(msgs, &Message{HostID: host.Name, PeerID: id, Type: "LimitAccept", Limit: prop.msg.Limit})
+			} else {
+				msgs = append(msgs, &Message{HostID: host.Name, PeerID: id, Type: "LimitReject", Limit: prop.msg.Limit, Reason: "rejected"})
+			}
+			return
+		}
+		if !accept {
+			host.urgentcmd.Dequeue()
+			host.peerIDtoPeer[id] = prop.peer
+			msgs = append(msgs, &Message{HostID: host.Name, PeerID: id, Type: "ProposeReject", Amount: 0})
+			return
+		}
+		limit := prop.msg.Limit
+		if len(args) == 1 {
+			var err error
+			if limit, err = parseLimit(args[0]); err != nil {
+				fmt.Println(err)
+				return
+			}
+		}
+		host.urgentcmd.Dequeue()
+		if prop.peer.trustline != nil {
+			// Never replace a trustline we have with a new one
+			fmt.Printf("Err: Already have a trustline with %s.\n", id)
+			return
+		}
+		prop.peer.PeerID = id
+		prop.peer.trustline = &Trustline{HostLimit: limit, PeerLimit: prop.msg.Limit}
+		prop.peer.pending = false
+		host.peerIDtoPeer[id] = prop.peer
+		msgs = append(msgs, &Message{HostID: host.Name, PeerID: id, Type: "ProposeAccept", Amount: 0, Limit: limit})
+	})
+	return msgs
+}
+
+// exitSettlements returns the settlements to send on exit, for as much of
+// our debt as the chain balance bal covers.
+func exitSettlements(host *Host, bal int) []*Message {
+	var msgs []*Message
+	// TODO: Could prevent the host from accumulating more debt than it can
+	// handle by keeping track of trustline debt in the host, and then
+	// preventing pays
+	// For now, we just settle what we can if the trustline debt exceeds what
+	// we have on Fakechain
+	host.run(func() {
+		for id, peer := range host.peerIDtoPeer {
+			if peer.trustline != nil && peer.trustline.HostBalance < 0 {
+				if bal-peer.trustline.PeerBalance > 0 {
+					msgs = append(msgs, &Message{HostID: host.Name, PeerID: id, Type: "Settle", Amount: uint32(peer.trustline.PeerBalance)})
+					fmt.Printf("Settlement with %s queued\n", id)
+					bal -= peer.trustline.PeerBalance
+				} else {
+					fmt.Printf("Err: Insufficient balance to settle with %s\n", id)
+				}
+			}
+		}
+	})
+	return msgs
+}
+
+// newHost creates a Host that settles over chain, with a fresh key. It does
+// not register on the chain or start listening.
+func newHost(name string, port uint16, chain Chain) *Host {
+	host := &Host{
 		Name:         name,
 		Port:         port,
 		peers:        make(map[*Peer]bool),
@@ -202,40 +365,185 @@ func startService(name string, balance uint32, port uint16, isLocal bool) {
 		proposal:     make(chan *Proposal),
 		register:     make(chan *Peer),
 		unregister:   make(chan *Peer),
-		urgentcmd:    queue,
-		Balance:      balance,
-		reader:       reader,
+		urgentcmd:    lane.NewQueue(),
+		chain:        chain,
+		reader:       bufio.NewReader(os.Stdin),
+		do:           make(chan func()),
+		balances:     make(chan *balanceReport),
+		held:         make(map[string][]*Message),
+		limitReqs:    make(map[string]uint32),
+		graph:        make(map[string]map[string]*Edge),
+		gossipRecv:   make(map[string]int),
+		keys:         make(map[string]ed25519.PublicKey),
+		keyLookups:   make(map[string]*keyLookup),
+		helloLookups: make(map[string]*keyLookup),
+		book:         newAddrBook(),
+		htlcDelta:    defaultHTLCDelta,
+		htlcGrace:    defaultHTLCGrace,
+		clearTried:   make(map[string]bool),
+	}
+	ferror(host.setKey(newKey())) // should never happen
+	return host
+}
+
+// A serviceConfig is how a node was asked to run, from the command line.
+type serviceConfig struct {
+	name       string
+	balance    uint32
+	port       uint16
+	local      bool
+	insecure   bool
+	transport  string
+	wsPort     uint16
+	maxPayment uint32
+	noClear    bool
+	clearEvery time.Duration
+	bootstrap  []string
+	peersFile  string
+	lan        bool
+	dht        bool
+	chain      Chain
+	dataDir    string
+}
+
+func startService(cfg *serviceConfig) {
+	fmt.Println("Starting...")
+	host := newHost(cfg.name, cfg.port, cfg.chain)
+	host.insecure = cfg.insecure
+	host.maxPayment = cfg.maxPayment
+	host.noClear = cfg.noClear
+	host.clearEvery = cfg.clearEvery
+
+	err := os.MkdirAll(cfg.dataDir, 0700)
+	if err == nil {
+		host.store, err = openStore(cfg.dataDir)
 	}
+	if err != nil {
+		fmt.Printf("Err: Could not open trustline store: %v\n", err)
+		return
+	}
+	key, err := loadKey(keyPath(cfg.dataDir))
+	if err == nil {
+		err = host.setKey(key)
+	}
+	if err != nil {
+		fmt.Printf("Err: Could not load node key: %v\n", err)
+		return
+	}
+	err = host.openAddrBook(cfg.dataDir)
+	if err == nil && cfg.peersFile != "" {
+		var n int
+		n, err = host.book.load(cfg.peersFile, true)
+		fmt.Printf("Loaded %d peers from %s\n", n, cfg.peersFile)
+	}
+	if err != nil {
+		fmt.Printf("Err: Could not load peers: %v\n", err)
+		return
+	}
+	// Without the chain, peers can still be found some other way
+	discovering := len(cfg.bootstrap) > 0 || cfg.peersFile != "" || cfg.lan || cfg.dht
 
 	fmt.Printf("Hi %s! We'll need a password for your Fakechain account.\n", host.Name)
 	host.setPassword()
-	host.setIP(isLocal)
-
-	addUser(host.Name, host.Balance, host.password, host.IP, host.Port)
-	fmt.Printf("User %s created and registered on FakeChain!\n", host.Name)
+	host.setIP(cfg.local)
 
 	var ip string
-	if !isLocal {
+	if !cfg.local {
 		ip = "0.0.0.0"
 	} else {
 		ip = host.IP
 	}
+	listenAddr := net.JoinHostPort(ip, strconv.Itoa(int(host.Port)))
+	switch cfg.transport {
+	case "tcp":
+	case "unix":
+		listenAddr, err = filepath.Abs(filepath.Join(cfg.dataDir, "node.sock"))
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		host.addr = "unix://" + listenAddr
+	default:
+		fmt.Printf("Err: Unknown transport %q\n", cfg.transport)
+		return
+	}
+	var wsAddr string
+	if cfg.wsPort != 0 {
+		wsAddr = net.JoinHostPort(ip, strconv.Itoa(int(cfg.wsPort))) + wsPath
+		host.addr = "ws://" + net.JoinHostPort(host.IP, strconv.Itoa(int(cfg.wsPort))) + wsPath
+	}
 
-	cstr := fmt.Sprintf("%s:%d", ip, host.Port)
-	addr, err := net.ResolveTCPAddr("tcp", cstr)
+	chainDown := false
+	err = host.chain.Register(host.Name, cfg.balance, host.password, host.peerInfo())
+	if err != nil && !discovering {
+		fmt.Printf("Err: Could not register %s: %v\n", host.Name, err)
+		return
+	} else if err != nil {
+		fmt.Printf("Err: Could not register %s, carrying on without FakeChain: %v\n", host.Name, err)
+		chainDown = true
+	} else {
+		fmt.Printf("User %s created and registered on FakeChain!\n", host.Name)
+	}
+	balanceNow, err := host.chain.Balance(host.Name)
+	host.chainBalance = balanceNow
+	if err != nil && !chainDown {
+		fmt.Printf("Err: Could not read balance of %s: %v\n", host.Name, err)
+		return
+	}
+
+	host.restoreTrustlines()
+	host.history, err = openHistory(historyPath(cfg.dataDir))
 	if err != nil {
-		panic(err)
+		fmt.Printf("Err: Could not open history: %v\n", err)
+		return
 	}
-	ln, err := net.ListenTCP("tcp", addr)
+	host.journal, err = openJournal(journalPath(cfg.dataDir))
+	if err == nil && chainDown {
+		// Only the chain can tell whether these went through
+		for _, e := range host.journal.unfinished() {
+			if e.State == settleIntent {
+				err = fmt.Errorf("settlement %s may have reached FakeChain, which is down", e.ID)
+			}
+		}
+	}
+	if err == nil {
+		err = host.replayJournal(balanceNow)
+	}
+	if err != nil {
+		fmt.Printf("Err: Could not open settlement journal: %v\n", err)
+		return
+	}
+
+	ln, err := transports[cfg.transport].Listen(listenAddr)
 	if err != nil {
 		fmt.Println(err)
+		return
 	}
 
-	fmt.Println("Set up complete, listening on " + cstr)
+	fmt.Println("Set up complete, listening on " + listenAddr)
+	if wsAddr != "" {
+		var wsln net.Listener
+		if cfg.wsPort == cfg.port && cfg.transport == "tcp" {
+			// One port for both, told apart by how connections open
+			ln, wsln = listenShared(ln, wsPath)
+		} else if wsln, err = transports["ws"].Listen(wsAddr); err != nil {
+			fmt.Println(err)
+			return
+		}
+		fmt.Println("Accepting WebSocket connections on " + host.addr)
+		go host.connectionListener(wsln)
+	}
+
+	if cfg.transport == "tcp" {
+		if err := host.startDiscovery(listenAddr, cfg.bootstrap, cfg.lan, cfg.dht); err != nil {
+			fmt.Printf("Err: Could not start peer discovery: %v\n", err)
+		}
+	}
 
 	go host.stateManager()
 	go host.connectionListener(ln)
-	startClient(&host)
+	go host.reconnectAll()
+	startClient(host)
 }
 
 func main() {
@@ -258,6 +566,87 @@ func main() {
 			Name:  "local, l",
 			Usage: "enable localhost connections only",
 		},
+		cli.BoolFlag{
+			Name:  "insecure",
+			Usage: "talk to peers unencrypted, for local debugging",
+		},
+		cli.StringFlag{
+			Name:  "transport",
+			Value: "tcp",
+			Usage: "listen on tcp, or unix for a socket in the data directory",
+		},
+		cli.UintFlag{
+			Name:  "ws-port",
+			Usage: "also accept WebSocket connections on `PORT_NUMBER`, which may be the --port, and have peers dial that",
+		},
+		cli.UintFlag{
+			Name:  "max-payment",
+			Usage: "refuse single payments from peers larger than `AMOUNT`",
+		},
+		cli.BoolFlag{
+			Name:  "no-clear",
+			Usage: "refuse to take part in clearing debt cycles",
+		},
+		cli.DurationFlag{
+			Name:  "clear-every",
+			Usage: "look for debt cycles to clear every `INTERVAL`, e.g. 10m",
+		},
+		cli.StringFlag{
+			Name:  "bootstrap",
+			Usage: "find peers through the nodes at `HOST:PORT,...`",
+		},
+		cli.StringFlag{
+			Name:  "peers",
+			Usage: "trust the peers in `FILE`, e.g. a peers.json from another node's data directory, and pin their keys",
+		},
+		cli.BoolFlag{
+			Name:  "lan",
+			Usage: "find peers on the local network over UDP multicast",
+		},
+		cli.BoolFlag{
+			Name:  "dht",
+			Usage: "find peers through a DHT run by the nodes, joined through --bootstrap",
+		},
+		cli.StringFlag{
+			Name:  "chain",
+			Value: "http",
+			Usage: "settlement backend: http (FakeChain), memory or file",
+		},
+		cli.StringFlag{
+			Name:  "ledger",
+			Value: "ledger.jsonl",
+			Usage: "`PATH` of the ledger file for --chain file",
+		},
+		cli.StringFlag{
+			Name:  "data-dir",
+			Value: "data",
+			Usage: "`DIR` to keep node state in, one subdirectory per username",
+		},
+		cli.StringFlag{
+			Name:        "fakechain",
+			Value:       destURL,
+			Usage:       "`URL` of the FakeChain server",
+			Destination: &destURL,
+		},
+	}
+
+	app.Commands = []cli.Command{
+		{
+			Name:  "fakechain-serve",
+			Usage: "run a local FakeChain server",
+			Flags: []cli.Flag{
+				cli.UintFlag{
+					Name:  "port, p",
+					Value: defaultFakechainPort,
+					Usage: "`PORT_NUMBER` to serve the FakeChain API on",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				addr := fmt.Sprintf(":%d", c.Uint("port"))
+				fmt.Println("FakeChain listening on " + addr)
+				return http.ListenAndServe(addr, NewFakechainServer())
+			},
+		},
 	}
 
 	app.Action = func(c *cli.Context) error {
@@ -268,11 +657,47 @@ func main() {
 			if err != nil {
 				return err
 			}
+			if !strings.HasSuffix(destURL, "/") {
+				destURL += "/"
+			}
 			if port > 0xFFFF {
 				return fmt.Errorf("port number %d is too high, should be below 65536", port)
 			}
+			if c.Uint("max-payment") > math.MaxUint32 {
+				return fmt.Errorf("max payment %d is too high", c.Uint("max-payment"))
+			}
+			if c.Uint("ws-port") > 0xFFFF {
+				return fmt.Errorf("port number %d is too high, should be below 65536", c.Uint("ws-port"))
+			}
+
+			chain, err := newChain(c.String("chain"), c.String("ledger"))
+			if err != nil {
+				return err
+			}
+
+			var bootstrap []string
+			if c.String("bootstrap") != "" {
+				bootstrap = strings.Split(c.String("bootstrap"), ",")
+			}
 
-			startService(name, uint32(balance), uint16(port), c.Bool("local"))
+			startService(&serviceConfig{
+				name:       name,
+				balance:    uint32(balance),
+				port:       uint16(port),
+				local:      c.Bool("local"),
+				insecure:   c.Bool("insecure"),
+				transport:  c.String("transport"),
+				wsPort:     uint16(c.Uint("ws-port")),
+				maxPayment: uint32(c.Uint("max-payment")),
+				noClear:    c.Bool("no-clear"),
+				clearEvery: c.Duration("clear-every"),
+				bootstrap:  bootstrap,
+				peersFile:  c.String("peers"),
+				lan:        c.Bool("lan"),
+				dht:        c.Bool("dht"),
+				chain:      chain,
+				dataDir:    filepath.Join(c.String("data-dir"), name),
+			})
 		}
 		return nil
 	}
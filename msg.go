@@ -1,33 +1,68 @@
 package main
 
 import (
-	"encoding/json"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 )
 
 // Message is a standard format to be sent and received
 // Command can be PROPOSE, PAY or SETTLE
 // Assumes nodes are stateful and keep track honestly
-// Can be expanded to have signatures
+// State is a trustline state record, see state.go
+// Sig is the sender's signature over the rest, see sign.go
+// ID identifies a payment or settlement across it and its ack
+// Limit is the credit the sender extends in Propose and ProposeAccept
+// Reason says why something was refused, and Code does so for a Reject, see reject.go
+// Path is a payment's route, see route.go, and Edges trustlines in the graph, see gossip.go
+// Hash, Expiry, Sealed and Preimage make up conditional payments, see htlc.go
+// Seq orders Pay and Settle messages on a trustline, see seq.go
+// Version, Types and Features are only set in the handshake, see handshake.go
 type Message struct {
-	HostID string `json:"host"`
-	PeerID string `json:"peer"`
-	Type   string `json:"type"`
-	Amount uint32 `json:"amt"`
+	HostID   string       `json:"host"`
+	PeerID   string       `json:"peer"`
+	Type     string       `json:"type"`
+	Amount   uint32       `json:"amt"`
+	Path     []string     `json:"path,omitempty"`
+	Edges    []*Edge      `json:"edges,omitempty"`
+	Hash     []byte       `json:"hash,omitempty"`
+	Expiry   int64        `json:"expiry,omitempty"`
+	Sealed   []byte       `json:"sealed,omitempty"`
+	Preimage []byte       `json:"preimage,omitempty"`
+	Limit    uint32       `json:"limit,omitempty"`
+	ID       string       `json:"id,omitempty"`
+	Seq      uint64       `json:"seq,omitempty"`
+	Code     string       `json:"code,omitempty"`
+	Reason   string       `json:"reason,omitempty"`
+	Version  int          `json:"version,omitempty"`
+	Types    []string     `json:"types,omitempty"`
+	Features []string     `json:"features,omitempty"`
+	State    *StateRecord `json:"state,omitempty"`
+	Sig      []byte       `json:"sig,omitempty"`
 }
 
+// newID returns a random identifier for settlements and messages
+func newID() string {
+	b := make([]byte, 8)
+	_, err := rand.Read(b)
+	ferror(err) // should never happen
+	return hex.EncodeToString(b)
+}
+
+// serialize returns msg as a frame, see codec.go
 func serialize(msg *Message) []byte {
-	mb, err := json.Marshal(msg)
+	mb, err := encodeFrame(msg)
 	ferror(err) // should never happen
 	return mb
 }
 
+// parseRawBytes decodes a single frame
 func parseRawBytes(b []byte) Message {
-	var m Message
-	err := json.Unmarshal(b, &m)
+	m, err := newFrameReader(bytes.NewReader(b)).Next()
 	if err != nil {
 		fmt.Println(err)
 		return Message{}
 	}
-	return m
+	return *m
 }
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// A PendingPay is a payment sent to the peer that it hasn't acknowledged yet.
+// It only counts toward the trustline once the PayAck arrives. One the peer
+// doesn't answer is sent again every payRetry while it is online, and given
+// up after payTries times. The last answersKept given up on are kept, so one
+// the peer credited and acks late still counts. Sent is when it last went out.
+type PendingPay struct {
+	ID     string
+	Amount uint32
+	Seq    uint64
+	Sent   time.Time
+	Tries  int `json:",omitempty"`
+}
+
+var (
+	payRetry = 30 * time.Second
+	payTries = 5
+)
+
+// A PayAnswer is how we answered a payment from the peer: a PayAck, or a
+// Reject if Code is set. It is saved along with the trustline the payment
+// changed, so a payment the peer sends again always gets the same answer.
+// Only the last answersKept are kept.
+type PayAnswer struct {
+	ID     string
+	Amount uint32
+	Code   string `json:",omitempty"`
+	Reason string `json:",omitempty"`
+}
+
+const answersKept = 256
+
+func (a *PayAnswer) reply(from string, to string) *Message {
+	if a.Code != "" {
+		return &Message{HostID: from, PeerID: to, Type: "Reject", Amount: a.Amount, ID: a.ID, Code: a.Code, Reason: a.Reason}
+	}
+	return &Message{HostID: from, PeerID: to, Type: "PayAck", Amount: a.Amount, ID: a.ID}
+}
+
+// answer returns how we answered the payment with id, or nil.
+func (tl *Trustline) answer(id string) *PayAnswer {
+	for _, a := range tl.Answers {
+		if a.ID == id {
+			return a
+		}
+	}
+	return nil
+}
+
+// answered keeps a, dropping the oldest answer past answersKept. Like
+// takePending, it rebuilds the slice.
+func (tl *Trustline) answered(a *PayAnswer) {
+	keep := tl.Answers
+	if len(keep) >= answersKept {
+		keep = keep[len(keep)-answersKept+1:]
+	}
+	answers := make([]*PayAnswer, 0, len(keep)+1)
+	tl.Answers = append(append(answers, keep...), a)
+}
+
+// pendingOut is the total of the payments waiting for an ack.
+func (tl *Trustline) pendingOut() uint32 {
+	var total uint32
+	for _, p := range tl.Pending {
+		total += p.Amount
+	}
+	return total
+}
+
+// takePending removes the pending payment with id. The slice is rebuilt rather
+// than changed in place since the store may still hold the old one.
+func (tl *Trustline) takePending(id string) (*PendingPay, bool) {
+	for i, p := range tl.Pending {
+		if p.ID == id {
+			rest := make([]*PendingPay, 0, len(tl.Pending)-1)
+			rest = append(rest, tl.Pending[:i]...)
+			tl.Pending = append(rest, tl.Pending[i+1:]...)
+			return p, true
+		}
+	}
+	return nil, false
+}
+
+// gaveUp keeps p among the payments given up on, dropping the oldest past
+// answersKept. Like takePending, it rebuilds the slice.
+func (tl *Trustline) gaveUp(p *PendingPay) {
+	keep := tl.GivenUp
+	if len(keep) >= answersKept {
+		keep = keep[len(keep)-answersKept+1:]
+	}
+	given := make([]*PendingPay, 0, len(keep)+1)
+	tl.GivenUp = append(append(given, keep...), p)
+}
+
+// takeGivenUp removes the payment with id from the ones given up on.
+func (tl *Trustline) takeGivenUp(id string) (*PendingPay, bool) {
+	for i, p := range tl.GivenUp {
+		if p.ID == id {
+			rest := make([]*PendingPay, 0, len(tl.GivenUp)-1)
+			rest = append(rest, tl.GivenUp[:i]...)
+			tl.GivenUp = append(rest, tl.GivenUp[i+1:]...)
+			return p, true
+		}
+	}
+	return nil, false
+}
+
+// pay sends a payment to peer. The balance only changes once the peer acks it.
+// Runs from the stateManager.
+func (host *Host) pay(peer *Peer, msg *Message) {
+	if !host.withinLimit(peer, msg) {
+		return
+	}
+	if msg.ID == "" {
+		msg.ID = newID()
+	}
+	tl := peer.trustline
+	tl.SendSeq++
+	msg.Seq = tl.SendSeq
+	tl.Pending = append(tl.Pending, &PendingPay{ID: msg.ID, Amount: msg.Amount, Seq: msg.Seq, Sent: time.Now()})
+	host.saveTrustline(peer)
+	if !host.sendTo(peer, msg) {
+		tl.takePending(msg.ID)
+		tl.SendSeq--
+		host.saveTrustline(peer)
+	}
+}
+
+// receivePay credits a payment from peer and acks it, or rejects it with the
+// reason it was refused, see reject.go. A payment we already answered gets
+// the same answer again, since the peer may have missed it; other replays are
+// dropped.
+func (host *Host) receivePay(peer *Peer, msg *Message) {
+	if peer.pending && !peer.resuming {
+		host.reject(peer, msg, rejectNoTrustline, "no open trustline")
+		return
+	}
+	tl := peer.trustline
+	if err := checkSeq(tl, msg.Seq); err != nil {
+		if a := tl.answer(msg.ID); a != nil && errors.Is(err, errReplayed) {
+			host.sendTo(peer, a.reply(host.Name, peer.PeerID))
+			return
+		}
+		// Trustlines saved before answers were kept
+		if errors.Is(err, errReplayed) && host.history != nil && host.history.seen(msg.ID) {
+			host.sendTo(peer, &Message{HostID: host.Name, PeerID: peer.PeerID, Type: "PayAck", Amount: msg.Amount, ID: msg.ID})
+			return
+		}
+		reportSeq(msg, err)
+		if !errors.Is(err, errReplayed) {
+			host.rejectSeq(peer, msg, err)
+		}
+		return
+	}
+	tl.RecvSeq = msg.Seq
+	code, reason := host.checkPay(peer, msg)
+	if code == "" {
+		tl.HostBalance += int(msg.Amount)
+		tl.PeerBalance -= int(msg.Amount)
+	}
+	a := &PayAnswer{ID: msg.ID, Amount: msg.Amount, Code: code, Reason: reason}
+	tl.answered(a)
+	host.saveTrustline(peer)
+	host.sendTo(peer, a.reply(host.Name, peer.PeerID))
+	if code != "" {
+		return
+	}
+	host.logHistory(peer, "Pay", "in", msg.Amount, msg.ID)
+	fmt.Printf("\n%s has paid you %d!\n", msg.HostID, msg.Amount)
+	fmt.Print("> ")
+	host.proposeState(peer)
+}
+
+// payAcked commits a pending payment once the peer has credited it. One we
+// gave up on is committed too if the ack is for the same amount: the peer
+// has credited it all the same.
+func (host *Host) payAcked(peer *Peer, msg *Message) {
+	tl := peer.trustline
+	late := false
+	p, ok := tl.takePending(msg.ID)
+	if !ok {
+		if p, ok = tl.takeGivenUp(msg.ID); !ok {
+			return
+		}
+		if p.Amount != msg.Amount {
+			tl.gaveUp(p)
+			fmt.Printf("\nErr: %s acked payment %s for %d, not %d; ignored\n", peer.PeerID, p.ID, msg.Amount, p.Amount)
+			fmt.Print("> ")
+			return
+		}
+		late = true
+	}
+	tl.HostBalance -= int(p.Amount)
+	tl.PeerBalance += int(p.Amount)
+	host.saveTrustline(peer)
+	host.logHistory(peer, "Pay", "out", p.Amount, p.ID)
+	if late {
+		fmt.Printf("\nPayment of %d to %s went through after all\n", p.Amount, peer.PeerID)
+	} else {
+		fmt.Printf("\nSent %d to %s\n", p.Amount, peer.PeerID)
+	}
+	fmt.Print("> ")
+}
+
+// retryPending sends payments the peer hasn't answered in payRetry again,
+// and gives up on ones it didn't answer payTries times. A payment given up on
+// frees its sequence number, which the peer catches up on with a resync, see
+// seq.go. Runs from the stateManager.
+func (host *Host) retryPending() {
+	now := time.Now()
+	for _, peer := range host.peerIDtoPeer {
+		if !peer.online() || peer.trustline == nil || peer.pending {
+			continue
+		}
+		tl := peer.trustline
+		for _, p := range tl.Pending {
+			if now.Sub(p.Sent) < payRetry {
+				continue
+			}
+			if p.Tries >= payTries {
+				tl.takePending(p.ID)
+				tl.gaveUp(p)
+				host.saveTrustline(peer)
+				fmt.Printf("\nErr: %s never answered payment of %d, gave up on it\n", peer.PeerID, p.Amount)
+				fmt.Print("> ")
+				continue
+			}
+			// Copied, since the store may still hold the old one
+			c := *p
+			c.Sent, c.Tries = now, p.Tries+1
+			tl.takePending(p.ID)
+			tl.Pending = append(tl.Pending, &c)
+			host.saveTrustline(peer)
+			host.sendTo(peer, &Message{HostID: host.Name, PeerID: peer.PeerID, Type: "Pay", Amount: c.Amount, ID: c.ID, Seq: c.Seq})
+		}
+	}
+}
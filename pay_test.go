@@ -0,0 +1,104 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPayWaitsForAck(t *testing.T) {
+	host := newTestHost(t, "alice", newMemChain())
+	go host.stateManager()
+	bob := testPeer(host, "bob")
+
+	host.outbound <- &Message{HostID: "alice", PeerID: "bob", Type: "Pay", Amount: 10}
+	pay := next(bob)
+	if pay.ID == "" {
+		t.Fatal("payment sent without an ID")
+	}
+	host.run(func() {
+		if tl := bob.trustline; tl.HostBalance != 0 || tl.pendingOut() != 10 {
+			t.Errorf("before the ack: balance %d, pending %d", tl.HostBalance, tl.pendingOut())
+		}
+	})
+
+	// Refused: dropped without touching the balance
+	host.outbound <- &Message{HostID: "alice", PeerID: "bob", Type: "Pay", Amount: 5}
+	refused := next(bob)
+	host.inbound <- &Message{HostID: "bob", PeerID: "alice", Type: "Reject", ID: refused.ID, Code: rejectOverLimit, Reason: "no"}
+	waitFor(t, host, func() bool { return bob.trustline.pendingOut() == 10 })
+
+	host.inbound <- &Message{HostID: "bob", PeerID: "alice", Type: "PayAck", ID: pay.ID}
+	// A duplicate ack changes nothing
+	host.inbound <- &Message{HostID: "bob", PeerID: "alice", Type: "PayAck", ID: pay.ID}
+	waitFor(t, host, func() bool { return len(bob.trustline.Pending) == 0 })
+	host.run(func() {
+		if bob.trustline.HostBalance != -10 || bob.trustline.PeerBalance != 10 {
+			t.Errorf("after the ack: %+v", bob.trustline)
+		}
+	})
+}
+
+func TestReceivePay(t *testing.T) {
+	host := newTestHost(t, "bob", newMemChain())
+	host.history, _ = openHistory(historyPath(t.TempDir()))
+	go host.stateManager()
+	alice := testPeer(host, "alice")
+
+	host.inbound <- &Message{HostID: "alice", PeerID: "bob", Type: "Pay", Amount: 10, ID: "p1", Seq: 1}
+	if msg := next(alice); msg.Type != "PayAck" || msg.ID != "p1" {
+		t.Fatalf("peer got %+v", msg)
+	}
+	// Resent after a lost ack: acked again, credited once
+	host.inbound <- &Message{HostID: "alice", PeerID: "bob", Type: "Pay", Amount: 10, ID: "p1", Seq: 1}
+	if msg := next(alice); msg.Type != "PayAck" || msg.ID != "p1" {
+		t.Fatalf("peer got %+v", msg)
+	}
+	// Refused, and refused again when resent
+	for i := 0; i < 2; i++ {
+		host.inbound <- &Message{HostID: "alice", PeerID: "bob", Type: "Pay", Amount: 0, ID: "p2", Seq: 2}
+		if msg := next(alice); msg.Type != "Reject" || msg.ID != "p2" || msg.Code != rejectAmount {
+			t.Fatalf("peer got %+v", msg)
+		}
+	}
+	host.run(func() {
+		if alice.trustline.HostBalance != 10 {
+			t.Errorf("HostBalance = %d, want 10", alice.trustline.HostBalance)
+		}
+	})
+}
+
+func TestPayRetried(t *testing.T) {
+	defer func(i, r time.Duration, n int) { settleCheckInterval, payRetry, payTries = i, r, n }(settleCheckInterval, payRetry, payTries)
+	settleCheckInterval, payRetry, payTries = 5*time.Millisecond, 10*time.Millisecond, 2
+
+	host := newTestHost(t, "alice", newMemChain())
+	go host.stateManager()
+	bob := testPeer(host, "bob")
+
+	// Bob never answers: sent again payTries times, then given up on
+	host.outbound <- &Message{HostID: "alice", PeerID: "bob", Type: "Pay", Amount: 10}
+	pay := next(bob)
+	for i := 0; i < payTries; i++ {
+		if msg := next(bob); msg.Type != "Pay" || msg.ID != pay.ID || msg.Seq != pay.Seq {
+			t.Fatalf("peer got %+v", msg)
+		}
+	}
+	waitFor(t, host, func() bool { return len(bob.trustline.Pending) == 0 })
+	host.run(func() {
+		if bob.trustline.HostBalance != 0 {
+			t.Errorf("HostBalance = %d, want 0", bob.trustline.HostBalance)
+		}
+	})
+
+	// Bob credited it after all and acks late: committed, but only for the
+	// amount sent
+	host.inbound <- &Message{HostID: "bob", PeerID: "alice", Type: "PayAck", Amount: 20, ID: pay.ID}
+	host.inbound <- &Message{HostID: "bob", PeerID: "alice", Type: "PayAck", Amount: 10, ID: pay.ID}
+	waitFor(t, host, func() bool { return bob.trustline.HostBalance == -10 })
+	host.inbound <- &Message{HostID: "bob", PeerID: "alice", Type: "PayAck", Amount: 10, ID: pay.ID}
+	host.run(func() {
+		if bob.trustline.HostBalance != -10 || bob.trustline.PeerBalance != 10 || len(bob.trustline.GivenUp) != 0 {
+			t.Errorf("after late ack: %+v", bob.trustline)
+		}
+	})
+}
@@ -0,0 +1,72 @@
+package main
+
+import "fmt"
+
+// A Reject refuses a payment, naming it by ID. Code says why in a form the
+// sender can act on and Reason in words. The sender drops the payment from
+// its pending ones, so its balance never moves.
+const (
+	rejectNoTrustline = "no_trustline"
+	rejectSequence    = "bad_sequence"
+	rejectMissingID   = "missing_id"
+	rejectAmount      = "invalid_amount"
+	rejectOverLimit   = "over_limit"
+	rejectTooLarge    = "too_large"
+	rejectDisputed    = "disputed"
+)
+
+// checkPay applies the agreed limit and our own policy to a payment from
+// peer. It returns the reject code and reason, or an empty code if the
+// payment can be credited.
+func (host *Host) checkPay(peer *Peer, msg *Message) (code string, reason string) {
+	tl := peer.trustline
+	switch {
+	case msg.ID == "":
+		return rejectMissingID, "missing payment ID"
+	case msg.Amount == 0:
+		return rejectAmount, "invalid amount"
+	case host.maxPayment > 0 && msg.Amount > host.maxPayment:
+		return rejectTooLarge, fmt.Sprintf("payments are capped at %d", host.maxPayment)
+	case host.disputed(peer.PeerID):
+		return rejectDisputed, "a settlement of yours is disputed"
+	case tl.HostBalance+int(tl.inFlight(false))+int(msg.Amount) > int(tl.HostLimit):
+		return rejectOverLimit, fmt.Sprintf("exceeds credit limit of %d", tl.HostLimit)
+	}
+	return "", ""
+}
+
+// disputed reports whether one of peerID's settlements never showed up on
+// the chain. No more credit is extended to it until that is sorted out.
+func (host *Host) disputed(peerID string) bool {
+	for _, s := range host.disputes {
+		if s.entry.PeerID == peerID {
+			return true
+		}
+	}
+	return false
+}
+
+func (host *Host) reject(peer *Peer, msg *Message, code string, reason string) {
+	reply := Message{HostID: host.Name, PeerID: peer.PeerID, Type: "Reject", Amount: msg.Amount, ID: msg.ID, Code: code, Reason: reason}
+	host.sendTo(peer, &reply)
+}
+
+// rejected drops a pending payment the peer refused. One refused for a
+// sequence gap is sent again instead, see seq.go.
+func (host *Host) rejected(peer *Peer, msg *Message) {
+	if msg.Code == rejectSequence && peer.resyncs() {
+		host.resync(peer, msg.Seq)
+		return
+	}
+	p, ok := peer.trustline.takePending(msg.ID)
+	if !ok {
+		// Nothing to undo for one we gave up on, just stop waiting for it
+		if _, ok := peer.trustline.takeGivenUp(msg.ID); ok {
+			host.saveTrustline(peer)
+		}
+		return
+	}
+	host.saveTrustline(peer)
+	fmt.Printf("\nErr: %s refused payment of %d (%s): %s\n", peer.PeerID, p.Amount, msg.Code, msg.Reason)
+	fmt.Print("> ")
+}
@@ -0,0 +1,40 @@
+package main
+
+import "testing"
+
+func TestRejectPolicy(t *testing.T) {
+	host := newTestHost(t, "bob", newMemChain())
+	host.maxPayment = 20
+	go host.stateManager()
+	alice := testPeer(host, "alice")
+
+	pay := func(seq uint64, amount uint32) Message {
+		host.inbound <- &Message{HostID: "alice", PeerID: "bob", Type: "Pay", Amount: amount, ID: newID(), Seq: seq}
+		return next(alice)
+	}
+	if msg := pay(1, 21); msg.Type != "Reject" || msg.Code != rejectTooLarge {
+		t.Fatalf("over the cap: %+v", msg)
+	}
+	// A modified peer can't run up debt past the limit in small steps
+	for i := uint64(2); i <= 6; i++ {
+		if msg := pay(i, 20); msg.Type != "PayAck" {
+			t.Fatalf("payment %d: %+v", i, msg)
+		}
+	}
+	if msg := pay(7, 1); msg.Type != "Reject" || msg.Code != rejectOverLimit {
+		t.Fatalf("over the limit: %+v", msg)
+	}
+
+	host.run(func() {
+		host.disputes = append(host.disputes, &inboundSettle{entry: &journalEntry{PeerID: "alice", Amount: 5}})
+		alice.trustline.HostBalance = 0
+	})
+	if msg := pay(8, 1); msg.Type != "Reject" || msg.Code != rejectDisputed {
+		t.Fatalf("with a dispute: %+v", msg)
+	}
+	host.run(func() {
+		if alice.trustline.HostBalance != 0 || alice.trustline.RecvSeq != 8 {
+			t.Errorf("rejected payment changed the trustline: %+v", alice.trustline)
+		}
+	})
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// A payment to someone we have no trustline with is routed through peers
+// that do, as a chain of conditional payments, see htlc.go. The sender picks
+// the whole path. Routes are searched over the trustlines we know of: our
+// own, and the ones in the graph other nodes gossip about, see gossip.go.
+
+const (
+	rejectBadRoute = "bad_route"
+	rejectNoRoute  = "no_route"
+)
+
+// openLinks returns the peers we have an open trustline with and can reach
+// now, sorted.
+func (host *Host) openLinks() []string {
+	var ids []string
+	for id, peer := range host.peerIDtoPeer {
+		if peer.online() && !peer.pending && peer.trustline != nil {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// neighbours returns who id can pay amount to, as far as we know, sorted.
+// Our own trustlines are checked when the payment is sent. Anyone can announce
+// an edge to anyone, so unless id is our neighbour, an edge only counts if
+// the far end announced one back.
+func (host *Host) neighbours(id string, amount uint32) []string {
+	if id == host.Name {
+		return host.openLinks()
+	}
+	known := contains(host.openLinks(), id)
+	var ids []string
+	for to, e := range host.graph[id] {
+		if e.Capacity == 0 || e.Capacity < amount || time.Since(e.time()) >= gossipExpiry {
+			continue
+		}
+		if back := host.edge(to, id); known || to == host.Name || back != nil && time.Since(back.time()) < gossipExpiry {
+			ids = append(ids, to)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// findRoute returns the shortest known path from us to peerID with room for
+// amount, both ends included, or nil if there is none.
+func (host *Host) findRoute(peerID string, amount uint32) []string {
+	return host.findPath(host.Name, peerID, "", amount)
+}
+
+// findPath returns the shortest known path between two nodes, both ends
+// included, that doesn't pass through skip and has room for amount, or nil
+// if there is none.
+func (host *Host) findPath(from string, to string, skip string, amount uint32) []string {
+	prev := map[string]string{from: ""}
+	queue := []string{from}
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+		if id == to {
+			var path []string
+			for ; id != ""; id = prev[id] {
+				path = append([]string{id}, path...)
+			}
+			return path
+		}
+		for _, n := range host.neighbours(id, amount) {
+			if _, seen := prev[n]; !seen && n != skip {
+				prev[n] = id
+				queue = append(queue, n)
+			}
+		}
+	}
+	return nil
+}
+
+// nextHop returns who a payment from peer goes to after us, or "" if it ends
+// here. It returns an error if we aren't on the path right after peer.
+func (host *Host) nextHop(peer *Peer, msg *Message) (string, error) {
+	for i := 1; i < len(msg.Path); i++ {
+		if msg.Path[i] != host.Name {
+			continue
+		}
+		if msg.Path[i-1] != peer.PeerID {
+			return "", fmt.Errorf("route doesn't come from %s", peer.PeerID)
+		}
+		if i == len(msg.Path)-1 {
+			return "", nil
+		}
+		return msg.Path[i+1], nil
+	}
+	return "", fmt.Errorf("route doesn't pass through %s", host.Name)
+}
+
+// checkRoute makes sure a payment from peer can go on to its next hop.
+func (host *Host) checkRoute(peer *Peer, msg *Message) (code string, reason string) {
+	next, err := host.nextHop(peer, msg)
+	if err != nil {
+		return rejectBadRoute, err.Error()
+	}
+	if next == "" {
+		return "", ""
+	}
+	p, ok := host.peerIDtoPeer[next]
+	switch {
+	case !ok || p.pending || p.trustline == nil:
+		return rejectNoRoute, fmt.Sprintf("%s has no trustline with %s", host.Name, next)
+	case !p.online():
+		return rejectNoRoute, fmt.Sprintf("%s is offline", next)
+	case host.exposure(p)+int(msg.Amount) > int(p.trustline.PeerLimit):
+		return rejectNoRoute, fmt.Sprintf("not enough credit from %s to %s", host.Name, next)
+	}
+	return "", ""
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// openTrustline has a propose a trustline to b and b accept it.
+func openTrustline(t *testing.T, a *Host, b *Host, pi *PeerInfo) {
+	t.Helper()
+	if err := a.createConnection(b.Name, pi); err != nil {
+		t.Fatal(err)
+	}
+	a.outbound <- &Message{HostID: a.Name, PeerID: b.Name, Type: "Propose", Limit: defaultTrustlineLimit}
+	acceptProposal(t, b)
+	waitFor(t, a, func() bool { return !a.peerIDtoPeer[b.Name].pending })
+}
+
+func TestRoutedPayment(t *testing.T) {
+	defer func(i time.Duration) { settleCheckInterval = i }(settleCheckInterval)
+	settleCheckInterval = 5 * time.Millisecond
+	chain := newMemChain()
+	alice := newTestHost(t, "alice", chain)
+	go alice.stateManager()
+	bob := newTestHost(t, "bob", chain)
+	go bob.stateManager()
+	carol := newTestHost(t, "carol", chain)
+	carol.maxPayment = 50
+	go carol.stateManager()
+	_, bobInfo := listen(t, bob)
+	_, carolInfo := listen(t, carol)
+	openTrustline(t, alice, bob, bobInfo)
+	openTrustline(t, bob, carol, carolInfo)
+
+	var route []string
+	waitFor(t, alice, func() bool {
+		route = alice.findRoute("carol", 0)
+		return route != nil
+	})
+	if !reflect.DeepEqual(route, []string{"alice", "bob", "carol"}) {
+		t.Fatalf("route %v", route)
+	}
+
+	balances := func(want int) {
+		t.Helper()
+		waitFor(t, alice, func() bool {
+			tl := alice.peerIDtoPeer["bob"].trustline
+			return tl.PeerBalance == want && tl.inFlight(true) == 0
+		})
+		waitFor(t, bob, func() bool {
+			return bob.peerIDtoPeer["alice"].trustline.inFlight(false) == 0 && bob.peerIDtoPeer["alice"].trustline.HostBalance == want &&
+				bob.peerIDtoPeer["carol"].trustline.PeerBalance == want
+		})
+		waitFor(t, carol, func() bool { return carol.peerIDtoPeer["bob"].trustline.HostBalance == want })
+	}
+
+	alice.outbound <- &Message{HostID: "alice", PeerID: "carol", Type: "Prepare", Amount: 10}
+	balances(10)
+	// Carol refuses it, and every hop is left as it was
+	alice.outbound <- &Message{HostID: "alice", PeerID: "carol", Type: "Prepare", Amount: 60}
+	balances(10)
+	// Bob can't pass it on, not enough credit from carol
+	bob.outbound <- &Message{HostID: "bob", PeerID: "carol", Type: "Pay", Amount: 45}
+	waitFor(t, bob, func() bool { return bob.peerIDtoPeer["carol"].trustline.PeerBalance == 55 })
+	alice.outbound <- &Message{HostID: "alice", PeerID: "carol", Type: "Prepare", Amount: 50}
+	waitFor(t, alice, func() bool { return alice.peerIDtoPeer["bob"].trustline.inFlight(true) == 0 })
+	waitFor(t, carol, func() bool { return carol.peerIDtoPeer["bob"].trustline.HostBalance == 55 })
+	alice.run(func() {
+		if tl := alice.peerIDtoPeer["bob"].trustline; tl.PeerBalance != 10 {
+			t.Errorf("alice owes bob %d", tl.PeerBalance)
+		}
+	})
+}
+
+func TestBadRouteRejected(t *testing.T) {
+	host := newTestHost(t, "bob", newMemChain())
+	go host.stateManager()
+	alice := testPeer(host, "alice")
+
+	host.inbound <- &Message{HostID: "alice", PeerID: "bob", Type: "Prepare", Amount: 5, ID: "r1", Seq: 1, Path: []string{"mallory", "bob", "carol"}}
+	if msg := next(alice); msg.Type != "Cancel" || msg.Code != rejectBadRoute {
+		t.Fatalf("route from someone else: %+v", msg)
+	}
+	host.inbound <- &Message{HostID: "alice", PeerID: "bob", Type: "Prepare", Amount: 5, ID: "r2", Seq: 2, Path: []string{"alice", "bob", "carol"}}
+	if msg := next(alice); msg.Type != "Cancel" || msg.Code != rejectNoRoute {
+		t.Fatalf("route to a stranger: %+v", msg)
+	}
+}
+
+// stalledChain is a chain whose lookups and payments hang until release is
+// closed.
+type stalledChain struct {
+	Chain
+	release chan struct{}
+}
+
+func (c stalledChain) Users() (map[string]PeerDetails, error) {
+	<-c.release
+	return c.Chain.Users()
+}
+
+func (c stalledChain) Pay(sender string, receiver string, password string, amount uint32, ref string) error {
+	<-c.release
+	return c.Chain.Pay(sender, receiver, password, amount, ref)
+}
+
+func TestRouteLooksUpKeyAside(t *testing.T) {
+	chain := newMemChain()
+	newTestHost(t, "carol", chain)
+	stalled := stalledChain{chain, make(chan struct{})}
+	alice := newTestHost(t, "alice", stalled)
+	go alice.stateManager()
+	bob := testPeer(alice, "bob")
+	alice.run(func() {
+		alice.putEdge(&Edge{From: "bob", To: "carol", Capacity: 100, Stamp: time.Now().UnixNano()})
+	})
+
+	// Carol's key is on the chain only, and the chain is slow to answer
+	alice.outbound <- &Message{HostID: "alice", PeerID: "carol", Type: "Prepare", Amount: 10}
+	done := make(chan struct{})
+	go func() {
+		alice.run(func() {})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("stateManager waited for the chain")
+	}
+	close(stalled.release)
+	if msg := next(bob); msg.Type != "Prepare" || msg.Amount != 10 || !reflect.DeepEqual(msg.Path, []string{"alice", "bob", "carol"}) {
+		t.Fatalf("peer got %+v", msg)
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// Pay and Settle messages carry a sequence number per trustline and
+// direction. Each side only applies the one after the last it received, so a
+// duplicated or replayed frame is caught instead of applied twice. Resent
+// messages keep their original number.
+//
+// A message that skips a number is refused with bad_sequence, carrying the
+// last number the receiver got. If both sides support resyncFeature, the
+// sender then numbers everything the peer hasn't acknowledged again from
+// there, closing the gap, and sends it all again.
+
+const resyncFeature = "seq-resync"
+
+var errReplayed = errors.New("replayed")
+
+// checkSeq tells whether seq is the next sequence number expected on tl.
+func checkSeq(tl *Trustline, seq uint64) error {
+	switch {
+	case seq <= tl.RecvSeq:
+		return fmt.Errorf("%w: sequence number %d was already received", errReplayed, seq)
+	case seq > tl.RecvSeq+1:
+		return fmt.Errorf("expected sequence number %d, got %d", tl.RecvSeq+1, seq)
+	}
+	return nil
+}
+
+func reportSeq(msg *Message, err error) {
+	fmt.Printf("\nErr: Dropped %s %s from %s: %v\n", msg.Type, msg.ID, msg.HostID, err)
+	fmt.Print("> ")
+}
+
+// rejectSeq refuses a message from peer that skipped a sequence number.
+func (host *Host) rejectSeq(peer *Peer, msg *Message, err error) {
+	typ := "Reject"
+	if msg.Type == "Prepare" {
+		typ = "Cancel"
+	}
+	reply := Message{HostID: host.Name, PeerID: peer.PeerID, Type: typ, Amount: msg.Amount, ID: msg.ID, Code: rejectSequence, Reason: err.Error(), Seq: peer.trustline.RecvSeq}
+	host.sendTo(peer, &reply)
+}
+
+// resyncs reports whether peer renumbers its messages after a gap. Peers
+// that never went through a handshake are assumed to.
+func (peer *Peer) resyncs() bool {
+	return peer.features == nil || peer.features[resyncFeature]
+}
+
+// resync numbers the messages peer hasn't acknowledged again, in their
+// order, from right after recv, the last one it got, and sends them again.
+func (host *Host) resync(peer *Peer, recv uint64) {
+	tl := peer.trustline
+	if recv >= tl.SendSeq {
+		return
+	}
+	var seqs []uint64
+	for _, p := range tl.Pending {
+		seqs = append(seqs, p.Seq)
+	}
+	var settles []*journalEntry
+	for _, e := range host.journal.unfinished() {
+		if !e.Inbound && e.PeerID == peer.PeerID && e.Seq != 0 {
+			settles = append(settles, e)
+			seqs = append(seqs, e.Seq)
+		}
+	}
+	for _, h := range tl.HTLCs {
+		if h.Out && !h.resolved() {
+			seqs = append(seqs, h.Seq)
+		}
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	renumber := make(map[uint64]uint64)
+	next := recv
+	for _, seq := range seqs {
+		if seq > recv {
+			next++
+			renumber[seq] = next
+		}
+	}
+
+	pending := make([]*PendingPay, 0, len(tl.Pending))
+	for _, p := range tl.Pending {
+		c := *p
+		if seq, ok := renumber[p.Seq]; ok {
+			c.Seq = seq
+		}
+		pending = append(pending, &c)
+	}
+	tl.Pending = pending
+	for _, h := range tl.HTLCs {
+		if seq, ok := renumber[h.Seq]; ok && h.Out && !h.resolved() {
+			c := *h
+			c.Seq = seq
+			tl.putHTLC(&c)
+		}
+	}
+	for _, e := range settles {
+		if seq, ok := renumber[e.Seq]; ok {
+			e.Seq = seq
+			if err := host.journal.record(e, e.State); err != nil {
+				logJournalErr(err)
+			}
+		}
+	}
+	tl.SendSeq = next
+	host.saveTrustline(peer)
+	fmt.Printf("\n%s missed messages after %d, sending them again\n", peer.PeerID, recv)
+	fmt.Print("> ")
+	host.resendUnacked(peer)
+}
+
+// resendUnacked sends a reconnected peer every payment and settlement it
+// hasn't acknowledged, in their original order. Settlements that were never
+// sent go last.
+func (host *Host) resendUnacked(peer *Peer) {
+	var msgs []*Message
+	var unsent []*journalEntry
+	for _, p := range peer.trustline.Pending {
+		msgs = append(msgs, &Message{HostID: host.Name, PeerID: peer.PeerID, Type: "Pay", Amount: p.Amount, ID: p.ID, Seq: p.Seq})
+	}
+	for _, e := range host.journal.unfinished() {
+		if e.Inbound || e.PeerID != peer.PeerID {
+			continue
+		}
+		if e.Seq == 0 {
+			unsent = append(unsent, e)
+			continue
+		}
+		msgs = append(msgs, &Message{HostID: host.Name, PeerID: peer.PeerID, Type: "Settle", Amount: e.Amount, ID: e.ID, Seq: e.Seq})
+	}
+	for _, h := range peer.trustline.HTLCs {
+		if h.Out && !h.resolved() {
+			msgs = append(msgs, h.prepare(host.Name, peer.PeerID))
+		}
+	}
+	sort.Slice(msgs, func(i, j int) bool { return msgs[i].Seq < msgs[j].Seq })
+	for _, msg := range msgs {
+		host.sendTo(peer, msg)
+	}
+	sort.Slice(unsent, func(i, j int) bool { return unsent[i].Time.Before(unsent[j].Time) })
+	for _, e := range unsent {
+		host.notifySettlement(peer, e)
+	}
+	// Answers to conditional payments it may have missed
+	for _, h := range peer.trustline.HTLCs {
+		if !h.Out && h.resolved() {
+			host.sendResolution(peer, h)
+		}
+	}
+}
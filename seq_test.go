@@ -0,0 +1,104 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSequenceNumbers(t *testing.T) {
+	chain := newMemChain()
+	chain.Register("alice", 50, "pw", PeerInfo{})
+	chain.Register("bob", 0, "pw", PeerInfo{})
+	dir := t.TempDir()
+	host := newTestHost(t, "alice", chain)
+	host.store, _ = openStore(dir)
+	host.history, _ = openHistory(historyPath(dir))
+	go host.stateManager()
+	bob := testPeer(host, "bob")
+
+	// Outbound: one counter across Pay and Settle
+	host.outbound <- &Message{HostID: "alice", PeerID: "bob", Type: "Pay", Amount: 20}
+	if msg := next(bob); msg.Seq != 1 {
+		t.Fatalf("first payment has seq %d", msg.Seq)
+	}
+	host.outbound <- &Message{HostID: "alice", PeerID: "bob", Type: "Settle", Amount: 5}
+	if msg := next(bob); msg.Type != "Settle" || msg.Seq != 2 {
+		t.Fatalf("settlement sent as %+v", msg)
+	}
+
+	// Inbound: applied once, in order. The payment above is still pending, so
+	// the balance is 5 settled plus 3 received
+	host.inbound <- &Message{HostID: "bob", PeerID: "alice", Type: "Pay", Amount: 3, ID: "p1", Seq: 1}
+	if msg := next(bob); msg.Type != "PayAck" {
+		t.Fatalf("peer got %+v", msg)
+	}
+	replays := []*Message{
+		{HostID: "bob", PeerID: "alice", Type: "Pay", Amount: 3, ID: "p1", Seq: 1},
+		{HostID: "bob", PeerID: "alice", Type: "Pay", Amount: 3, ID: "p2", Seq: 1},
+		{HostID: "bob", PeerID: "alice", Type: "Settle", Amount: 3, ID: "s1", Seq: 1},
+		{HostID: "bob", PeerID: "alice", Type: "Settle", Amount: 3, ID: "s2", Seq: 5},
+	}
+	for _, m := range replays {
+		host.inbound <- m
+	}
+	// Only the exact resend of p1 is acked again
+	if msg := next(bob); msg.Type != "PayAck" || msg.ID != "p1" {
+		t.Fatalf("peer got %+v", msg)
+	}
+	host.inbound <- &Message{HostID: "bob", PeerID: "alice", Type: "Pay", Amount: 3, ID: "p3", Seq: 3}
+	if msg := next(bob); msg.Type != "Reject" || msg.Code != rejectSequence || !strings.Contains(msg.Reason, "expected sequence number 2") {
+		t.Fatalf("gap answered with %+v", msg)
+	}
+	host.run(func() {
+		if tl := bob.trustline; tl.HostBalance != 8 || tl.RecvSeq != 1 || len(host.unverified) != 0 {
+			t.Errorf("trustline %+v, %d unverified settlements", tl, len(host.unverified))
+		}
+	})
+
+	// The counters survive a restart
+	restarted := newHost("alice", 0, chain)
+	restarted.store, _ = openStore(dir)
+	restarted.restoreTrustlines()
+	if tl := restarted.peerIDtoPeer["bob"].trustline; tl.SendSeq != 2 || tl.RecvSeq != 1 {
+		t.Fatalf("restored send %d, receive %d", tl.SendSeq, tl.RecvSeq)
+	}
+}
+
+func TestSequenceResync(t *testing.T) {
+	host := newTestHost(t, "alice", newMemChain())
+	go host.stateManager()
+	bob := testPeer(host, "bob")
+	pay := func() Message {
+		host.outbound <- &Message{HostID: "alice", PeerID: "bob", Type: "Pay", Amount: 1}
+		return next(bob)
+	}
+	host.outbound <- &Message{HostID: "alice", PeerID: "bob", Type: "Pay", Amount: 1}
+	ackPay(t, host, bob)
+
+	// A number got lost on our side: bob reports the last he got and the
+	// payment goes again, closing the gap
+	host.run(func() { bob.trustline.SendSeq++ })
+	p := pay()
+	if p.Seq != 3 {
+		t.Fatalf("sent with seq %d", p.Seq)
+	}
+	host.inbound <- &Message{HostID: "bob", PeerID: "alice", Type: "Reject", ID: p.ID, Code: rejectSequence, Seq: 1}
+	if msg := next(bob); msg.Type != "Pay" || msg.ID != p.ID || msg.Seq != 2 {
+		t.Fatalf("resent %+v", msg)
+	}
+
+	// A payment lost on the way: everything unacknowledged goes again, in
+	// order
+	q, r := pay(), pay()
+	host.inbound <- &Message{HostID: "bob", PeerID: "alice", Type: "Reject", ID: r.ID, Code: rejectSequence, Seq: 2}
+	for i, id := range []string{p.ID, q.ID, r.ID} {
+		if msg := next(bob); msg.ID != id || msg.Seq != uint64(i+2) {
+			t.Fatalf("resent %+v", msg)
+		}
+	}
+	host.run(func() {
+		if tl := bob.trustline; tl.SendSeq != 4 || len(tl.Pending) != 3 {
+			t.Errorf("trustline %+v", tl)
+		}
+	})
+}
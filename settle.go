@@ -0,0 +1,546 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// How often the chain is polled while inbound settlements are unverified, and
+// how long a peer's settlement may take to show up before it is disputed.
+var (
+	settleCheckInterval = time.Second
+	settleTimeout       = 30 * time.Second
+)
+
+// An inboundSettle is a settlement a peer claims to have made to us on the
+// chain. The trustline is only credited once the funds are seen there.
+type inboundSettle struct {
+	entry    *journalEntry
+	Received time.Time
+	deadline time.Time
+}
+
+// A deposit is money that showed up on the chain without a settlement to
+// match it, as of seen. One that no settlement claims within settleTimeout
+// is taken into our confirmed balance, so a later claim can't take credit
+// for it.
+type deposit struct {
+	amount uint32
+	seen   time.Time
+}
+
+// A balanceReport is the result of polling our own balance on the chain. gen
+// is host.balanceGen when the poll started; reports from before our own last
+// settlement are stale and dropped.
+type balanceReport struct {
+	gen     uint64
+	balance uint32
+	err     error
+}
+
+// settle queues a settlement with peer. Settlements go to the chain one at a
+// time, and off the stateManager, see nextSettlement. Runs from the
+// stateManager.
+func (host *Host) settle(peer *Peer, msg *Message) {
+	if host.unsure() {
+		fmt.Printf("\nErr: Settlement with %s refused: an earlier settlement is still being checked with the chain\n", msg.PeerID)
+		fmt.Print("> ")
+		return
+	}
+	host.settleQueue = append(host.settleQueue, msg)
+	host.nextSettlement()
+}
+
+// nextSettlement pays the next queued settlement on the chain and tells the
+// peer. Every step is journaled first, see journal.go. A payment that fails
+// without the chain refusing it may still have gone through, so it stays an
+// intent until checkIntents finds out, and no other settlement starts
+// meanwhile.
+func (host *Host) nextSettlement() {
+	if host.settlingWith != "" || host.unsure() || len(host.settleQueue) == 0 {
+		return
+	}
+	msg := host.settleQueue[0]
+	host.settleQueue = host.settleQueue[1:]
+	host.settlingWith = msg.PeerID
+	go func() {
+		before, err := host.chain.Balance(host.Name)
+		host.do <- func() { host.payOnChain(msg, before, err) }
+	}()
+}
+
+// payOnChain journals the intent to settle msg, before being our balance
+// until then, and makes the payment.
+func (host *Host) payOnChain(msg *Message, before uint32, err error) {
+	peer, ok := host.peerIDtoPeer[msg.PeerID]
+	if err == nil && (!ok || peer.trustline == nil) {
+		err = fmt.Errorf("no trustline with %s", msg.PeerID)
+	}
+	if err != nil {
+		fmt.Printf("\nErr: Settlement with %s failed: %v\n", msg.PeerID, err)
+		fmt.Print("> ")
+		host.settleDone()
+		return
+	}
+	e := &journalEntry{
+		ID:     newID(),
+		PeerID: msg.PeerID,
+		Amount: msg.Amount,
+		Before: before,
+		Mark:   peer.trustline.SettledOut + uint64(msg.Amount),
+	}
+	if err := host.journal.record(e, settleIntent); err != nil {
+		logJournalErr(err)
+		host.settleDone()
+		return
+	}
+	host.paying = e
+	// Polls from before can't tell whether the money left
+	host.balanceGen++
+	go func() {
+		err := host.chain.Pay(host.Name, e.PeerID, host.password, e.Amount, e.ID)
+		host.do <- func() { host.paidOnChain(e, err) }
+	}()
+}
+
+// paidOnChain finishes our settlement e once the chain has answered.
+func (host *Host) paidOnChain(e *journalEntry, err error) {
+	defer host.settleDone()
+	host.paying = nil
+	if err != nil && !refused(err) {
+		fmt.Printf("\nErr: Settlement with %s may not have gone through, checking with the chain: %v\n", e.PeerID, err)
+		fmt.Print("> ")
+		return
+	}
+	if err != nil {
+		if jerr := host.journal.record(e, settleAborted); jerr != nil {
+			logJournalErr(jerr)
+		}
+		if errors.Is(err, errInsufficientFunds) {
+			fmt.Printf("\nErr: Insufficient funds to settle with %s at amount: %d\n", e.PeerID, e.Amount)
+		} else {
+			fmt.Printf("\nErr: Settlement with %s failed: %v\n", e.PeerID, err)
+		}
+		fmt.Print("> ")
+		return
+	}
+	host.submitted(e)
+}
+
+// settleDone lets the next settlement go to the chain.
+func (host *Host) settleDone() {
+	peerID := host.settlingWith
+	host.settlingWith = ""
+	host.settlementOver(peerID)
+}
+
+// settlementOver gives payments to peerID that waited for a settlement
+// another try once none may free up credit any more, and starts the next
+// settlement.
+func (host *Host) settlementOver(peerID string) {
+	if peer, ok := host.peerIDtoPeer[peerID]; ok && peer.online() && !host.settleQueued(peer) && host.settling(peer) == 0 {
+		host.releaseHeld(peer)
+	}
+	host.nextSettlement()
+}
+
+// settleQueued reports whether one of our settlements with peer is queued,
+// at the chain or being checked with it.
+func (host *Host) settleQueued(peer *Peer) bool {
+	if host.settlingWith == peer.PeerID {
+		return true
+	}
+	for _, msg := range host.settleQueue {
+		if msg.PeerID == peer.PeerID {
+			return true
+		}
+	}
+	for _, e := range host.intents() {
+		if e.PeerID == peer.PeerID {
+			return true
+		}
+	}
+	return false
+}
+
+// submitted applies one of our settlements that reached the chain and tells
+// the peer. Without the trustline it waits, journaled, for replayJournal.
+func (host *Host) submitted(e *journalEntry) {
+	if err := host.journal.record(e, settleSubmitted); err != nil {
+		logJournalErr(err)
+		return
+	}
+	peer, ok := host.peerIDtoPeer[e.PeerID]
+	if !ok || peer.trustline == nil {
+		fmt.Printf("\nErr: Settlement of %d with %s reached the chain, but the trustline is gone\n", e.Amount, e.PeerID)
+		fmt.Print("> ")
+		return
+	}
+	host.applySettlement(peer, e)
+	host.notifySettlement(peer, e)
+}
+
+// refused reports whether the chain turned a payment down, as opposed to
+// failing in a way that leaves it unknown whether the payment went through.
+func refused(err error) bool {
+	return errors.Is(err, errInsufficientFunds) || errors.Is(err, errInvalidKey) || errors.Is(err, errUnknownUser)
+}
+
+// intents returns our settlements not known to have reached the chain or
+// not, other than the one the chain has yet to answer for.
+func (host *Host) intents() []*journalEntry {
+	var es []*journalEntry
+	for _, e := range host.journal.unfinished() {
+		if !e.Inbound && e.State == settleIntent && e != host.paying {
+			es = append(es, e)
+		}
+	}
+	return es
+}
+
+// unsure reports whether one of our settlements may or may not have reached
+// the chain. Our balance only tells which if nothing else was paid since.
+func (host *Host) unsure() bool {
+	return len(host.intents()) > 0
+}
+
+// reachedChain tells whether our settlement e got to the chain. It asks the
+// chain by the settlement's ID, which went with the payment. A chain that
+// can't tell, like the hosted FakeChain, leaves it to our balance: it can
+// only have dropped below the balance at the time of the intent if the
+// payment went through, though money coming in since can hide that.
+func (host *Host) reachedChain(e *journalEntry, balance func() (uint32, error)) (bool, error) {
+	paid, err := host.chain.Paid(host.Name, e.ID)
+	if !errors.Is(err, errNoTransfers) {
+		return paid, err
+	}
+	bal, err := balance()
+	if err != nil {
+		return false, err
+	}
+	return bal < e.Before, nil
+}
+
+// checkIntents asks the chain, off the stateManager, whether our settlements
+// that failed without a refusal went through, and then applies or aborts
+// them. Runs from the stateManager.
+func (host *Host) checkIntents() {
+	intents := host.intents()
+	if len(intents) == 0 || host.checking {
+		return
+	}
+	host.checking = true
+	go func() {
+		paid := make([]bool, len(intents))
+		var err error
+		for i, e := range intents {
+			c := *e
+			paid[i], err = host.reachedChain(&c, func() (uint32, error) { return host.chain.Balance(host.Name) })
+			if err != nil {
+				break
+			}
+		}
+		host.do <- func() {
+			host.checking = false
+			if err != nil {
+				fmt.Printf("\nErr: Could not check settlements with the chain: %v\n", err)
+				fmt.Print("> ")
+				return
+			}
+			for i, e := range intents {
+				host.intentChecked(e, paid[i])
+			}
+		}
+	}()
+}
+
+// intentChecked applies our settlement e if it reached the chain, and aborts
+// it otherwise.
+func (host *Host) intentChecked(e *journalEntry, paid bool) {
+	if e.State != settleIntent {
+		return
+	}
+	defer host.settlementOver(e.PeerID)
+	if !paid {
+		if err := host.journal.record(e, settleAborted); err != nil {
+			logJournalErr(err)
+			return
+		}
+		fmt.Printf("\nErr: Settlement of %d with %s did not go through\n", e.Amount, e.PeerID)
+		fmt.Print("> ")
+		return
+	}
+	fmt.Printf("\nSettlement of %d with %s went through after all\n", e.Amount, e.PeerID)
+	fmt.Print("> ")
+	host.submitted(e)
+}
+
+// applySettlement moves a journaled settlement onto the trustline and our
+// confirmed chain balance, unless the trustline already has it.
+func (host *Host) applySettlement(peer *Peer, e *journalEntry) {
+	tl := peer.trustline
+	if e.Inbound {
+		if tl.SettledIn >= e.Mark {
+			return
+		}
+		tl.SettledIn = e.Mark
+		tl.HostBalance -= int(e.Amount)
+		tl.PeerBalance += int(e.Amount)
+		host.chainBalance += e.Amount
+		defer host.logHistory(peer, "Settle", "in", e.Amount, e.ID)
+	} else {
+		if tl.SettledOut >= e.Mark {
+			return
+		}
+		tl.SettledOut = e.Mark
+		tl.HostBalance += int(e.Amount)
+		tl.PeerBalance -= int(e.Amount)
+		host.chainBalance -= e.Amount
+		host.balanceGen++
+		defer host.logHistory(peer, "Settle", "out", e.Amount, e.ID)
+	}
+	host.saveTrustline(peer)
+}
+
+// notifySettlement tells peer about a settlement that reached the chain. If
+// the peer is offline it hears about it once it reconnects, see
+// resendUnacked.
+func (host *Host) notifySettlement(peer *Peer, e *journalEntry) {
+	if !peer.online() {
+		return
+	}
+	if e.Seq == 0 {
+		// Journaled before the trustline, replayJournal catches the
+		// trustline up after a crash in between
+		e.Seq = peer.trustline.SendSeq + 1
+		if err := host.journal.record(e, e.State); err != nil {
+			logJournalErr(err)
+			return
+		}
+		peer.trustline.SendSeq = e.Seq
+		host.saveTrustline(peer)
+	}
+	msg := Message{HostID: host.Name, PeerID: e.PeerID, Type: "Settle", Amount: e.Amount, ID: e.ID, Seq: e.Seq}
+	host.sendTo(peer, &msg)
+	if err := host.journal.record(e, settleNotified); err != nil {
+		logJournalErr(err)
+	}
+}
+
+// settleAcked finishes one of our settlements once the peer has credited it.
+func (host *Host) settleAcked(msg *Message) {
+	e, ok := host.journal.get(msg.HostID, msg.ID, false)
+	if !ok || e.done() {
+		return
+	}
+	if err := host.journal.record(e, settleAcked); err != nil {
+		logJournalErr(err)
+		return
+	}
+	if peer, ok := host.peerIDtoPeer[e.PeerID]; ok && peer.online() {
+		host.releaseHeld(peer)
+	}
+}
+
+// expectSettlement queues a peer's settlement for verification. A settlement
+// we already credited is acknowledged again, since the peer may have missed
+// our ack; other replays are dropped.
+func (host *Host) expectSettlement(peer *Peer, msg *Message) {
+	e, known := host.journal.get(msg.HostID, msg.ID, true)
+	seqErr := checkSeq(peer.trustline, msg.Seq)
+	if seqErr != nil && !(known && errors.Is(seqErr, errReplayed)) {
+		reportSeq(msg, seqErr)
+		if !errors.Is(seqErr, errReplayed) {
+			host.rejectSeq(peer, msg, seqErr)
+		}
+		return
+	}
+	if !known {
+		e = &journalEntry{ID: msg.ID, PeerID: msg.HostID, Amount: msg.Amount, Inbound: true}
+		if err := host.journal.record(e, settleReceived); err != nil {
+			logJournalErr(err)
+			return
+		}
+	}
+	if seqErr == nil {
+		// Journaled first, so a crash in between doesn't make the resent
+		// Settle look like a replay
+		peer.trustline.RecvSeq = msg.Seq
+		host.saveTrustline(peer)
+	}
+	if known {
+		if e.State == settleCredited {
+			host.ackSettlement(peer, e)
+		}
+		return
+	}
+	host.verify(e)
+	fmt.Printf("\n%s says they settled %d, verifying on chain...\n", msg.HostID, msg.Amount)
+	fmt.Print("> ")
+}
+
+func (host *Host) verify(e *journalEntry) {
+	now := time.Now()
+	host.unverified = append(host.unverified, &inboundSettle{entry: e, Received: now, deadline: now.Add(settleTimeout)})
+}
+
+func (host *Host) ackSettlement(peer *Peer, e *journalEntry) {
+	msg := Message{HostID: host.Name, PeerID: e.PeerID, Type: "SettleAck", Amount: e.Amount, ID: e.ID}
+	host.sendTo(peer, &msg)
+}
+
+// pollBalance fetches our chain balance if settlements are waiting to be
+// verified. It waits while one of ours is at the chain or may or may not
+// have gone through, which would throw off the count. Runs from the stateManager.
+func (host *Host) pollBalance() {
+	if len(host.unverified) == 0 || host.polling || host.settlingWith != "" || host.unsure() {
+		return
+	}
+	host.polling = true
+	gen := host.balanceGen
+	go func() {
+		bal, err := host.chain.Balance(host.Name)
+		host.balances <- &balanceReport{gen, bal, err}
+	}()
+}
+
+// verifySettlements matches the growth of our chain balance since the last
+// confirmed balance against the unverified settlements, oldest first.
+// Settlements still missing after settleTimeout are disputed. Growth no
+// settlement claims is kept as deposits, and taken into chainBalance once
+// it's been unclaimed for settleTimeout.
+func (host *Host) verifySettlements(r *balanceReport) {
+	host.polling = false
+	if r.gen != host.balanceGen {
+		return
+	}
+	if r.err != nil {
+		fmt.Printf("\nErr: Could not verify settlements: %v\n", r.err)
+		fmt.Print("> ")
+		return
+	}
+	surplus := int64(r.balance) - int64(host.chainBalance)
+	now := time.Now()
+	for len(host.deposits) > 0 && now.Sub(host.deposits[0].seen) > settleTimeout {
+		host.chainBalance += host.deposits[0].amount
+		surplus -= int64(host.deposits[0].amount)
+		host.deposits = host.deposits[1:]
+	}
+	waiting := host.unverified[:0]
+	for _, s := range host.unverified {
+		e := s.entry
+		switch {
+		case surplus >= int64(e.Amount):
+			peer, ok := host.peerIDtoPeer[e.PeerID]
+			if !ok {
+				waiting = append(waiting, s)
+				continue
+			}
+			e.Mark = peer.trustline.SettledIn + uint64(e.Amount)
+			if err := host.journal.record(e, settleCredited); err != nil {
+				logJournalErr(err)
+				waiting = append(waiting, s)
+				continue
+			}
+			surplus -= int64(e.Amount)
+			host.applySettlement(peer, e)
+			fmt.Printf("\n%s has settled a payment of %d!\n", e.PeerID, e.Amount)
+			fmt.Print("> ")
+			if peer.online() {
+				host.ackSettlement(peer, e)
+				host.proposeState(peer)
+			}
+		case now.After(s.deadline):
+			if err := host.journal.record(e, settleDisputed); err != nil {
+				logJournalErr(err)
+			}
+			host.disputes = append(host.disputes, s)
+			fmt.Printf("\nErr: Settlement of %d from %s never arrived on chain and is disputed\n", e.Amount, e.PeerID)
+			fmt.Print("> ")
+		default:
+			waiting = append(waiting, s)
+		}
+	}
+	host.unverified = waiting
+	host.trackDeposits(surplus, now)
+}
+
+// trackDeposits brings the deposits in line with the surplus left after
+// settlements were credited. A drop in our balance goes straight into
+// chainBalance.
+func (host *Host) trackDeposits(surplus int64, now time.Time) {
+	if surplus <= 0 {
+		host.chainBalance = uint32(int64(host.chainBalance) + surplus)
+		host.deposits = nil
+		return
+	}
+	var known int64
+	for _, d := range host.deposits {
+		known += int64(d.amount)
+	}
+	if surplus > known {
+		host.deposits = append(host.deposits, &deposit{amount: uint32(surplus - known), seen: now})
+	}
+	// Settlements claimed some, oldest first
+	for used := known - surplus; used > 0; {
+		d := host.deposits[0]
+		if int64(d.amount) > used {
+			d.amount -= uint32(used)
+			break
+		}
+		used -= int64(d.amount)
+		host.deposits = host.deposits[1:]
+	}
+}
+
+// replayJournal picks up settlements that were in flight when the node last
+// stopped. Must run after the trustlines are restored and before the
+// stateManager starts; balance is our current balance on the chain.
+//
+// An intent whose payment never reached the chain is aborted, see
+// reachedChain. Settlements that reached the chain but not the trustline are
+// applied, and ones the peer hasn't acknowledged are sent again once it
+// reconnects, so the peer either credits them or acknowledges them again.
+// Inbound settlements go back to being verified.
+func (host *Host) replayJournal(balance uint32) error {
+	for _, e := range host.journal.entries {
+		switch e.State {
+		case settleIntent:
+			paid, err := host.reachedChain(e, func() (uint32, error) { return balance, nil })
+			if err != nil {
+				return err
+			}
+			if !paid {
+				if err := host.journal.record(e, settleAborted); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := host.journal.record(e, settleSubmitted); err != nil {
+				return err
+			}
+			fallthrough
+		case settleSubmitted, settleNotified, settleAcked, settleCredited:
+			if peer, ok := host.peerIDtoPeer[e.PeerID]; ok {
+				host.applySettlement(peer, e)
+				if !e.Inbound && e.Seq > peer.trustline.SendSeq {
+					peer.trustline.SendSeq = e.Seq
+					host.saveTrustline(peer)
+				}
+			}
+		case settleReceived:
+			host.verify(e)
+		}
+	}
+	return nil
+}
+
+func displayDisputes(host *Host) {
+	for _, s := range host.unverified {
+		fmt.Printf("%s: settlement of %d unverified since %s\n", s.entry.PeerID, s.entry.Amount, s.Received.Format(time.Stamp))
+	}
+	for _, s := range host.disputes {
+		fmt.Printf("%s: settlement of %d disputed (claimed %s)\n", s.entry.PeerID, s.entry.Amount, s.Received.Format(time.Stamp))
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Every frame is signed with the sending node's Ed25519 key. Public keys are
+// published in the PeerInfo each node registers on the chain, and a peer's
+// key is looked up there when it connects.
+
+// keyPath is where a node keeps its private key, as the hex encoded seed.
+func keyPath(dataDir string) string {
+	return filepath.Join(dataDir, "node.key")
+}
+
+// loadKey reads the node's key from path, or generates and saves one the
+// first time.
+func loadKey(path string) (ed25519.PrivateKey, error) {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		key := newKey()
+		return key, writeSynced(path, []byte(hex.EncodeToString(key.Seed())+"\n"))
+	} else if err != nil {
+		return nil, err
+	}
+	seed, err := hex.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("%s is not a valid key", path)
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+func newKey() ed25519.PrivateKey {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	ferror(err) // should never happen
+	return key
+}
+
+func (host *Host) publicKey() ed25519.PublicKey {
+	return host.key.Public().(ed25519.PublicKey)
+}
+
+// sign sets msg.Sig to our signature over the rest of msg.
+func (host *Host) sign(msg *Message) {
+	msg.Sig = ed25519.Sign(host.key, signedBytes(msg))
+}
+
+// signedBytes is the encoding of msg without its signature, which is what
+// gets signed.
+func signedBytes(msg *Message) []byte {
+	m := *msg
+	m.Sig = nil
+	b, err := json.Marshal(&m)
+	ferror(err) // should never happen
+	return b
+}
+
+func verifySig(key ed25519.PublicKey, msg *Message) bool {
+	return len(key) == ed25519.PublicKeySize && ed25519.Verify(key, signedBytes(msg), msg.Sig)
+}
+
+var errNoPublicKey = errors.New("has not published a public key")
+
+// lookupPeer fetches what peerID published on the chain, including its
+// public key.
+func (host *Host) lookupPeer(peerID string) (*PeerInfo, error) {
+	ud, err := host.chain.Users()
+	if err != nil {
+		return nil, err
+	}
+	info, ok := ud[peerID]
+	if !ok {
+		return nil, fmt.Errorf("%w %s", errUnknownUser, peerID)
+	}
+	if len(info.PeerInfo.PublicKey) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("%s %w", peerID, errNoPublicKey)
+	}
+	return &info.PeerInfo, nil
+}
+
+// The preimage of a routed payment is sealed to the recipient's published
+// key, so the hops in between can't claim it. The Ed25519 keys are used as
+// their X25519 equivalents: an ephemeral key agreement with the recipient
+// gives a pad that the preimage is XORed with.
+
+// x25519Public converts an Ed25519 public key to the X25519 public key of the
+// same secret, u = (1+y)/(1-y) mod 2^255-19.
+func x25519Public(pub ed25519.PublicKey) (*ecdh.PublicKey, error) {
+	if len(pub) != ed25519.PublicKeySize {
+		return nil, errors.New("invalid public key")
+	}
+	b := make([]byte, len(pub))
+	for i := range pub {
+		b[len(b)-1-i] = pub[i]
+	}
+	b[0] &= 0x7f // The sign of x
+	y := new(big.Int).SetBytes(b)
+	p := new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 255), big.NewInt(19))
+	den := new(big.Int).Sub(big.NewInt(1), y)
+	den.Mod(den, p)
+	if den.Sign() == 0 {
+		return nil, errors.New("invalid public key")
+	}
+	u := new(big.Int).Add(big.NewInt(1), y)
+	u.Mul(u, den.ModInverse(den, p)).Mod(u, p)
+	u.FillBytes(b)
+	for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+		b[i], b[j] = b[j], b[i]
+	}
+	return ecdh.X25519().NewPublicKey(b)
+}
+
+// x25519Private is the X25519 private key of an Ed25519 key.
+func x25519Private(key ed25519.PrivateKey) (*ecdh.PrivateKey, error) {
+	h := sha512.Sum512(key.Seed())
+	return ecdh.X25519().NewPrivateKey(h[:32])
+}
+
+func sealPad(shared []byte, ephemeral []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte("p2pcredit preimage"))
+	h.Write(shared)
+	h.Write(ephemeral)
+	return h.Sum(nil)
+}
+
+func xorBytes(a []byte, b []byte) []byte {
+	out := make([]byte, len(a))
+	for i := range a {
+		out[i] = a[i] ^ b[i]
+	}
+	return out
+}
+
+// sealPreimage seals a 32 byte preimage to pub.
+func sealPreimage(pub ed25519.PublicKey, preimage []byte) ([]byte, error) {
+	to, err := x25519Public(pub)
+	if err != nil {
+		return nil, err
+	}
+	eph, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := eph.ECDH(to)
+	if err != nil {
+		return nil, err
+	}
+	ephPub := eph.PublicKey().Bytes()
+	return append(ephPub, xorBytes(preimage, sealPad(shared, ephPub))...), nil
+}
+
+// openPreimage opens a preimage sealed to us and checks it against hash.
+func (host *Host) openPreimage(sealed []byte, hash []byte) ([]byte, error) {
+	if len(sealed) != 64 {
+		return nil, errors.New("malformed sealed preimage")
+	}
+	priv, err := x25519Private(host.key)
+	if err != nil {
+		return nil, err
+	}
+	eph, err := ecdh.X25519().NewPublicKey(sealed[:32])
+	if err != nil {
+		return nil, err
+	}
+	shared, err := priv.ECDH(eph)
+	if err != nil {
+		return nil, err
+	}
+	preimage := xorBytes(sealed[32:], sealPad(shared, sealed[:32]))
+	if sum := sha256.Sum256(preimage); !bytes.Equal(sum[:], hash) {
+		return nil, errors.New("preimage doesn't match the hash")
+	}
+	return preimage, nil
+}
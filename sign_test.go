@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io/ioutil"
+	"testing"
+)
+
+func TestLoadKey(t *testing.T) {
+	path := keyPath(t.TempDir())
+	key, err := loadKey(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := loadKey(path)
+	if err != nil || !again.Equal(key) {
+		t.Fatalf("reloaded a different key: %v", err)
+	}
+
+	msg := &Message{HostID: "alice", PeerID: "bob", Type: "Pay", Amount: 5, ID: "p1", Seq: 1}
+	host := &Host{key: key}
+	host.sign(msg)
+	if !verifySig(host.publicKey(), msg) {
+		t.Fatal("signature does not verify")
+	}
+	msg.Amount = 500
+	if verifySig(host.publicKey(), msg) {
+		t.Fatal("tampered message verifies")
+	}
+
+	ioutil.WriteFile(path, []byte("nope"), 0600)
+	if _, err := loadKey(path); err == nil {
+		t.Fatal("loaded a corrupt key")
+	}
+}
+
+func TestSealPreimage(t *testing.T) {
+	carol := &Host{key: newKey()}
+	// Both ways to the X25519 key agree
+	pub, err := x25519Public(carol.publicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	priv, _ := x25519Private(carol.key)
+	if !bytes.Equal(pub.Bytes(), priv.PublicKey().Bytes()) {
+		t.Fatal("converted public key doesn't match the private key")
+	}
+
+	preimage := bytes.Repeat([]byte{7}, 32)
+	hash := sha256.Sum256(preimage)
+	sealed, err := sealPreimage(carol.publicKey(), preimage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := carol.openPreimage(sealed, hash[:]); err != nil || !bytes.Equal(got, preimage) {
+		t.Fatalf("opened %x: %v", got, err)
+	}
+	bob := &Host{key: newKey()}
+	if _, err := bob.openPreimage(sealed, hash[:]); err == nil {
+		t.Fatal("someone else opened the preimage")
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+)
+
+// A StateRecord is a snapshot of a trustline that both sides sign. After
+// acking a Pay or Settle, the receiver signs its view of the trustline and
+// sends it as a State message. The other side countersigns it in a StateAck
+// if the record matches its own view exactly; under crossing traffic it may
+// not, and a later record takes its place. Each side keeps the latest record
+// signed by both, which can be exported as evidence of the last agreed
+// balance.
+//
+// Seq holds the sequence number of the last Pay or Settle each node sent that
+// the state includes, and Balance each node's HostBalance.
+type StateRecord struct {
+	Trustline string            `json:"trustline"`
+	Seq       map[string]uint64 `json:"seq"`
+	Balance   map[string]int    `json:"balance"`
+	Sigs      map[string][]byte `json:"sigs,omitempty"`
+}
+
+// trustlineID names the trustline between a and b the same on both sides.
+func trustlineID(a string, b string) string {
+	ids := []string{a, b}
+	sort.Strings(ids)
+	return strings.Join(ids, ":")
+}
+
+// stateRecord is our current, unsigned view of the trustline with peer.
+func (host *Host) stateRecord(peer *Peer) *StateRecord {
+	tl := peer.trustline
+	return &StateRecord{
+		Trustline: trustlineID(host.Name, peer.PeerID),
+		Seq:       map[string]uint64{host.Name: tl.SendSeq, peer.PeerID: tl.RecvSeq},
+		Balance:   map[string]int{host.Name: tl.HostBalance, peer.PeerID: tl.PeerBalance},
+	}
+}
+
+func (r *StateRecord) signedBytes() []byte {
+	c := *r
+	c.Sigs = nil
+	b, err := json.Marshal(&c)
+	ferror(err) // should never happen
+	return b
+}
+
+func (r *StateRecord) sign(id string, key ed25519.PrivateKey) {
+	if r.Sigs == nil {
+		r.Sigs = make(map[string][]byte)
+	}
+	r.Sigs[id] = ed25519.Sign(key, r.signedBytes())
+}
+
+// verify checks that each node in keys signed r.
+func (r *StateRecord) verify(keys map[string]ed25519.PublicKey) error {
+	for id, key := range keys {
+		if len(key) != ed25519.PublicKeySize || !ed25519.Verify(key, r.signedBytes(), r.Sigs[id]) {
+			return fmt.Errorf("state of %s is not signed by %s", r.Trustline, id)
+		}
+	}
+	return nil
+}
+
+// matches reports whether r describes the same state as s.
+func (r *StateRecord) matches(s *StateRecord) bool {
+	if r.Trustline != s.Trustline || len(r.Seq) != len(s.Seq) || len(r.Balance) != len(s.Balance) {
+		return false
+	}
+	for id, seq := range s.Seq {
+		if r.Seq[id] != seq {
+			return false
+		}
+	}
+	for id, bal := range s.Balance {
+		if b, ok := r.Balance[id]; !ok || b != bal {
+			return false
+		}
+	}
+	return true
+}
+
+// newer reports whether r includes more messages than old.
+func (r *StateRecord) newer(old *StateRecord) bool {
+	if old == nil {
+		return true
+	}
+	more := false
+	for id, seq := range r.Seq {
+		if seq < old.Seq[id] {
+			return false
+		}
+		more = more || seq > old.Seq[id]
+	}
+	return more
+}
+
+// proposeState sends peer our signed view of the trustline to countersign.
+func (host *Host) proposeState(peer *Peer) {
+	r := host.stateRecord(peer)
+	r.sign(host.Name, host.key)
+	msg := Message{HostID: host.Name, PeerID: peer.PeerID, Type: "State", State: r}
+	host.sendTo(peer, &msg)
+}
+
+// cosignState countersigns a state record from peer if it matches our view.
+func (host *Host) cosignState(peer *Peer, msg *Message) {
+	r := msg.State
+	if r == nil || !r.matches(host.stateRecord(peer)) {
+		return
+	}
+	if err := r.verify(map[string]ed25519.PublicKey{peer.PeerID: peer.key}); err != nil {
+		fmt.Printf("\nErr: %v\n", err)
+		fmt.Print("> ")
+		return
+	}
+	r.sign(host.Name, host.key)
+	host.keepState(peer, r)
+	reply := Message{HostID: host.Name, PeerID: peer.PeerID, Type: "StateAck", State: r}
+	host.sendTo(peer, &reply)
+}
+
+// stateAcked keeps a record peer countersigned.
+func (host *Host) stateAcked(peer *Peer, msg *Message) {
+	r := msg.State
+	if r == nil || r.Trustline != trustlineID(host.Name, peer.PeerID) {
+		return
+	}
+	keys := map[string]ed25519.PublicKey{host.Name: host.publicKey(), peer.PeerID: peer.key}
+	if err := r.verify(keys); err != nil {
+		fmt.Printf("\nErr: %v\n", err)
+		fmt.Print("> ")
+		return
+	}
+	host.keepState(peer, r)
+}
+
+func (host *Host) keepState(peer *Peer, r *StateRecord) {
+	if !r.newer(peer.trustline.State) {
+		return
+	}
+	peer.trustline.State = r
+	host.saveTrustline(peer)
+}
+
+// exportState writes the latest state agreed with peerID as JSON to path, or
+// prints it if path is empty.
+func exportState(host *Host, peerID string, path string) error {
+	var r *StateRecord
+	host.run(func() {
+		if peer, ok := host.peerIDtoPeer[peerID]; ok && peer.trustline != nil {
+			r = peer.trustline.State
+		}
+	})
+	if r == nil {
+		return fmt.Errorf("no agreed state with %s", peerID)
+	}
+	b, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	if path == "" {
+		fmt.Println(string(b))
+		return nil
+	}
+	return ioutil.WriteFile(path, append(b, '\n'), 0600)
+}
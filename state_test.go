@@ -0,0 +1,89 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestCosignedState(t *testing.T) {
+	chain := newMemChain()
+	alice := newTestHost(t, "alice", chain)
+	go alice.stateManager()
+	bob := newTestHost(t, "bob", chain)
+	go bob.stateManager()
+	_, pi := listen(t, bob)
+
+	if err := alice.createConnection("bob", pi); err != nil {
+		t.Fatal(err)
+	}
+	alice.outbound <- &Message{HostID: "alice", PeerID: "bob", Type: "Propose", Limit: defaultTrustlineLimit}
+	acceptProposal(t, bob)
+	waitFor(t, alice, func() bool { return !alice.peerIDtoPeer["bob"].pending })
+	alice.outbound <- &Message{HostID: "alice", PeerID: "bob", Type: "Pay", Amount: 10}
+	waitFor(t, alice, func() bool { return alice.peerIDtoPeer["bob"].trustline.State != nil })
+	bob.outbound <- &Message{HostID: "bob", PeerID: "alice", Type: "Pay", Amount: 3}
+
+	// Both end up holding the same record, signed by both
+	want := map[string]int{"alice": -7, "bob": 7}
+	keys := map[string]ed25519.PublicKey{"alice": alice.publicKey(), "bob": bob.publicKey()}
+	for _, host := range []*Host{alice, bob} {
+		peerID := "bob"
+		if host == bob {
+			peerID = "alice"
+		}
+		waitFor(t, host, func() bool {
+			r := host.peerIDtoPeer[peerID].trustline.State
+			return r != nil && r.Balance["alice"] == want["alice"] && r.Balance["bob"] == want["bob"]
+		})
+		path := filepath.Join(t.TempDir(), "state.json")
+		if err := exportState(host, peerID, path); err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadFile(path)
+		var r StateRecord
+		if err := json.Unmarshal(b, &r); err != nil {
+			t.Fatal(err)
+		}
+		if err := r.verify(keys); err != nil {
+			t.Fatalf("%s exported %+v: %v", host.Name, r, err)
+		}
+		if r.Trustline != "alice:bob" || r.Seq["alice"] != 1 || r.Seq["bob"] != 1 {
+			t.Errorf("%s exported %+v", host.Name, r)
+		}
+	}
+}
+
+func TestStateMismatchNotCosigned(t *testing.T) {
+	host := newTestHost(t, "alice", newMemChain())
+	go host.stateManager()
+	bob := testPeer(host, "bob")
+	bobKey := newKey()
+	host.run(func() { bob.key = bobKey.Public().(ed25519.PublicKey) })
+
+	r := &StateRecord{
+		Trustline: "alice:bob",
+		Seq:       map[string]uint64{"alice": 0, "bob": 0},
+		Balance:   map[string]int{"alice": 0, "bob": 50},
+	}
+	r.sign("bob", bobKey)
+	host.inbound <- &Message{HostID: "bob", PeerID: "alice", Type: "State", State: r}
+	host.run(func() {
+		if len(bob.data) != 0 || bob.trustline.State != nil {
+			t.Errorf("cosigned a record of a balance we never had")
+		}
+	})
+
+	r = &StateRecord{
+		Trustline: "alice:bob",
+		Seq:       map[string]uint64{"alice": 0, "bob": 0},
+		Balance:   map[string]int{"alice": 0, "bob": 0},
+	}
+	r.sign("bob", bobKey)
+	host.inbound <- &Message{HostID: "bob", PeerID: "alice", Type: "State", State: r}
+	if msg := parseRawBytes(<-bob.data); msg.Type != "StateAck" || msg.State.verify(map[string]ed25519.PublicKey{"alice": host.publicKey(), "bob": bob.key}) != nil {
+		t.Fatalf("peer got %+v", msg)
+	}
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// snapshotEvery is how many WAL records are written before the store is
+// compacted into a new snapshot.
+const snapshotEvery = 256
+
+// storeRecord is one WAL line: the full new state of one trustline, or its
+// removal, together with our confirmed chain balance at that moment. Writing
+// both in one line keeps them consistent across a crash.
+type storeRecord struct {
+	PeerID       string     `json:"peer"`
+	Trustline    *Trustline `json:"trustline,omitempty"`
+	ChainBalance uint32     `json:"chain_balance"`
+}
+
+// storeSnapshot is the compacted state of a store.
+type storeSnapshot struct {
+	Trustlines   map[string]*Trustline `json:"trustlines"`
+	ChainBalance uint32                `json:"chain_balance"`
+	HasBalance   bool                  `json:"has_balance"`
+}
+
+// store keeps trustlines on disk as a snapshot plus a write-ahead log of the
+// changes made since. Both live in the node's data directory.
+type store struct {
+	dir     string
+	wal     *os.File
+	records int
+	state   storeSnapshot
+}
+
+func (s *store) snapshotPath() string { return filepath.Join(s.dir, "trustlines.snapshot") }
+func (s *store) walPath() string      { return filepath.Join(s.dir, "trustlines.wal") }
+
+// openStore loads the snapshot and replays the WAL on top of it.
+func openStore(dir string) (*store, error) {
+	s := &store{dir: dir, state: storeSnapshot{Trustlines: make(map[string]*Trustline)}}
+	b, err := ioutil.ReadFile(s.snapshotPath())
+	if err == nil {
+		if err := json.Unmarshal(b, &s.state); err != nil {
+			return nil, err
+		}
+		if s.state.Trustlines == nil {
+			s.state.Trustlines = make(map[string]*Trustline)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if f, err := os.Open(s.walPath()); err == nil {
+		sc := bufio.NewScanner(f)
+		for sc.Scan() {
+			var r storeRecord
+			if err := json.Unmarshal(sc.Bytes(), &r); err != nil {
+				// A torn last line from a crash mid-write
+				break
+			}
+			s.apply(&r)
+		}
+		f.Close()
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if err := s.snapshot(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *store) apply(r *storeRecord) {
+	if r.Trustline == nil {
+		delete(s.state.Trustlines, r.PeerID)
+	} else {
+		s.state.Trustlines[r.PeerID] = r.Trustline
+	}
+	s.state.ChainBalance = r.ChainBalance
+	s.state.HasBalance = true
+}
+
+// snapshot writes the current state to a new snapshot and starts an empty WAL.
+func (s *store) snapshot() error {
+	b, err := json.Marshal(&s.state)
+	if err != nil {
+		return err
+	}
+	tmp := s.snapshotPath() + ".tmp"
+	if err := writeSynced(tmp, b); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.snapshotPath()); err != nil {
+		return err
+	}
+	if s.wal != nil {
+		s.wal.Close()
+	}
+	s.wal, err = os.OpenFile(s.walPath(), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	s.records = 0
+	return err
+}
+
+func writeSynced(path string, b []byte) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// save durably records the trustline with peerID, or its removal if tl is
+// nil, along with our chain balance.
+func (s *store) save(peerID string, tl *Trustline, chainBalance uint32) error {
+	r := &storeRecord{PeerID: peerID, ChainBalance: chainBalance}
+	if tl != nil {
+		// Copy, so later changes in memory don't leak into the snapshot
+		c := *tl
+		c.Version = trustlineVersion
+		r.Trustline = &c
+	}
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	if _, err := s.wal.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	if err := s.wal.Sync(); err != nil {
+		return err
+	}
+	s.apply(r)
+	s.records++
+	if s.records >= snapshotEvery {
+		return s.snapshot()
+	}
+	return nil
+}
+
+// trustlines returns copies of the stored trustlines.
+func (s *store) trustlines() map[string]*Trustline {
+	tls := make(map[string]*Trustline)
+	for id, tl := range s.state.Trustlines {
+		c := *tl
+		tls[id] = &c
+	}
+	return tls
+}
+
+// chainBalance returns the last saved confirmed chain balance, if any.
+func (s *store) chainBalance() (uint32, bool) {
+	return s.state.ChainBalance, s.state.HasBalance
+}
+
+// saveTrustline persists peer's trustline. Pending proposals aren't saved.
+func (host *Host) saveTrustline(peer *Peer) {
+	if host.store == nil || peer.trustline == nil {
+		return
+	}
+	if err := host.store.save(peer.PeerID, peer.trustline, host.chainBalance); err != nil {
+		fmt.Printf("\nErr: Could not save trustline with %s: %v\n", peer.PeerID, err)
+		fmt.Print("> ")
+	}
+}
+
+// restoreTrustlines loads the stored trustlines as offline peers. Must run
+// before the stateManager starts.
+func (host *Host) restoreTrustlines() {
+	for id, tl := range host.store.trustlines() {
+		host.peerIDtoPeer[id] = &Peer{PeerID: id, trustline: tl.withDefaultLimits()}
+	}
+	if bal, ok := host.store.chainBalance(); ok {
+		host.chainBalance = bal
+	}
+}
+
+// disconnected drops a connection. An accepted trustline stays known as an
+// offline peer, a pending proposal is forgotten.
+func (host *Host) disconnected(peer *Peer) {
+	if cur, ok := host.peerIDtoPeer[peer.PeerID]; !ok || cur != peer {
+		return
+	}
+	if peer.pending && !peer.resuming {
+		delete(host.peerIDtoPeer, peer.PeerID)
+		return
+	}
+	host.peerIDtoPeer[peer.PeerID] = &Peer{PeerID: peer.PeerID, trustline: peer.trustline}
+	fmt.Printf("\n%s went offline\n", peer.PeerID)
+	fmt.Print("> ")
+	host.announceEdges()
+}
+
+// resumeTrustline answers a Resume from a peer reconnecting to an existing
+// trustline. The connection took over the known trustline when it
+// registered.
+func (host *Host) resumeTrustline(prop *Proposal) {
+	peer := prop.peer
+	if !peer.resuming {
+		msg := Message{HostID: host.Name, PeerID: peer.PeerID, Type: "ResumeReject"}
+		host.sendTo(peer, &msg)
+		host.hangUp(peer)
+		host.disconnected(peer)
+		return
+	}
+	peer.pending = false
+	peer.resuming = false
+	msg := Message{HostID: host.Name, PeerID: peer.PeerID, Type: "ResumeAccept"}
+	host.sendTo(peer, &msg)
+	fmt.Printf("\n%s is back online!\n", peer.PeerID)
+	fmt.Print("> ")
+	host.resendUnacked(peer)
+	host.newNeighbour(peer)
+}
+
+// refuseProposal answers a Propose from a peer we already have a trustline
+// with. Accepting it would start the trustline over from nothing, so it is
+// refused, and the trustline is kept for when the peer resumes it.
+func (host *Host) refuseProposal(prop *Proposal) {
+	peer := prop.peer
+	fmt.Printf("\nErr: %s proposed a trustline, but we already have one with it; refused\n", peer.PeerID)
+	fmt.Print("> ")
+	msg := Message{HostID: host.Name, PeerID: peer.PeerID, Type: "ProposeReject", Reason: "trustline already exists"}
+	host.sendTo(peer, &msg)
+	host.hangUp(peer)
+	host.disconnected(peer)
+}
+
+// reconnect dials an offline peer and asks to resume the trustline.
+func (host *Host) reconnect(peerID string, pi *PeerInfo) error {
+	err := host.createConnection(peerID, pi)
+	if err != nil {
+		return err
+	}
+	msg := Message{HostID: host.Name, PeerID: peerID, Type: "Resume"}
+	host.outbound <- &msg
+	return nil
+}
+
+// reconnectAll tries to resume every offline trustline, looking peers up as
+// resolve does.
+func (host *Host) reconnectAll() {
+	var offline []string
+	host.run(func() {
+		for id, peer := range host.peerIDtoPeer {
+			if !peer.online() {
+				offline = append(offline, id)
+			}
+		}
+	})
+	if len(offline) == 0 {
+		return
+	}
+	for _, id := range offline {
+		pi, err := host.resolve(id)
+		if err == nil {
+			err = host.reconnect(id, pi)
+		}
+		if err != nil {
+			fmt.Printf("\nErr: Could not reconnect to %s: %v\n", id, err)
+			fmt.Print("> ")
+		}
+	}
+}
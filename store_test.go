@@ -0,0 +1,197 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestStoreReopen(t *testing.T) {
+	dir := t.TempDir()
+	s, err := openStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Enough saves to go through a snapshot and leave records in the WAL
+	for i := 1; i <= snapshotEvery+10; i++ {
+		s.save("bob", &Trustline{HostBalance: -i, PeerBalance: i}, uint32(i))
+	}
+	s.save("carol", &Trustline{HostBalance: 5, PeerBalance: -5}, 7)
+	s.save("dave", &Trustline{}, 7)
+	s.save("dave", nil, 7)
+	s.wal.Close()
+
+	s, err = openStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tls := s.trustlines()
+	if len(tls) != 2 || tls["bob"].HostBalance != -(snapshotEvery+10) || tls["carol"].HostBalance != 5 {
+		t.Fatalf("reopened trustlines: %+v", tls)
+	}
+	if bal, ok := s.chainBalance(); !ok || bal != 7 {
+		t.Fatalf("chain balance = %d, %v", bal, ok)
+	}
+}
+
+func TestRestoreTrustlines(t *testing.T) {
+	dir := t.TempDir()
+	chain := newMemChain()
+	chain.Register("alice", 50, "pw", PeerInfo{})
+	chain.Register("bob", 0, "pw", PeerInfo{})
+
+	host := newTestHost(t, "alice", chain)
+	host.store, _ = openStore(dir)
+	go host.stateManager()
+	bob := testPeer(host, "bob")
+	host.outbound <- &Message{HostID: "alice", PeerID: "bob", Type: "Pay", Amount: 20}
+	ackPay(t, host, bob)
+	host.outbound <- &Message{HostID: "alice", PeerID: "bob", Type: "Settle", Amount: 5}
+	next(bob)
+
+	// Restart: bob's trustline is back, offline, with the same balance
+	restarted := newHost("alice", 0, chain)
+	restarted.store, _ = openStore(dir)
+	restarted.restoreTrustlines()
+	peer, ok := restarted.peerIDtoPeer["bob"]
+	if !ok || peer.online() {
+		t.Fatalf("bob restored as %+v", peer)
+	}
+	if peer.trustline.HostBalance != -15 || peer.trustline.SettledOut != 5 || restarted.chainBalance != 45 {
+		t.Fatalf("restored %+v, chain balance %d", peer.trustline, restarted.chainBalance)
+	}
+
+	// Limits of 0 agreed on stay 0, while a record from before limits gets
+	// the default
+	host.run(func() {
+		bob.trustline.HostLimit, bob.trustline.PeerLimit = 0, 0
+		host.saveTrustline(bob)
+		host.store.save("carol", &Trustline{HostBalance: 3}, host.chainBalance)
+		host.store.state.Trustlines["carol"].Version = 0
+		host.store.snapshot()
+	})
+	restarted = newHost("alice", 0, chain)
+	restarted.store, _ = openStore(dir)
+	restarted.restoreTrustlines()
+	if tl := restarted.peerIDtoPeer["bob"].trustline; tl.HostLimit != 0 || tl.PeerLimit != 0 {
+		t.Fatalf("bob restored with limits %d/%d", tl.HostLimit, tl.PeerLimit)
+	}
+	if tl := restarted.peerIDtoPeer["carol"].trustline; tl.HostLimit != defaultTrustlineLimit || tl.PeerLimit != defaultTrustlineLimit {
+		t.Fatalf("carol restored with limits %d/%d", tl.HostLimit, tl.PeerLimit)
+	}
+}
+
+// listen starts accepting connections for host on a loopback port.
+func listen(t *testing.T, host *Host) (*net.TCPListener, *PeerInfo) {
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go host.connectionListener(ln)
+	host.IP, host.Port = "127.0.0.1", uint16(ln.Addr().(*net.TCPAddr).Port)
+	pi := host.peerInfo()
+	host.chain.Register(host.Name, 0, host.password, pi)
+	return ln, &pi
+}
+
+// acceptProposal answers the next proposal on host with "y", like the REPL.
+func acceptProposal(t *testing.T, host *Host) {
+	t.Helper()
+	waitFor(t, host, func() bool { return host.urgentcmd.Head() != nil })
+	queue(host, answerProposal(host, true, nil))
+}
+
+func TestResumeAfterRestart(t *testing.T) {
+	chain := newMemChain()
+	alice := newTestHost(t, "alice", chain)
+	alice.store, _ = openStore(t.TempDir())
+	go alice.stateManager()
+	bobDir := t.TempDir()
+	bob := newTestHost(t, "bob", chain)
+	bob.store, _ = openStore(bobDir)
+	bob.history, _ = openHistory(historyPath(bobDir))
+	go bob.stateManager()
+	ln, pi := listen(t, bob)
+
+	if err := alice.createConnection("bob", pi); err != nil {
+		t.Fatal(err)
+	}
+	alice.outbound <- &Message{HostID: "alice", PeerID: "bob", Type: "Propose", Limit: defaultTrustlineLimit}
+	acceptProposal(t, bob)
+	waitFor(t, alice, func() bool { return !alice.peerIDtoPeer["bob"].pending })
+	alice.outbound <- &Message{HostID: "alice", PeerID: "bob", Type: "Pay", Amount: 10}
+	waitFor(t, bob, func() bool { return bob.peerIDtoPeer["alice"].trustline.HostBalance == 10 })
+
+	// Bob goes away and comes back from his data directory
+	ln.Close()
+	alice.run(func() { alice.peerIDtoPeer["bob"].socket.Close() })
+	waitFor(t, alice, func() bool { return !alice.peerIDtoPeer["bob"].online() })
+
+	bob2 := newTestHost(t, "bob", chain)
+	bob2.store, _ = openStore(bobDir)
+	// Tells bob2 which payments it already credited, in case alice missed
+	// an ack
+	bob2.history, _ = openHistory(historyPath(bobDir))
+	bob2.restoreTrustlines()
+	go bob2.stateManager()
+	_, pi = listen(t, bob2)
+
+	// No new proposal: the same trustline picks up where it left off
+	if err := alice.reconnect("bob", pi); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, alice, func() bool {
+		peer := alice.peerIDtoPeer["bob"]
+		return peer.online() && !peer.pending
+	})
+	alice.outbound <- &Message{HostID: "alice", PeerID: "bob", Type: "Pay", Amount: 5}
+	waitFor(t, bob2, func() bool { return bob2.peerIDtoPeer["alice"].trustline.HostBalance == 15 })
+	waitFor(t, alice, func() bool { return alice.peerIDtoPeer["bob"].trustline.HostBalance == -15 })
+}
+
+func TestProposeOverTrustlineRefused(t *testing.T) {
+	host := newTestHost(t, "alice", newMemChain())
+	go host.stateManager()
+	bob := testPeer(host, "bob")
+	tl := bob.trustline
+	host.run(func() { tl.HostBalance, tl.PeerBalance = -10, 10 })
+
+	// Bob comes back having lost the trustline, and proposes a new one
+	// The connection is hung up on, so its frames are read from data
+	data := make(chan []byte, 16)
+	conn := &Peer{PeerID: "bob", data: data}
+	host.register <- conn
+	host.proposal <- &Proposal{conn, &Message{HostID: "bob", PeerID: "alice", Type: "Propose", Limit: 100}}
+	if msg := parseRawBytes(<-data); msg.Type != "ProposeReject" {
+		t.Fatalf("peer got %+v", msg)
+	}
+	host.run(func() {
+		peer := host.peerIDtoPeer["bob"]
+		if peer == nil || peer.online() || peer.trustline != tl || tl.HostBalance != -10 {
+			t.Errorf("bob is now %+v", peer)
+		}
+		if host.urgentcmd.Head() != nil {
+			t.Error("proposal left at the prompt")
+		}
+	})
+}
+
+func TestAnswerProposalAfterDisconnect(t *testing.T) {
+	host := newTestHost(t, "bob", newMemChain())
+	go host.stateManager()
+	for _, accept := range []bool{true, false} {
+		// Alice proposes, then goes away before we answer
+		socket, _ := net.Pipe()
+		conn := &Peer{PeerID: "alice", socket: socket, trustline: &Trustline{}, data: make(chan []byte, 16), pending: true}
+		host.register <- conn
+		host.proposal <- &Proposal{conn, &Message{HostID: "alice", PeerID: "bob", Type: "Propose", Limit: 100}}
+		host.unregister <- conn
+		if msgs := answerProposal(host, accept, nil); len(msgs) != 0 {
+			t.Fatalf("answered with %+v", msgs)
+		}
+		host.run(func() {
+			if host.urgentcmd.Head() != nil || host.peerIDtoPeer["alice"] != nil {
+				t.Errorf("left %v at the prompt, alice as %+v", host.urgentcmd.Head(), host.peerIDtoPeer["alice"])
+			}
+		})
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"time"
+)
+
+// Connections are encrypted with TLS unless a node runs with --insecure. Both
+// sides offer the "tls" feature in their Hello and switch the connection over
+// to TLS straight after the HelloAck. Certificates are self-signed with the
+// node's key; each node publishes its certificate's fingerprint in its
+// peering_info, and peers accept only that certificate. The Hello and
+// HelloAck are signed, so the feature can't be stripped to downgrade a
+// connection.
+
+const tlsFeature = "tls"
+
+// newCert makes a self-signed certificate for key. Nothing in it depends on
+// when it is made, and Ed25519 signatures are deterministic, so the same key
+// always gets the same certificate and the fingerprint others pinned holds
+// across restarts.
+func newCert(key ed25519.PrivateKey) (tls.Certificate, error) {
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Unix(0, 0).UTC(),
+		// RFC 5280's "no well-defined expiration date"
+		NotAfter: time.Date(9999, 12, 31, 23, 59, 59, 0, time.UTC),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+func fingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:])
+}
+
+// setKey makes key the node's identity, along with a certificate for it.
+func (host *Host) setKey(key ed25519.PrivateKey) error {
+	cert, err := newCert(key)
+	if err != nil {
+		return err
+	}
+	host.key = key
+	host.cert = cert
+	return nil
+}
+
+// peerInfo is what we publish on the chain for others to reach us.
+func (host *Host) peerInfo() PeerInfo {
+	pi := PeerInfo{IP: host.IP, Port: host.Port, PublicKey: host.publicKey(), Addr: host.addr}
+	if !host.insecure {
+		pi.Fingerprint = fingerprint(host.cert.Certificate[0])
+	}
+	return pi
+}
+
+// features are the optional protocol features this node offers.
+func (host *Host) features() []string {
+	if host.insecure {
+		return supportedFeatures
+	}
+	return append([]string{tlsFeature}, supportedFeatures...)
+}
+
+// tlsConfig accepts only the certificate pinned by fp.
+func (host *Host) tlsConfig(fp string) *tls.Config {
+	return &tls.Config{
+		Certificates:       []tls.Certificate{host.cert},
+		MinVersion:         tls.VersionTLS13,
+		ClientAuth:         tls.RequireAnyClientCert,
+		InsecureSkipVerify: true, // Checked against the pin instead
+		VerifyPeerCertificate: func(raw [][]byte, _ [][]*x509.Certificate) error {
+			if len(raw) == 0 {
+				return errors.New("no certificate")
+			}
+			if fingerprint(raw[0]) != fp {
+				return errors.New("certificate does not match the published fingerprint")
+			}
+			return nil
+		},
+	}
+}
+
+// bufferedConn reads through the frame reader's buffer, so nothing it read
+// ahead is lost when TLS takes over the connection.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// startTLS switches peer's connection over to TLS once both sides agreed to
+// it in the handshake.
+func (host *Host) startTLS(peer *Peer, client bool) error {
+	if !peer.features[tlsFeature] {
+		if host.insecure {
+			return nil
+		}
+		return fmt.Errorf("%s does not encrypt connections", peer.PeerID)
+	}
+	if peer.PeerInfo == nil || peer.PeerInfo.Fingerprint == "" {
+		return fmt.Errorf("%s has not published a certificate fingerprint", peer.PeerID)
+	}
+	raw := &bufferedConn{peer.socket, peer.frames.r}
+	var conn *tls.Conn
+	if client {
+		conn = tls.Client(raw, host.tlsConfig(peer.PeerInfo.Fingerprint))
+	} else {
+		conn = tls.Server(raw, host.tlsConfig(peer.PeerInfo.Fingerprint))
+	}
+	if err := conn.Handshake(); err != nil {
+		return fmt.Errorf("TLS with %s: %v", peer.PeerID, err)
+	}
+	peer.socket = conn
+	peer.frames = newFrameReader(conn)
+	return nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"crypto/tls"
+	"strings"
+	"testing"
+)
+
+func TestEncryptedConnection(t *testing.T) {
+	chain := newMemChain()
+	alice := newTestHost(t, "alice", chain)
+	go alice.stateManager()
+	bob := newTestHost(t, "bob", chain)
+	go bob.stateManager()
+	_, pi := listen(t, bob)
+
+	if err := alice.createConnection("bob", pi); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, bob, func() bool {
+		peer, ok := bob.peerIDtoPeer["alice"]
+		return ok && peer.online()
+	})
+	for _, host := range []*Host{alice, bob} {
+		host.run(func() {
+			for _, peer := range host.peerIDtoPeer {
+				if _, ok := peer.socket.(*tls.Conn); !ok {
+					t.Errorf("%s talks to %s over %T", host.Name, peer.PeerID, peer.socket)
+				}
+			}
+		})
+	}
+
+	// A certificate other than the published one is refused
+	wrong := *pi
+	wrong.Fingerprint = fingerprint(alice.cert.Certificate[0])
+	if err := alice.createConnection("bob", &wrong); err == nil || !strings.Contains(err.Error(), "fingerprint") {
+		t.Fatalf("connected to an unpinned certificate: %v", err)
+	}
+
+	// Plaintext only with --insecure on both sides
+	carol := newTestHost(t, "carol", chain)
+	carol.insecure = true
+	go carol.stateManager()
+	if err := carol.createConnection("bob", pi); err == nil || !strings.Contains(err.Error(), "encryption required") {
+		t.Fatalf("insecure node got in: %v", err)
+	}
+	dave := newTestHost(t, "dave", chain)
+	dave.insecure = true
+	go dave.stateManager()
+	_, pi = listen(t, dave)
+	if err := carol.createConnection("dave", pi); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCertSurvivesRestart(t *testing.T) {
+	key := newKey()
+	a, err := newCert(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := newCert(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fingerprint(a.Certificate[0]) != fingerprint(b.Certificate[0]) {
+		t.Error("the same key got a different certificate")
+	}
+}
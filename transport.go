@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// A Transport carries frames between nodes. A node advertises where it
+// listens in its PeerInfo, and peers dial it with the transport named by the
+// address's scheme.
+type Transport interface {
+	Dial(addr string) (net.Conn, error)
+	Listen(addr string) (net.Listener, error)
+}
+
+// transports are the available transports by scheme.
+var transports = map[string]Transport{
+	"tcp":  tcpTransport{},
+	"unix": unixTransport{},
+	"mem":  memNet,
+	"ws":   wsTransport{},
+}
+
+// endpoint splits the address pi advertises into a scheme and an address for
+// that transport. Nodes that only advertise an IP and port use TCP.
+func (pi *PeerInfo) endpoint() (string, string) {
+	if pi.Addr == "" {
+		return "tcp", net.JoinHostPort(pi.IP, strconv.Itoa(int(pi.Port)))
+	}
+	if i := strings.Index(pi.Addr, "://"); i >= 0 {
+		return pi.Addr[:i], pi.Addr[i+3:]
+	}
+	return "tcp", pi.Addr
+}
+
+// dialPeer connects to the address pi advertises.
+func dialPeer(pi *PeerInfo) (net.Conn, error) {
+	scheme, addr := pi.endpoint()
+	t, ok := transports[scheme]
+	if !ok {
+		return nil, fmt.Errorf("unknown transport %q", scheme)
+	}
+	return t.Dial(addr)
+}
+
+type tcpTransport struct{}
+
+func (tcpTransport) Dial(addr string) (net.Conn, error) {
+	return net.Dial("tcp", addr)
+}
+
+func (tcpTransport) Listen(addr string) (net.Listener, error) {
+	return net.Listen("tcp", addr)
+}
+
+// unixTransport listens on a socket file, for nodes on the same machine.
+type unixTransport struct{}
+
+func (unixTransport) Dial(addr string) (net.Conn, error) {
+	return net.Dial("unix", addr)
+}
+
+func (unixTransport) Listen(addr string) (net.Listener, error) {
+	// A socket left over from a node that didn't shut down cleanly
+	if err := os.Remove(addr); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return net.Listen("unix", addr)
+}
+
+// memTransport connects nodes in the same process over net.Pipe, without
+// using any ports. Addresses are just names.
+type memTransport struct {
+	mu        sync.Mutex
+	listeners map[string]*memListener
+}
+
+var memNet = &memTransport{listeners: make(map[string]*memListener)}
+
+func (t *memTransport) Dial(addr string) (net.Conn, error) {
+	t.mu.Lock()
+	l, ok := t.listeners[addr]
+	t.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("mem://%s: connection refused", addr)
+	}
+	client, server := net.Pipe()
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.done:
+		return nil, fmt.Errorf("mem://%s: connection refused", addr)
+	}
+}
+
+func (t *memTransport) Listen(addr string) (net.Listener, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.listeners[addr]; ok {
+		return nil, fmt.Errorf("mem://%s: address already in use", addr)
+	}
+	l := &memListener{t: t, addr: memAddr(addr), conns: make(chan net.Conn), done: make(chan struct{})}
+	t.listeners[addr] = l
+	return l, nil
+}
+
+type memListener struct {
+	t     *memTransport
+	addr  memAddr
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+func (l *memListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *memListener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+		l.t.mu.Lock()
+		delete(l.t.listeners, string(l.addr))
+		l.t.mu.Unlock()
+	})
+	return nil
+}
+
+func (l *memListener) Addr() net.Addr {
+	return l.addr
+}
+
+type memAddr string
+
+func (a memAddr) Network() string { return "mem" }
+func (a memAddr) String() string  { return string(a) }
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// listenOn starts accepting connections for host over the transport for
+// scheme and publishes the address on the chain.
+func listenOn(t *testing.T, host *Host, scheme string, addr string) *PeerInfo {
+	ln, err := transports[scheme].Listen(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go host.connectionListener(ln)
+	if scheme == "ws" {
+		// Listening on port 0
+		addr = ln.Addr().String() + wsPath
+	}
+	host.addr = scheme + "://" + addr
+	pi := host.peerInfo()
+	host.chain.Register(host.Name, 0, host.password, pi)
+	return &pi
+}
+
+func TestTransports(t *testing.T) {
+	for _, scheme := range []string{"mem", "unix", "ws"} {
+		t.Run(scheme, func(t *testing.T) {
+			chain := newMemChain()
+			dir := t.TempDir()
+			names := []string{"alice", "bob", "carol"}
+			hosts := make(map[string]*Host)
+			infos := make(map[string]*PeerInfo)
+			for _, name := range names {
+				host := newTestHost(t, name, chain)
+				go host.stateManager()
+				addr := t.Name() + "/" + name
+				switch scheme {
+				case "unix":
+					addr = filepath.Join(dir, name+".sock")
+				case "ws":
+					addr = "127.0.0.1:0" + wsPath
+				}
+				hosts[name] = host
+				infos[name] = listenOn(t, host, scheme, addr)
+			}
+
+			// A ring of trustlines, each paying the next
+			for i, name := range names {
+				host, next := hosts[name], names[(i+1)%len(names)]
+				if err := host.createConnection(next, infos[next]); err != nil {
+					t.Fatal(err)
+				}
+				host.outbound <- &Message{HostID: name, PeerID: next, Type: "Propose", Limit: defaultTrustlineLimit}
+				acceptProposal(t, hosts[next])
+				waitFor(t, host, func() bool { return !host.peerIDtoPeer[next].pending })
+				host.outbound <- &Message{HostID: name, PeerID: next, Type: "Pay", Amount: uint32(i + 1)}
+			}
+			for i, name := range names {
+				host, next := hosts[name], names[(i+1)%len(names)]
+				waitFor(t, host, func() bool { return host.peerIDtoPeer[next].trustline.HostBalance == -(i + 1) })
+			}
+		})
+	}
+}
+
+func TestEndpoint(t *testing.T) {
+	for _, c := range []struct {
+		pi     PeerInfo
+		scheme string
+		addr   string
+	}{
+		{PeerInfo{IP: "127.0.0.1", Port: 4000}, "tcp", "127.0.0.1:4000"},
+		{PeerInfo{IP: "::1", Port: 4000}, "tcp", "[::1]:4000"},
+		{PeerInfo{Addr: "unix:///tmp/alice.sock"}, "unix", "/tmp/alice.sock"},
+		{PeerInfo{Addr: "mem://alice"}, "mem", "alice"},
+		{PeerInfo{IP: "10.0.0.1", Port: 4000, Addr: "ws://10.0.0.1:8080/p2p"}, "ws", "10.0.0.1:8080/p2p"},
+	} {
+		if scheme, addr := c.pi.endpoint(); scheme != c.scheme || addr != c.addr {
+			t.Errorf("%+v: got %s %s", c.pi, scheme, addr)
+		}
+	}
+	if _, err := dialPeer(&PeerInfo{Addr: "carrier-pigeon://alice"}); err == nil {
+		t.Error("dialed an unknown transport")
+	}
+}
+
+func TestSharedPort(t *testing.T) {
+	chain := newMemChain()
+	alice := newTestHost(t, "alice", chain)
+	go alice.stateManager()
+	bob := newTestHost(t, "bob", chain)
+	go bob.stateManager()
+	carol := newTestHost(t, "carol", chain)
+	go carol.stateManager()
+
+	// Bob takes plain and WebSocket connections on the same port
+	ln, err := transports["tcp"].Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, ws := listenShared(ln, wsPath)
+	t.Cleanup(func() { plain.Close() })
+	go bob.connectionListener(plain)
+	go bob.connectionListener(ws)
+	addr := ln.Addr().String()
+	bob.addr = "ws://" + addr + wsPath
+	chain.Register("bob", 0, bob.password, bob.peerInfo())
+
+	wsInfo := bob.peerInfo()
+	tcpInfo := bob.peerInfo()
+	tcpInfo.Addr = "tcp://" + addr
+	openTrustline(t, alice, bob, &tcpInfo)
+	openTrustline(t, carol, bob, &wsInfo)
+	waitFor(t, bob, func() bool {
+		a, c := bob.peerIDtoPeer["alice"], bob.peerIDtoPeer["carol"]
+		return a != nil && !a.pending && c != nil && !c.pending
+	})
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// wsTransport carries frames as binary WebSocket messages, for nodes behind
+// proxies that only let HTTP through. Addresses are host:port/path. Dialing
+// goes through the proxy set in the environment, if any.
+type wsTransport struct{}
+
+// wsPath is where nodes accept WebSocket connections.
+const wsPath = "/p2p"
+
+var wsUpgrader = websocket.Upgrader{
+	// Nodes authenticate each other in the handshake, not by origin, so
+	// browser peers are welcome
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+func (wsTransport) Dial(addr string) (net.Conn, error) {
+	conn, _, err := websocket.DefaultDialer.Dial("ws://"+addr, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &wsConn{Conn: conn}, nil
+}
+
+func (wsTransport) Listen(addr string) (net.Listener, error) {
+	hostport, path := addr, wsPath
+	if i := strings.Index(addr, "/"); i >= 0 {
+		hostport, path = addr[:i], addr[i:]
+	}
+	ln, err := net.Listen("tcp", hostport)
+	if err != nil {
+		return nil, err
+	}
+	return serveWS(ln, path), nil
+}
+
+// serveWS accepts WebSocket connections to path on ln.
+func serveWS(ln net.Listener, path string) *wsListener {
+	l := &wsListener{ln: ln, conns: make(chan net.Conn), done: make(chan struct{})}
+	mux := http.NewServeMux()
+	mux.HandleFunc(path, l.upgrade)
+	l.srv = &http.Server{Handler: mux}
+	go l.srv.Serve(ln)
+	return l
+}
+
+// listenShared takes both plain and WebSocket connections on ln, and returns
+// a listener for each. They are told apart by how they open: a WebSocket
+// connection with an HTTP "GET ", a plain one with a frame, whose length
+// prefix is never followed by "ET ".
+func listenShared(ln net.Listener, path string) (plain net.Listener, ws net.Listener) {
+	m := &portMux{ln: ln, done: make(chan struct{})}
+	p, h := m.side(), m.side()
+	go m.run(p, h)
+	return p, serveWS(h, path)
+}
+
+// A portMux sorts the connections on one listener between its sides.
+type portMux struct {
+	ln   net.Listener
+	done chan struct{}
+	once sync.Once
+}
+
+func (m *portMux) side() *muxSide {
+	return &muxSide{m: m, conns: make(chan net.Conn)}
+}
+
+func (m *portMux) run(plain *muxSide, web *muxSide) {
+	for {
+		conn, err := m.ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			m.close()
+			return
+		} else if err != nil {
+			continue
+		}
+		go m.sort(conn, plain, web)
+	}
+}
+
+// sort hands conn to the side it belongs to once its first bytes are in.
+func (m *portMux) sort(conn net.Conn, plain *muxSide, web *muxSide) {
+	r := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	head, err := r.Peek(len("GET "))
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		conn.Close()
+		return
+	}
+	to := plain
+	if string(head) == "GET " {
+		to = web
+	}
+	select {
+	case to.conns <- &peekedConn{Conn: conn, r: r}:
+	case <-m.done:
+		conn.Close()
+	}
+}
+
+func (m *portMux) close() error {
+	var err error
+	m.once.Do(func() {
+		close(m.done)
+		err = m.ln.Close()
+	})
+	return err
+}
+
+// A muxSide is a listener for the connections a portMux sorts its way.
+// Closing either side closes the port.
+type muxSide struct {
+	m     *portMux
+	conns chan net.Conn
+}
+
+func (s *muxSide) Accept() (net.Conn, error) {
+	select {
+	case conn := <-s.conns:
+		return conn, nil
+	case <-s.m.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (s *muxSide) Close() error {
+	return s.m.close()
+}
+
+func (s *muxSide) Addr() net.Addr {
+	return s.m.ln.Addr()
+}
+
+// peekedConn is a connection whose first bytes were read to sort it, and
+// are read again from r.
+type peekedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *peekedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+type wsListener struct {
+	ln    net.Listener
+	srv   *http.Server
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+func (l *wsListener) upgrade(w http.ResponseWriter, r *http.Request) {
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade already answered with an error
+		return
+	}
+	select {
+	case l.conns <- &wsConn{Conn: conn}:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+func (l *wsListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *wsListener) Close() error {
+	var err error
+	l.once.Do(func() {
+		close(l.done)
+		err = l.srv.Close()
+	})
+	return err
+}
+
+func (l *wsListener) Addr() net.Addr {
+	return l.ln.Addr()
+}
+
+// wsConn is a WebSocket connection as a byte stream. Frames may be split
+// across messages or share one, so reads just carry on into the next
+// message.
+type wsConn struct {
+	*websocket.Conn
+	r io.Reader
+}
+
+func (c *wsConn) Read(b []byte) (int, error) {
+	for {
+		if c.r == nil {
+			_, r, err := c.NextReader()
+			if err != nil {
+				return 0, err
+			}
+			c.r = r
+		}
+		n, err := c.r.Read(b)
+		if err == io.EOF {
+			c.r = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (c *wsConn) Write(b []byte) (int, error) {
+	if err := c.WriteMessage(websocket.BinaryMessage, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *wsConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}